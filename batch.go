@@ -0,0 +1,79 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"context"
+	"sync"
+)
+
+// An option for Client.SendBatch.
+type BatchOption func(*batchConfig)
+
+type batchConfig struct {
+	cancelOnError bool
+}
+
+// Option that cancels the requests of the batch still in flight as soon as one of them
+// fails, e.g. when the batch is all-or-nothing at the application level. Errors of nodes
+// with noFail are reported in the responses and don't count as failures.
+func WithCancelOnError() BatchOption {
+	return func(cfg *batchConfig) {
+		cfg.cancelOnError = true
+	}
+}
+
+// Sends several requests concurrently, each one in its own transaction, and waits for all
+// of them. Responses are in the same order as the requests; a failed (or cancelled) request
+// has a nil Response. The returned error is the first one that occurred, if any.
+//
+// All the requests share the context, so cancelling it cancels the whole batch. It returns
+// only after all the requests are done, so no goroutine is left running, e.g. when it's
+// called by the tasks of an errgroup that is cancelled.
+func (c *Client) SendBatch(ctx context.Context, reqs []*Request, opts ...BatchOption) ([]*Response, error) {
+	var cfg batchConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	responses := make([]*Response, len(reqs))
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := range reqs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, _, err := c.SendWithContext(ctx, reqs[i])
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					if cfg.cancelOnError {
+						cancel()
+					}
+				})
+				return
+			}
+			responses[i] = res
+		}(i)
+	}
+	wg.Wait()
+	return responses, firstErr
+}
@@ -0,0 +1,160 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Size of the buffer between the streaming encoder and the request body.
+const streamBufferSize = 32 * 1024
+
+// Builder method that makes the Client stream the JSON of the requests to the server, as
+// it's produced, with a chunked transfer, instead of marshalling it to memory before
+// sending it. Each node, and each item of a batch, is marshalled on its own, so the peak
+// memory depends on the largest item rather than on the whole request; it's meant for big
+// batch inserts.
+//
+// It only works with the default Marshaller and with a ServerProfile that doesn't rename
+// the fields, and it's not compatible with WithMaxRequestBytes, as the size of the request
+// is not known in advance, nor with WithStableMarshalling, as the fields are written in
+// the order they are produced: Build fails otherwise.
+func (cb *ClientBuilder) WithStreamingRequestBody() *ClientBuilder {
+	cb.streamBody = true
+	return cb
+}
+
+// Checks that the streaming of the requests is compatible with the other settings.
+func (cb *ClientBuilder) checkStreamBody() error {
+	if !cb.streamBody {
+		return nil
+	}
+	if _, ok := cb.marshaller.(jsonMarshaller); !ok {
+		return errors.New("a streaming request body requires the default marshaller")
+	}
+	if len(cb.profile.fieldNames) > 0 {
+		return errors.New("a streaming request body requires a profile that doesn't rename fields")
+	}
+	if cb.maxRequestBytes > 0 {
+		return errors.New("a streaming request body is not compatible with maxRequestBytes")
+	}
+	if cb.stableMarshal {
+		return errors.New("a streaming request body is not compatible with stable marshalling")
+	}
+	return nil
+}
+
+// Returns a reader of the JSON of the request, that is written by a goroutine as it's
+// read. Closing the reader stops the goroutine.
+func streamRequest(payload request) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		bw := bufio.NewWriterSize(pw, streamBufferSize)
+		err := encodeRequest(bw, payload)
+		if err == nil {
+			err = bw.Flush()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// Writes the JSON of the request, marshalling a node (or an item of a batch) at a time.
+// It's equivalent to json.Marshal of payload.wire(), apart from the order of the fields and
+// from whitespace.
+func encodeRequest(w io.Writer, payload request) error {
+	// the other fields come first, then the transaction
+	items := payload.Transaction
+	payload.Transaction = nil
+	fields := payload.fields()
+	delete(fields, "transaction")
+	head, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	head = bytes.TrimSuffix(head, []byte("}"))
+	if len(fields) > 0 {
+		head = append(head, ',')
+	}
+	if _, err = w.Write(head); err != nil {
+		return err
+	}
+	if _, err = io.WriteString(w, `"transaction":[`); err != nil {
+		return err
+	}
+	// an Encoder writes directly to w; the newlines it adds are valid whitespace
+	enc := json.NewEncoder(w)
+	for i, item := range items {
+		if i > 0 {
+			if _, err = io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err = encodeRequestItem(w, enc, item); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "]}")
+	return err
+}
+
+// Writes the JSON of a node; the items of a batch are marshalled one at a time, after the
+// other fields.
+func encodeRequestItem(w io.Writer, enc *json.Encoder, item requestItem) error {
+	batch := item.ValuesBatch
+	if batch == nil {
+		return enc.Encode(item.wire())
+	}
+
+	item.ValuesBatch = nil
+	if _, ok := item.Extra["valuesBatch"]; ok {
+		// as with json.Marshal, the extra fields can't override the batch
+		extra := make(map[string]interface{}, len(item.Extra))
+		for k, v := range item.Extra {
+			if k != "valuesBatch" {
+				extra[k] = v
+			}
+		}
+		item.Extra = extra
+	}
+	head, err := json.Marshal(item.wire())
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(bytes.TrimSuffix(head, []byte("}"))); err != nil {
+		return err
+	}
+	if _, err = io.WriteString(w, `,"valuesBatch":[`); err != nil {
+		return err
+	}
+	for i, values := range batch {
+		if i > 0 {
+			if _, err = io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err = enc.Encode(values); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, "]}")
+	return err
+}
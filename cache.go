@@ -0,0 +1,158 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Builder method that enables caching the responses of the requests that contain only
+// queries, for ttl; the cache is keyed by the content of the request (and by the
+// credentials and headers given with the SendOptions, if any), and holds up to size
+// entries, discarding the least recently used ones. Requests with statements are never
+// cached.
+//
+// Each caller receives its own copy of the cached Response (see Response.Clone).
+func (cb *ClientBuilder) WithResponseCache(ttl time.Duration, size int) *ClientBuilder {
+	cb.cacheTTL = ttl
+	cb.cacheSize = size
+	return cb
+}
+
+type cacheEntry struct {
+	key     string
+	res     *Response
+	expires time.Time
+}
+
+// A LRU cache of responses, with expiration. It's safe for concurrent use.
+type responseCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func newResponseCache(ttl time.Duration, size int) *responseCache {
+	return &responseCache{
+		ttl:     ttl,
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (rc *responseCache) get(key string) (*Response, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	el, ok := rc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		rc.lru.Remove(el)
+		delete(rc.entries, key)
+		return nil, false
+	}
+	rc.lru.MoveToFront(el)
+	return entry.res, true
+}
+
+func (rc *responseCache) put(key string, res *Response) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if el, ok := rc.entries[key]; ok {
+		el.Value = &cacheEntry{key, res, time.Now().Add(rc.ttl)}
+		rc.lru.MoveToFront(el)
+		return
+	}
+	rc.entries[key] = rc.lru.PushFront(&cacheEntry{key, res, time.Now().Add(rc.ttl)})
+	for rc.lru.Len() > rc.size {
+		oldest := rc.lru.Back()
+		rc.lru.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Is the request made only of queries?
+func (req *Request) isReadOnly() bool {
+	for i := range req.req.Transaction {
+		if req.req.Transaction[i].Query == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// The options of a call that change who the request is sent as, so they are part of the
+// key of the cache.
+type cacheCallKey struct {
+	SkipInline bool         `json:"skipInline,omitempty"`
+	Inline     *credentials `json:"inline,omitempty"`
+	Headers    http.Header  `json:"headers,omitempty"`
+}
+
+// Computes the key of the cache for a request. It includes the URL, as the cache is shared
+// by the clients derived with WithDatabase; the schemas of the queries (see
+// RequestBuilder.WithResultSchema); and the credentials and headers given for the call
+// (see SendOption), so that a call never gets a response obtained with other ones.
+func (c *Client) cacheKey(ctx context.Context, req *Request) (string, error) {
+	tx, err := json.Marshal(req.req.wire())
+	if err != nil {
+		return "", err
+	}
+	key := c.cfg.url + "\n" + string(tx)
+	// the schemas are applied while parsing, so the cached rows are already converted
+	if schemas := req.schemas(); schemas != nil {
+		bs, err := json.Marshal(schemas)
+		if err != nil {
+			return "", err
+		}
+		key += "\n" + string(bs)
+	}
+	if cfg := callConfig(ctx); cfg != nil && (cfg.skipInline || cfg.inline != nil || cfg.headers != nil) {
+		call, err := json.Marshal(cacheCallKey{SkipInline: cfg.skipInline, Inline: cfg.inline, Headers: cfg.headers})
+		if err != nil {
+			return "", err
+		}
+		key += "\n" + string(call)
+	}
+	return key, nil
+}
+
+// Sends a read-only request, using the cache.
+func (c *Client) sendCached(ctx context.Context, req *Request, attempts int) (*Response, int, error) {
+	key, err := c.cacheKey(ctx, req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if res, ok := c.cache.get(key); ok {
+		return res.Clone(), 200, nil
+	}
+	res, code, err := c.sendWithRetries(ctx, req, attempts)
+	if err == nil {
+		c.cache.put(key, res.Clone())
+	}
+	return res, code, err
+}
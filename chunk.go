@@ -0,0 +1,160 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"context"
+	"fmt"
+)
+
+// Builder method that sets the maximum number of items of a batch; when sending a request
+// with a larger batch, it's split into several requests, each with a chunk of n items
+// (the other nodes are sent along, in order). The results are then merged back, so that
+// the Response matches the original request. 0 (default) means no splitting.
+//
+// Beware that, when a request is split, it's no longer atomic: if a request fails, the
+// ones that were already sent are not rolled back. The failing node is reported in the
+// WsError as in the original request. If a chunk of a batch with WithNoFail fails, the
+// merged ResponseItem is failed, and its RowsUpdatedBatch has 0 for each item of that
+// chunk, so that it still matches the items of the batch.
+func (cb *ClientBuilder) WithBatchChunkSize(n int) *ClientBuilder {
+	cb.batchChunkSize = n
+	return cb
+}
+
+// Does the request need to be split?
+func (c *Client) needsChunking(req *Request) bool {
+	if c.cfg.batchChunkSize <= 0 {
+		return false
+	}
+	for i := range req.req.Transaction {
+		if len(req.req.Transaction[i].ValuesBatch) > c.cfg.batchChunkSize {
+			return true
+		}
+	}
+	return false
+}
+
+// A sub-request of a split request, with the index in the original request of each
+// of its nodes.
+type chunk struct {
+	req     *Request
+	origIdx []int
+}
+
+// Splits a request so that no batch is larger than the chunk size.
+func (c *Client) split(req *Request) []chunk {
+	var ret []chunk
+	newChunk := func() chunk {
+		return chunk{req: &Request{req: request{
+			ReadOnly: req.req.ReadOnly,
+			Metadata: req.req.Metadata,
+			Extra:    req.req.Extra,
+		}}}
+	}
+	cur := newChunk()
+	flush := func() {
+		if len(cur.origIdx) > 0 {
+			ret = append(ret, cur)
+		}
+		cur = newChunk()
+	}
+	for i, item := range req.req.Transaction {
+		if len(item.ValuesBatch) <= c.cfg.batchChunkSize {
+			cur.req.req.Transaction = append(cur.req.req.Transaction, item)
+			cur.origIdx = append(cur.origIdx, i)
+			continue
+		}
+		for start := 0; start < len(item.ValuesBatch); start += c.cfg.batchChunkSize {
+			end := start + c.cfg.batchChunkSize
+			if end > len(item.ValuesBatch) {
+				end = len(item.ValuesBatch)
+			}
+			part := item
+			part.ValuesBatch = item.ValuesBatch[start:end]
+			cur.req.req.Transaction = append(cur.req.req.Transaction, part)
+			cur.origIdx = append(cur.origIdx, i)
+			flush()
+		}
+	}
+	flush()
+	for i := range ret {
+		if req.idempotencyKey != "" {
+			ret[i].req.idempotencyKey = fmt.Sprintf("%s-%d", req.idempotencyKey, i)
+		}
+	}
+	return ret
+}
+
+// Sends a request splitting its batches, and merges the responses.
+func (c *Client) sendChunked(ctx context.Context, req *Request, attempts int) (*Response, int, error) {
+	ret := &Response{Results: make([]ResponseItem, len(req.req.Transaction))}
+	seen := make([]bool, len(req.req.Transaction))
+	code := 0
+	for _, ch := range c.split(req) {
+		res, cd, err := c.sendWithRetries(ctx, ch.req, attempts)
+		code = cd
+		if err != nil {
+			return nil, code, remapRequestIdx(err, ch.origIdx)
+		}
+		if len(res.Results) != len(ch.origIdx) {
+			return nil, code, fmt.Errorf("expected %d results, got %d", len(ch.origIdx), len(res.Results))
+		}
+		for j, item := range res.Results {
+			idx := ch.origIdx[j]
+			split := len(req.req.Transaction[idx].ValuesBatch) > c.cfg.batchChunkSize
+			if n := len(ch.req.req.Transaction[j].ValuesBatch); split && len(item.RowsUpdatedBatch) < n {
+				// a failed chunk has no counts
+				counts := make([]int64, n)
+				copy(counts, item.RowsUpdatedBatch)
+				item.RowsUpdatedBatch = counts
+			}
+			if !seen[idx] {
+				seen[idx] = true
+				ret.Results[idx] = item
+				continue
+			}
+			merged := &ret.Results[idx]
+			merged.RowsUpdatedBatch = append(merged.RowsUpdatedBatch, item.RowsUpdatedBatch...)
+			if item.LastInsertID != nil {
+				merged.LastInsertID = item.LastInsertID
+			}
+			if merged.Success && !item.Success {
+				merged.Success = false
+				merged.Error = item.Error
+			}
+		}
+	}
+	return ret, code, nil
+}
+
+// Translates the index of the failing node of a sub-request to the original request.
+func remapRequestIdx(err error, origIdx []int) error {
+	switch e := err.(type) {
+	case WsError:
+		if e.RequestIdx >= 0 && e.RequestIdx < len(origIdx) {
+			e.RequestIdx = origIdx[e.RequestIdx]
+		}
+		return e
+	case WsErrorWithValues:
+		if e.RequestIdx >= 0 && e.RequestIdx < len(origIdx) {
+			e.RequestIdx = origIdx[e.RequestIdx]
+		}
+		return e
+	}
+	return err
+}
@@ -21,11 +21,20 @@ package ws4sqlite_client
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // Authentication mode for the database remote.
@@ -38,6 +47,8 @@ const (
 	AUTH_MODE_INLINE AuthMode = "INLINE"
 	// No authentication
 	AUTH_MODE_NONE AuthMode = "NONE"
+	// Bearer token in the Authorization header, e.g. for a gateway; see WithAuthTokenProvider
+	AUTH_MODE_TOKEN AuthMode = "TOKEN"
 )
 
 // Used in URL composition
@@ -50,6 +61,42 @@ const (
 	PROTOCOL_HTTPS Protocol = "https"
 )
 
+// Policy for the HTTP redirects that the remote may respond with.
+type RedirectPolicy string
+
+const (
+	// Behaves as the default http.Client, following up to 10 redirects; but a redirect
+	// that would drop the body (301, 302 or 303) fails with ErrRedirectDroppedBody
+	REDIRECT_POLICY_DEFAULT RedirectPolicy = "DEFAULT"
+	// Redirects are not followed; the redirect response is returned as a WsError
+	REDIRECT_POLICY_NEVER RedirectPolicy = "NEVER"
+	// Redirects are followed only if they point to the same host, otherwise an error is
+	// returned; as for the default, a redirect can't drop the body
+	REDIRECT_POLICY_SAME_HOST RedirectPolicy = "SAME_HOST"
+)
+
+// Encodes and decodes JSON; it allows to use a library other than encoding/json, for
+// performance. The structs to (un)marshal use the standard "json" tags, and
+// json.RawMessage.
+//
+// The records of the result sets are always decoded with encoding/json, to preserve the
+// order of the columns.
+type Marshaller interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// The default Marshaller, using encoding/json.
+type jsonMarshaller struct{}
+
+func (jsonMarshaller) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonMarshaller) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
 // This class is a builder for Client instances. Once configured with the URL to
 // contact and the authorization (if any), it can be used to instantiate a Client.
 //
@@ -62,10 +109,62 @@ const (
 //
 //	cli.Send(...)
 type ClientBuilder struct {
-	url      string
-	authMode AuthMode
-	user     string
-	password string
+	err             string
+	url             string
+	authMode        AuthMode
+	user            string
+	password        string
+	basicAuth       string
+	httpClient      *http.Client
+	maxIdleConns    int
+	idleConnTimeout time.Duration
+	maxConnsPerHost int
+	redirectPolicy  RedirectPolicy
+	contentType     string
+	attempts        int
+	attemptsSet     bool
+	backoff         time.Duration
+	maxBackoff      time.Duration
+	maxRetryAfter   time.Duration
+	idempotencyKeys bool
+	maxRequestBytes int64
+	profile         ServerProfile
+	dialTimeout     time.Duration
+	headerTimeout   time.Duration
+	errorValues     bool
+	checkRespType   bool
+	authChallenge   bool
+	validator       func(*Response) error
+	streamBody      bool
+	urls            []string
+	batchChunkSize  int
+	traceHeaders    []traceHeader
+	cacheTTL        time.Duration
+	cacheSize       int
+	marshaller      Marshaller
+	stableMarshal   bool
+	orderedRows     bool
+	successStatuses []int
+	maxRetryElapsed time.Duration
+	jitter          float64
+	jitterSeed      *int64
+	hostHeader      string
+	decoders        map[string]ContentDecoder
+	contextValues   func(ctx context.Context) map[string]interface{}
+	tokenProvider   func(ctx context.Context) (string, error)
+	zeroRowsUpdated bool
+	expectedRows    int
+	pathPrefix      string
+	queryParams     url.Values
+	httpMethod      string
+	mutators        []func(*http.Request) error
+	isolated        bool
+}
+
+// A header whose value is taken from the context of the send.
+type traceHeader struct {
+	name string
+	key  interface{}
 }
 
 // This struct represent a client for ws4sqlite. It can be constructed using the
@@ -80,38 +179,151 @@ type ClientBuilder struct {
 //	               Build()
 //
 //	cli.Send(...)
+//
+// A Client is immutable once built, and safe for concurrent use by multiple goroutines;
+// it's meant to be shared. The same goes for a Request, that is never modified by Send.
 type Client struct {
-	ClientBuilder
+	cfg        ClientBuilder
+	httpClient *http.Client
+	cache      *responseCache
+	jitterRand *lockedRand
+	failover   *failover
 }
 
 // First step when building. Generates a new ClientBuilder instance.
 func NewClientBuilder() *ClientBuilder {
-	return &ClientBuilder{authMode: AUTH_MODE_NONE}
+	return &ClientBuilder{
+		authMode:       AUTH_MODE_NONE,
+		redirectPolicy: REDIRECT_POLICY_DEFAULT,
+		contentType:    "application/json",
+		httpMethod:     http.MethodPost,
+		attempts:       1,
+		backoff:        DEFAULT_BACKOFF,
+		maxBackoff:     DEFAULT_MAX_BACKOFF,
+		maxRetryAfter:  DEFAULT_MAX_RETRY_AFTER,
+		profile:        PROFILE_V0_11,
+		marshaller:     jsonMarshaller{},
+	}
+}
+
+// Shortcut to build a Client for the given URL, without authentication; it's the same as
+// NewClientBuilder().WithURL(url).Build().
+func NewClient(url string) (*Client, error) {
+	return NewClientBuilder().WithURL(url).Build()
+}
+
+// Shortcut to build a Client for the given URL, with HTTP Basic Authentication; it's the
+// same as NewClientBuilder().WithURL(url).WithHTTPAuth(user, password).Build().
+func NewClientWithBasicAuth(url, user, password string) (*Client, error) {
+	return NewClientBuilder().WithURL(url).WithHTTPAuth(user, password).Build()
 }
 
 // Builder methods that adds a "raw" URL for contacting the ws4sqlite remote.
 func (cb *ClientBuilder) WithURL(url string) *ClientBuilder {
 	cb.url = url
+	cb.urls = nil
 	return cb
 }
 
 // Builder methods that adds an URL for contacting the ws4sqlite remote, given its components.
+// The databaseId is escaped as needed.
 func (cb *ClientBuilder) WithURLComponents(protocol Protocol, host string, port int, databaseId string) *ClientBuilder {
-	cb.url = fmt.Sprintf("%s://%s:%d/%s", protocol, host, port, databaseId)
+	if !validHost(host) {
+		cb.err = "invalid host"
+		return cb
+	}
+	cb.url = fmt.Sprintf("%s://%s:%d/%s", protocol, host, port, url.PathEscape(databaseId))
+	cb.urls = nil
 	return cb
 }
 
 // Builder methods that adds an URL for contacting the ws4sqlite remote, given its components but with an implicit port.
+// The databaseId is escaped as needed.
 func (cb *ClientBuilder) WithURLComponentsNoPort(protocol Protocol, host string, databaseId string) *ClientBuilder {
-	cb.url = fmt.Sprintf("%s://%s/%s", protocol, host, databaseId)
+	if !validHost(host) {
+		cb.err = "invalid host"
+		return cb
+	}
+	cb.url = fmt.Sprintf("%s://%s/%s", protocol, host, url.PathEscape(databaseId))
+	cb.urls = nil
+	return cb
+}
+
+// Builder method that adds a prefix to the path of the URL, e.g. for a reverse proxy that
+// exposes ws4sqlite under "/api/v1"; the database id stays the last segment. It's applied
+// at Build time, so it composes with WithURL and WithURLComponents in any order.
+func (cb *ClientBuilder) WithPathPrefix(prefix string) *ClientBuilder {
+	if strings.ContainsAny(prefix, "?# \t\r\n") {
+		cb.err = "invalid path prefix"
+		return cb
+	}
+	cb.pathPrefix = prefix
+	return cb
+}
+
+// Builder method that adds a parameter to the query string of the URL, e.g. for routing
+// in a reverse proxy; it's escaped as needed. It can be used several times, also with the
+// same key. It's applied at Build time, so it composes with WithURL and WithURLComponents
+// in any order.
+func (cb *ClientBuilder) WithQueryParam(key, value string) *ClientBuilder {
+	if key == "" {
+		cb.err = "cannot specify an empty query parameter"
+		return cb
+	}
+	params := url.Values{}
+	for k, v := range cb.queryParams {
+		params[k] = append([]string{}, v...)
+	}
+	params.Add(key, value)
+	cb.queryParams = params
 	return cb
 }
 
+// Adds the path prefix and the query parameters to the URL.
+func composeURL(rawURL, prefix string, params url.Values) (string, error) {
+	if prefix == "" && len(params) == 0 {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		escaped := "/" + prefix + u.EscapedPath()
+		if u.Path, err = url.PathUnescape(escaped); err != nil {
+			return "", err
+		}
+		u.RawPath = escaped
+	}
+	if len(params) > 0 {
+		query := u.Query()
+		for k, v := range params {
+			query[k] = append(query[k], v...)
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String(), nil
+}
+
+// Fails a redirect that would send the request without the body, i.e. that changes the
+// method (to GET, for a 301, 302 or 303).
+func checkRedirectKeepsBody(req *http.Request, via []*http.Request) error {
+	if req.Method != via[0].Method {
+		return fmt.Errorf("%w: %s %s was redirected to %s %s", ErrRedirectDroppedBody, via[0].Method, via[0].URL, req.Method, req.URL)
+	}
+	return nil
+}
+
+func validHost(host string) bool {
+	return host != "" && !strings.ContainsAny(host, "/?#@ \t\r\n")
+}
+
 // Builder methods that configures INLINE authentication; the remote must be configured accordingly.
 func (cb *ClientBuilder) WithInlineAuth(user, password string) *ClientBuilder {
 	cb.authMode = AUTH_MODE_INLINE
 	cb.user = user
 	cb.password = password
+	cb.basicAuth = ""
 	return cb
 }
 
@@ -120,21 +332,524 @@ func (cb *ClientBuilder) WithHTTPAuth(user, password string) *ClientBuilder {
 	cb.authMode = AUTH_MODE_HTTP
 	cb.user = user
 	cb.password = password
+	cb.basicAuth = ""
+	return cb
+}
+
+// Builder methods that configures HTTP Basic Authentication, with credentials that are already
+// base64-encoded (e.g. as stored in a secret manager); they are sent verbatim in the
+// Authorization header, as "Basic <encoded>".
+func (cb *ClientBuilder) WithPreencodedBasicAuth(encoded string) *ClientBuilder {
+	cb.authMode = AUTH_MODE_HTTP
+	cb.user = ""
+	cb.password = ""
+	cb.basicAuth = encoded
+	return cb
+}
+
+// Builder method that configures the authentication with a bearer token, in the
+// Authorization header (e.g. for a gateway in front of ws4sqlite). The provider is called
+// before each attempt, so it should cache the token while it's valid. If the remote
+// answers 401, the provider is called again with a context for which IsTokenRefresh is
+// true, so that it can obtain a fresh token, and the request is sent once more.
+func (cb *ClientBuilder) WithAuthTokenProvider(provider func(ctx context.Context) (string, error)) *ClientBuilder {
+	cb.authMode = AUTH_MODE_TOKEN
+	cb.user = ""
+	cb.password = ""
+	cb.basicAuth = ""
+	cb.tokenProvider = provider
+	return cb
+}
+
+// Context key that marks the refresh of a token.
+type tokenRefreshKey struct{}
+
+// Tells a token provider (see WithAuthTokenProvider) that the last token was rejected,
+// so a cached one must not be used.
+func IsTokenRefresh(ctx context.Context) bool {
+	refresh, _ := ctx.Value(tokenRefreshKey{}).(bool)
+	return refresh
+}
+
+// Builder method that sets the http.Client to use for the communication. If not set,
+// a new one is created at Build time, and shared by all the Send calls of the Client.
+//
+// Note that, when this is used, WithMaxIdleConns, WithIdleConnTimeout and WithMaxConnsPerHost
+// are ignored: the given http.Client must be configured directly.
+func (cb *ClientBuilder) WithHTTPClient(client *http.Client) *ClientBuilder {
+	cb.httpClient = client
+	return cb
+}
+
+// Builder method that sets which HTTP status codes are considered a success, for gateways
+// that answer e.g. 202 or 204 instead of 200; by default it's only 200. Other codes are
+// returned as a WsError. A success with no body (e.g. 204) gives an empty Response, except
+// for 200, that gives ErrEmptyResponse.
+func (cb *ClientBuilder) WithSuccessStatuses(codes ...int) *ClientBuilder {
+	cb.successStatuses = append([]int{}, codes...)
+	return cb
+}
+
+// Builder method that adds a function that can modify each HTTP request, after its body
+// and headers are set and right before it's sent, e.g. to sign it; the body can be read
+// with GetBody. If it returns an error, the request is not sent and the error is
+// returned. It's called for each attempt. It can be used several times; the functions are
+// called in order.
+func (cb *ClientBuilder) WithRequestMutator(mutator func(*http.Request) error) *ClientBuilder {
+	if mutator == nil {
+		cb.err = "cannot specify a nil mutator"
+		return cb
+	}
+	cb.mutators = append(append([]func(*http.Request) error{}, cb.mutators...), mutator)
+	return cb
+}
+
+// Builder method that sets the HTTP method of the requests; ws4sqlite uses POST (the
+// default), but some gateways may require a different one. Allowed methods are POST,
+// PUT, PATCH, DELETE and GET; the body is sent regardless.
+func (cb *ClientBuilder) WithHTTPMethod(method string) *ClientBuilder {
+	switch method = strings.ToUpper(method); method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodGet:
+		cb.httpMethod = method
+	default:
+		cb.err = "invalid HTTP method"
+	}
+	return cb
+}
+
+// Builder method that sets the Host header of the requests, when it must differ from the
+// host of the URL; e.g. to connect to a specific address of a load balancer, that routes
+// by virtual host. Note that, for HTTPS, the TLS server name is still the one in the URL.
+func (cb *ClientBuilder) WithHostHeader(host string) *ClientBuilder {
+	if !validHost(host) {
+		cb.err = "invalid host header"
+		return cb
+	}
+	cb.hostHeader = host
+	return cb
+}
+
+// Creates a reader that decompresses a response body; see WithContentDecoder.
+type ContentDecoder func(r io.Reader) (io.ReadCloser, error)
+
+// Builder method that adds a decoder for responses with the given Content-Encoding (e.g.
+// "zstd"), that is then advertised in the Accept-Encoding header of the requests. It can
+// be used several times, for different encodings.
+//
+// Note that, if this is used, the transparent gzip decompression of net/http is disabled;
+// add a decoder for "gzip" too, if the server may use it. For zstd, the reader of
+// github.com/klauspost/compress/zstd can be used; see the README.
+func (cb *ClientBuilder) WithContentDecoder(encoding string, decoder ContentDecoder) *ClientBuilder {
+	if encoding == "" || decoder == nil {
+		cb.err = "a content decoder needs an encoding and a function"
+		return cb
+	}
+	decoders := make(map[string]ContentDecoder, len(cb.decoders)+1)
+	for k, v := range cb.decoders {
+		decoders[k] = v
+	}
+	decoders[strings.ToLower(encoding)] = decoder
+	cb.decoders = decoders
+	return cb
+}
+
+// Builder method that makes the clients derived with Client.WithDatabase use their own
+// transport, with the same settings but separate connections, e.g. when the databases
+// must not share them. By default, derived clients share the connections of the original
+// one, that is more efficient. Custom transports (see WithHTTPClient) that are not an
+// *http.Transport are shared anyway.
+func (cb *ClientBuilder) WithIsolatedTransport() *ClientBuilder {
+	cb.isolated = true
+	return cb
+}
+
+// Builder method that sets the maximum number of idle (keep-alive) connections of the
+// transport. Ignored if WithHTTPClient is used.
+func (cb *ClientBuilder) WithMaxIdleConns(n int) *ClientBuilder {
+	cb.maxIdleConns = n
+	return cb
+}
+
+// Builder method that sets how long an idle (keep-alive) connection remains open. Ignored
+// if WithHTTPClient is used.
+func (cb *ClientBuilder) WithIdleConnTimeout(d time.Duration) *ClientBuilder {
+	cb.idleConnTimeout = d
+	return cb
+}
+
+// Builder method that sets the maximum number of connections to the remote host. Ignored
+// if WithHTTPClient is used.
+func (cb *ClientBuilder) WithMaxConnsPerHost(n int) *ClientBuilder {
+	cb.maxConnsPerHost = n
+	return cb
+}
+
+// Builder method that sets how HTTP redirects are handled. Following a redirect may drop
+// the Authorization header or (for 301/302) the body, so it's advisable to restrict it.
+func (cb *ClientBuilder) WithRedirectPolicy(policy RedirectPolicy) *ClientBuilder {
+	cb.redirectPolicy = policy
+	return cb
+}
+
+// Builder method that sets the timeout for establishing a connection to the remote. Ignored
+// if WithHTTPClient is used.
+func (cb *ClientBuilder) WithDialTimeout(d time.Duration) *ClientBuilder {
+	cb.dialTimeout = d
+	return cb
+}
+
+// Builder method that sets the timeout for receiving the response headers, once the request
+// is sent; it's the time the server takes to process the transaction, and doesn't include
+// reading the body. Ignored if WithHTTPClient is used.
+func (cb *ClientBuilder) WithResponseHeaderTimeout(d time.Duration) *ClientBuilder {
+	cb.headerTimeout = d
+	return cb
+}
+
+// Builder method that sets the Content-Type of the requests; by default it's "application/json".
+// Useful for gateways that require a specific media type.
+func (cb *ClientBuilder) WithContentType(contentType string) *ClientBuilder {
+	cb.contentType = contentType
+	return cb
+}
+
+// Builder method that enables the automatic generation of an Idempotency-Key header for each
+// Send (unless the Request specifies its own key, with RequestBuilder.WithIdempotencyKey). The
+// key is a random UUID, and is the same for all the retries of a Send; the server (or a proxy)
+// must honor it to avoid applying a transaction twice.
+func (cb *ClientBuilder) WithIdempotencyKeys() *ClientBuilder {
+	cb.idempotencyKeys = true
+	return cb
+}
+
+// Builder method that sets a limit to the size of the (marshalled) requests; a request
+// that exceeds it is not sent, and a RequestTooLargeError is returned. 0 means no limit.
+func (cb *ClientBuilder) WithMaxRequestBytes(n int64) *ClientBuilder {
+	cb.maxRequestBytes = n
+	return cb
+}
+
+// Builder method that makes the Client read a value from the context passed to SendWithContext,
+// using key, and send it in the given header; useful for correlation/trace ids. If the value
+// is missing or zero, the header is not sent. It can be called several times, for different
+// headers.
+func (cb *ClientBuilder) WithTraceHeaderFromContext(headerName string, key interface{}) *ClientBuilder {
+	cb.traceHeaders = append(cb.traceHeaders, traceHeader{name: headerName, key: key})
+	return cb
+}
+
+// Builder method that sets the Marshaller used to encode the requests and decode the
+// responses; by default, encoding/json is used.
+func (cb *ClientBuilder) WithMarshaller(m Marshaller) *ClientBuilder {
+	cb.marshaller = m
+	return cb
+}
+
+// Builder method that makes the Client marshal the requests deterministically: the same
+// Request always gives the same bytes, with the keys of the values (and of any other JSON
+// object) sorted. It's useful when the body is hashed, signed or compared to a golden file.
+//
+// encoding/json, the default, already sorts the keys of maps; with this mode, the output of
+// the Marshaller is re-encoded with sorted keys, so it holds for any Marshaller. Numbers are
+// kept as they are.
+func (cb *ClientBuilder) WithStableMarshalling() *ClientBuilder {
+	cb.stableMarshal = true
+	return cb
+}
+
+// Re-encodes a JSON document with the keys of its objects sorted.
+func stableJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// Builder method that makes the Client set ResponseItem.RowsUpdated to 0, rather than
+// leaving it nil, for successful statements (without a batch) for which the server
+// doesn't report a count; some servers, or gateways, omit the field when it's zero. This
+// way, nil RowsUpdated always means a query, a batch or a failure. Queries keep nil.
+func (cb *ClientBuilder) WithZeroForNilRowsUpdated() *ClientBuilder {
+	cb.zeroRowsUpdated = true
+	return cb
+}
+
+// Builder method that sets how many records the result sets are expected to have, to
+// allocate them at once. By default, the records are counted before decoding them; the
+// hint avoids that, when the size is known in advance (e.g. when paging). It's only a hint,
+// result sets of any size are decoded correctly.
+func (cb *ClientBuilder) WithExpectedRows(n int) *ClientBuilder {
+	cb.expectedRows = n
+	return cb
+}
+
+// Builder method that makes the Client also populate ResponseItem.OrderedResultSet, with
+// records that preserve the order of the columns as sent by the server. Note that
+// ws4sqlite (up to 0.12) sorts the columns alphabetically, rather than in the order of
+// the SELECT list.
+func (cb *ClientBuilder) WithOrderedRows() *ClientBuilder {
+	cb.orderedRows = true
+	return cb
+}
+
+// Builder method that makes the Client check that the Content-Type of a successful
+// response contains "json"; if not, an UnexpectedContentTypeError is returned, with the
+// actual type and the beginning of the body. It guards against proxies that answer with an
+// HTML page and a 200, that would otherwise fail with an obscure JSON error.
+func (cb *ClientBuilder) WithResponseContentTypeCheck() *ClientBuilder {
+	cb.checkRespType = true
+	return cb
+}
+
+// Builder method that makes the Client return an AuthChallengeError, instead of a WsError,
+// when the server answers 401 with a WWW-Authenticate challenge for a scheme that the
+// Client doesn't use, e.g. Basic when it has no authentication, or inline credentials; the
+// error names the expected scheme, to diagnose a misconfiguration. It wraps the WsError,
+// that can be extracted with errors.As.
+func (cb *ClientBuilder) WithAuthChallengeErrors() *ClientBuilder {
+	cb.authChallenge = true
+	return cb
+}
+
+// Builder method that sets a function that checks each successful Response, after it's
+// parsed, e.g. to enforce that the first query returns exactly one record. If it returns
+// an error, Send returns it wrapped in a ResponseValidationError (and no Response), with
+// the HTTP code. For chunked requests, the merged Response is checked.
+func (cb *ClientBuilder) WithResponseValidator(fn func(*Response) error) *ClientBuilder {
+	if fn == nil {
+		cb.err = "cannot specify a nil response validator"
+		return cb
+	}
+	cb.validator = fn
+	return cb
+}
+
+// Builder method that makes the Client return a WsErrorWithValues, instead of a WsError,
+// when a specific query/statement fails: it also contains the values bound to that node,
+// for debugging. The values of the fields declared in an encoder are redacted.
+func (cb *ClientBuilder) WithErrorValues() *ClientBuilder {
+	cb.errorValues = true
 	return cb
 }
 
 // Returns the Client that was built.
 func (cb *ClientBuilder) Build() (*Client, error) {
+	if cb.err != "" {
+		return nil, errors.New(cb.err)
+	}
 	if cb.url == "" {
 		return nil, errors.New("no url specified")
 	}
-	if cb.authMode != AUTH_MODE_HTTP && cb.authMode != AUTH_MODE_NONE && cb.authMode != AUTH_MODE_INLINE {
+	if cb.authMode != AUTH_MODE_HTTP && cb.authMode != AUTH_MODE_NONE && cb.authMode != AUTH_MODE_INLINE && cb.authMode != AUTH_MODE_TOKEN {
 		return nil, errors.New("invalid authMode")
 	}
-	if cb.authMode != AUTH_MODE_NONE && (cb.user == "" || cb.password == "") {
+	if cb.authMode == AUTH_MODE_TOKEN && cb.tokenProvider == nil {
+		return nil, errors.New("no token provider specified")
+	}
+	if cb.authMode != AUTH_MODE_NONE && cb.authMode != AUTH_MODE_TOKEN && cb.basicAuth == "" && (cb.user == "" || cb.password == "") {
 		return nil, errors.New("no user or password specified")
 	}
-	return &Client{*cb}, nil
+	if cb.redirectPolicy != REDIRECT_POLICY_DEFAULT && cb.redirectPolicy != REDIRECT_POLICY_NEVER && cb.redirectPolicy != REDIRECT_POLICY_SAME_HOST {
+		return nil, errors.New("invalid redirectPolicy")
+	}
+	if cb.marshaller == nil {
+		return nil, errors.New("no marshaller specified")
+	}
+	if cb.contentType == "" {
+		return nil, errors.New("no content type specified")
+	}
+	for _, th := range cb.traceHeaders {
+		if th.name == "" || th.key == nil {
+			return nil, errors.New("trace headers need a name and a key")
+		}
+	}
+	if cb.attempts < 1 {
+		return nil, errors.New("attempts must be at least 1")
+	}
+	if cb.jitter < 0 || cb.jitter > 1 {
+		return nil, errors.New("jitter must be between 0 and 1")
+	}
+	if cb.maxRetryElapsed < 0 {
+		return nil, errors.New("maxRetryElapsed cannot be negative")
+	}
+	if cb.backoff <= 0 || cb.maxBackoff < cb.backoff {
+		return nil, errors.New("invalid backoff")
+	}
+	if cb.maxRetryAfter < 0 {
+		return nil, errors.New("maxRetryAfter cannot be negative")
+	}
+	if cb.cacheTTL < 0 || cb.cacheSize < 0 || (cb.cacheTTL > 0) != (cb.cacheSize > 0) {
+		return nil, errors.New("invalid response cache settings")
+	}
+	if cb.expectedRows < 0 {
+		return nil, errors.New("expectedRows cannot be negative")
+	}
+	if cb.batchChunkSize < 0 {
+		return nil, errors.New("batchChunkSize cannot be negative")
+	}
+	if cb.maxRequestBytes < 0 {
+		return nil, errors.New("maxRequestBytes cannot be negative")
+	}
+	if err := cb.checkStreamBody(); err != nil {
+		return nil, err
+	}
+	for _, code := range cb.successStatuses {
+		if code < 200 || code > 299 {
+			return nil, fmt.Errorf("invalid success status: %d", code)
+		}
+	}
+	if cb.maxIdleConns < 0 || cb.idleConnTimeout < 0 || cb.maxConnsPerHost < 0 || cb.dialTimeout < 0 || cb.headerTimeout < 0 {
+		return nil, errors.New("transport settings cannot be negative")
+	}
+
+	httpClient := cb.httpClient
+	if httpClient == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if cb.maxIdleConns > 0 {
+			transport.MaxIdleConns = cb.maxIdleConns
+			transport.MaxIdleConnsPerHost = cb.maxIdleConns
+		}
+		if cb.idleConnTimeout > 0 {
+			transport.IdleConnTimeout = cb.idleConnTimeout
+		}
+		if cb.maxConnsPerHost > 0 {
+			transport.MaxConnsPerHost = cb.maxConnsPerHost
+		}
+		if cb.dialTimeout > 0 {
+			transport.DialContext = (&net.Dialer{
+				Timeout:   cb.dialTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext
+		}
+		if cb.headerTimeout > 0 {
+			transport.ResponseHeaderTimeout = cb.headerTimeout
+		}
+		httpClient = &http.Client{Transport: transport}
+	}
+	switch cb.redirectPolicy {
+	case REDIRECT_POLICY_DEFAULT:
+		// a custom http.Client is used as is; a redirect that drops the body is detected
+		// after the fact, in send()
+		if cb.httpClient == nil {
+			hc := *httpClient
+			hc.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 10 {
+					return ErrTooManyRedirects
+				}
+				return checkRedirectKeepsBody(req, via)
+			}
+			httpClient = &hc
+		}
+	case REDIRECT_POLICY_NEVER:
+		hc := *httpClient
+		hc.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		httpClient = &hc
+	case REDIRECT_POLICY_SAME_HOST:
+		hc := *httpClient
+		hc.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return ErrTooManyRedirects
+			}
+			if req.URL.Host != via[0].URL.Host {
+				return fmt.Errorf("%w: %s", ErrRedirectToOtherHost, req.URL.Host)
+			}
+			return checkRedirectKeepsBody(req, via)
+		}
+		httpClient = &hc
+	}
+
+	var cache *responseCache
+	if cb.cacheSize > 0 {
+		cache = newResponseCache(cb.cacheTTL, cb.cacheSize)
+	}
+
+	var jitterRand *lockedRand
+	if cb.jitter > 0 {
+		seed := time.Now().UnixNano()
+		if cb.jitterSeed != nil {
+			seed = *cb.jitterSeed
+		}
+		jitterRand = newLockedRand(seed)
+	}
+
+	ret := &Client{*cb, httpClient, cache, jitterRand, nil}
+	composed, err := composeURL(cb.url, cb.pathPrefix, cb.queryParams)
+	if err != nil {
+		return nil, err
+	}
+	ret.cfg.url = composed
+	if len(cb.urls) > 1 {
+		ret.failover = &failover{urls: make([]string, len(cb.urls)), preferred: new(atomic.Int32)}
+		for i, u := range cb.urls {
+			if ret.failover.urls[i], err = composeURL(u, cb.pathPrefix, cb.queryParams); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if cb.maxRetryElapsed > 0 && !cb.attemptsSet {
+		ret.cfg.attempts = math.MaxInt32
+	}
+	return ret, nil
+}
+
+// Returns a copy of the Client that targets another database on the same remote; the
+// last segment of the URL path is replaced with databaseId (escaped as needed). The copy
+// shares the configuration, the authentication and the http.Client (and so the
+// connections) of the original, that is not affected; unless the Client was built with
+// WithIsolatedTransport.
+func (c *Client) WithDatabase(databaseId string) *Client {
+	ret := *c
+	ret.cfg.url = replaceDatabase(c.cfg.url, databaseId)
+	if c.failover != nil {
+		ret.failover = &failover{urls: make([]string, len(c.failover.urls)), preferred: c.failover.preferred}
+		for i, u := range c.failover.urls {
+			ret.failover.urls[i] = replaceDatabase(u, databaseId)
+		}
+	}
+	if c.cfg.isolated {
+		ret.httpClient = isolatedHTTPClient(c.httpClient)
+	}
+	return &ret
+}
+
+// Returns a copy of the http.Client, with a new transport with the same settings, so
+// that no connection is shared. Transports other than *http.Transport are kept.
+func isolatedHTTPClient(hc *http.Client) *http.Client {
+	ret := *hc
+	switch t := hc.Transport.(type) {
+	case nil:
+		ret.Transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		ret.Transport = t.Clone()
+	}
+	return &ret
+}
+
+func replaceDatabase(rawURL, databaseId string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	escaped := u.EscapedPath()
+	if idx := strings.LastIndex(escaped, "/"); idx >= 0 {
+		escaped = escaped[:idx]
+	}
+	escaped += "/" + url.PathEscape(databaseId)
+	if u.Path, err = url.PathUnescape(escaped); err != nil {
+		return rawURL
+	}
+	u.RawPath = escaped
+	return u.String()
+}
+
+// Returns the http.Client used for the communication with the remote.
+func (c *Client) HTTPClient() *http.Client {
+	return c.httpClient
 }
 
 // Sends a set of requests to the remote, wrapped in a Request struct. Returns
@@ -151,52 +866,207 @@ func (c *Client) Send(req *Request) (*Response, int, error) {
 //
 // Returns a WsError if the remote service returns a processing error. If the
 // communication fails, it returns the "naked" error, so check for cast-ability.
-func (c *Client) SendWithContext(ctx context.Context, req *Request) (*Response, int, error) {
-	if c.authMode == AUTH_MODE_INLINE {
-		req.req.Credentials = &credentials{
-			User:     c.user,
-			Password: c.password,
-		}
+//
+// If the Client was configured with WithRetries, failed attempts are retried as
+// documented there. If it was configured with WithBatchChunkSize, large batches are
+// split across several requests.
+//
+// Options can override some settings for this call only, e.g. WithTimeout or WithHeader.
+func (c *Client) SendWithContext(ctx context.Context, req *Request, opts ...SendOption) (*Response, int, error) {
+	return c.sendWith(ctx, req, c.cfg.attempts, opts)
+}
+
+// Sends a request, making up to the given number of attempts; it's the implementation of
+// SendWithContext and SendWithRetry.
+func (c *Client) sendWith(ctx context.Context, req *Request, attempts int, opts []SendOption) (*Response, int, error) {
+	if len(req.req.Transaction) == 0 {
+		return nil, 0, ErrEmptyTransaction
+	}
+	ctx, req, cancel := applySendOptions(ctx, req, opts)
+	defer cancel()
+	if c.cfg.contextValues != nil {
+		req = withDefaultValues(req, c.cfg.contextValues(ctx))
 	}
+	if c.cache != nil && req.isReadOnly() {
+		return c.validate(c.sendCached(ctx, req, attempts))
+	}
+	if c.needsChunking(req) {
+		return c.validate(c.sendChunked(ctx, req, attempts))
+	}
+	return c.validate(c.sendWithRetries(ctx, req, attempts))
+}
 
-	jsonData, err := json.Marshal(req.req)
-	if err != nil {
-		return nil, 0, err
+// Applies the response validator, if any, to a successful response.
+func (c *Client) validate(res *Response, code int, err error) (*Response, int, error) {
+	if err != nil || c.cfg.validator == nil {
+		return res, code, err
+	}
+	if verr := c.cfg.validator(res); verr != nil {
+		return nil, code, ResponseValidationError{Err: verr}
 	}
+	return res, code, nil
+}
 
-	client := &http.Client{}
-	post, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, 0, err
+// Sends the request once; if a token is rejected, it's refreshed and the request is sent
+// again.
+func (c *Client) sendAuthenticated(ctx context.Context, req *Request, idempotencyKey string) (*Response, int, error) {
+	res, code, err := c.sendFailover(ctx, req, idempotencyKey)
+	if code == http.StatusUnauthorized && c.cfg.authMode == AUTH_MODE_TOKEN {
+		return c.sendFailover(context.WithValue(ctx, tokenRefreshKey{}, true), req, idempotencyKey)
+	}
+	return res, code, err
+}
+
+// Performs a single attempt of sending the request to the given URL.
+func (c *Client) send(ctx context.Context, req *Request, idempotencyKey, targetURL string) (*Response, int, error) {
+	if !c.cfg.profile.statementTimeouts && req.hasStatementTimeouts() {
+		return nil, 0, ErrStatementTimeoutUnsupported
+	}
+	// the request is shared, so the credentials go in a copy
+	payload := req.req
+	cfg := callConfig(ctx)
+	if cfg != nil && cfg.inline != nil {
+		payload.Credentials = cfg.inline
+	} else if c.cfg.authMode == AUTH_MODE_INLINE && (cfg == nil || !cfg.skipInline) {
+		payload.Credentials = &credentials{
+			User:     c.cfg.user,
+			Password: c.cfg.password,
+		}
+	}
+
+	var post *http.Request
+	var err error
+	if c.cfg.streamBody {
+		body := streamRequest(payload)
+		// the transport closes it, but not if returning before sending
+		defer body.Close()
+		post, err = http.NewRequestWithContext(ctx, c.cfg.httpMethod, targetURL, body)
+		if err != nil {
+			return nil, 0, err
+		}
+		post.GetBody = func() (io.ReadCloser, error) {
+			return streamRequest(payload), nil
+		}
+	} else {
+		jsonData, err := c.cfg.marshaller.Marshal(payload.wire())
+		if err != nil {
+			return nil, 0, err
+		}
+		if c.cfg.stableMarshal {
+			if jsonData, err = stableJSON(jsonData); err != nil {
+				return nil, 0, err
+			}
+		}
+		jsonData, err = c.cfg.profile.adaptRequest(jsonData)
+		if err != nil {
+			return nil, 0, err
+		}
+		if c.cfg.maxRequestBytes > 0 && int64(len(jsonData)) > c.cfg.maxRequestBytes {
+			return nil, 0, RequestTooLargeError{Size: int64(len(jsonData)), Limit: c.cfg.maxRequestBytes}
+		}
+		post, err = http.NewRequestWithContext(ctx, c.cfg.httpMethod, targetURL, bytes.NewBuffer(jsonData))
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if c.cfg.authMode == AUTH_MODE_HTTP {
+		if c.cfg.basicAuth != "" {
+			post.Header.Set("Authorization", "Basic "+c.cfg.basicAuth)
+		} else {
+			post.SetBasicAuth(c.cfg.user, c.cfg.password)
+		}
+	} else if c.cfg.authMode == AUTH_MODE_TOKEN {
+		token, err := c.cfg.tokenProvider(ctx)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot obtain the auth token: %w", err)
+		}
+		post.Header.Set("Authorization", "Bearer "+token)
+	}
+	if idempotencyKey != "" {
+		post.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	for _, th := range c.cfg.traceHeaders {
+		if v := ctx.Value(th.key); v != nil && !reflect.ValueOf(v).IsZero() {
+			post.Header.Set(th.name, fmt.Sprint(v))
+		}
+	}
+	post.Header.Add("Content-Type", c.cfg.contentType)
+	if c.cfg.hostHeader != "" {
+		post.Host = c.cfg.hostHeader
+	}
+	if len(c.cfg.decoders) > 0 {
+		encodings := make([]string, 0, len(c.cfg.decoders))
+		for encoding := range c.cfg.decoders {
+			encodings = append(encodings, encoding)
+		}
+		sort.Strings(encodings)
+		post.Header.Set("Accept-Encoding", strings.Join(encodings, ", "))
+	}
+	if cfg != nil {
+		for name, values := range cfg.headers {
+			post.Header[name] = values
+		}
 	}
-	if c.authMode == AUTH_MODE_HTTP {
-		post.SetBasicAuth(c.user, c.password)
+	for _, mutator := range c.cfg.mutators {
+		if err := mutator(post); err != nil {
+			return nil, 0, err
+		}
 	}
-	post.Header.Add("Content-Type", "application/json")
-	resp, err := client.Do(post)
+	resp, err := c.httpClient.Do(post)
 	if err != nil {
 		return nil, 0, err
 	}
+	// a custom http.Client may have followed a redirect that dropped the body
+	if resp.Request != nil && resp.Request.Method != post.Method {
+		resp.Body.Close()
+		return nil, resp.StatusCode, fmt.Errorf("%w: %s was redirected to %s %s", ErrRedirectDroppedBody, targetURL, resp.Request.Method, resp.Request.URL)
+	}
 
-	body, err := io.ReadAll(resp.Body)
+	defer resp.Body.Close()
+
+	body, err := c.readBody(resp)
 	if err != nil {
 		return nil, resp.StatusCode, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
+	if adapted, err := c.cfg.profile.adaptResponse(body); err == nil {
+		body = adapted
+	}
+
+	if !c.isSuccess(resp.StatusCode) {
 		wserr := WsError{}
-		err = json.Unmarshal(body, &wserr)
+		err = c.cfg.marshaller.Unmarshal(body, &wserr)
 		if err != nil {
 			wserr.RequestIdx = -1
 			wserr.Msg = string(body)
 		}
 		wserr.Code = resp.StatusCode
+		wserr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		wserr.Category = categorize(wserr.Code, wserr.RequestIdx)
+		if c.cfg.authChallenge && wserr.Code == http.StatusUnauthorized {
+			if challenge := newAuthChallengeError(wserr, resp.Header.Values("WWW-Authenticate"), c.cfg.authMode); challenge != nil {
+				return nil, resp.StatusCode, *challenge
+			}
+		}
+		if c.cfg.errorValues && wserr.RequestIdx >= 0 && wserr.RequestIdx < len(req.req.Transaction) {
+			return nil, resp.StatusCode, newWsErrorWithValues(wserr, &req.req.Transaction[wserr.RequestIdx])
+		}
 		return nil, resp.StatusCode, wserr
 	}
 
+	if len(bytes.TrimSpace(body)) == 0 {
+		if resp.StatusCode == 200 {
+			return nil, resp.StatusCode, ErrEmptyResponse
+		}
+		return &Response{Results: make([]ResponseItem, 0)}, resp.StatusCode, nil
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); c.cfg.checkRespType && !strings.Contains(strings.ToLower(contentType), "json") {
+		return nil, resp.StatusCode, newUnexpectedContentTypeError(resp.StatusCode, contentType, body)
+	}
+
 	var res response
-	err = json.Unmarshal(body, &res)
+	err = c.cfg.marshaller.Unmarshal(body, &res)
 	if err != nil {
 		return nil, resp.StatusCode, err
 	}
@@ -208,25 +1078,82 @@ func (c *Client) SendWithContext(ctx context.Context, req *Request) (*Response,
 			Error:            res.Results[i].Error,
 			RowsUpdated:      res.Results[i].RowsUpdated,
 			RowsUpdatedBatch: res.Results[i].RowsUpdatedBatch,
+			LastInsertID:     res.Results[i].LastInsertID,
 		}
-		if res.Results[i].ResultSet != nil {
-			Rirs := make([]map[string]interface{}, 0)
-			for i2 := range res.Results[i].ResultSet {
-				Rirsi := make(map[string]interface{})
-				for k, v := range res.Results[i].ResultSet[i2] {
-					var v2 interface{}
-					err = json.Unmarshal(v, &v2)
-					if err != nil {
-						return nil, resp.StatusCode, err
-					}
-					Rirsi[k] = v2
-				}
-				Rirs = append(Rirs, Rirsi)
+		if rs := res.Results[i].ResultSet; rs != nil && string(rs) != "null" {
+			Rirs, columns, ordered, err := decodeResultSet(rs, c.cfg.orderedRows, c.cfg.expectedRows)
+			if err != nil {
+				return nil, resp.StatusCode, err
 			}
 			Ri.ResultSet = Rirs
+			Ri.OrderedResultSet = ordered
+			Ri.Columns = inferColumns(columns, Rirs)
+			if i < len(req.req.Transaction) && req.req.Transaction[i].schema != nil {
+				if err = applySchema(Rirs, req.req.Transaction[i].schema); err != nil {
+					return nil, resp.StatusCode, fmt.Errorf("in request #%d: %w", i, err)
+				}
+			}
+		}
+		if i < len(req.req.Transaction) {
+			if req.req.Transaction[i].Query == "" {
+				Ri.ResultSet = nil
+				Ri.Columns = nil
+				Ri.OrderedResultSet = nil
+				if c.cfg.zeroRowsUpdated && Ri.Success && Ri.RowsUpdated == nil && Ri.RowsUpdatedBatch == nil {
+					var zero int64
+					Ri.RowsUpdated = &zero
+				}
+			} else if Ri.Success && Ri.ResultSet == nil {
+				Ri.ResultSet = make([]map[string]interface{}, 0)
+				if c.cfg.orderedRows {
+					Ri.OrderedResultSet = make([]OrderedRow, 0)
+				}
+			}
 		}
 		Res.Results = append(Res.Results, Ri)
 	}
 
 	return &Res, resp.StatusCode, nil
 }
+
+// Reads the body of a response, decompressing it if needed; see WithContentDecoder.
+func (c *Client) readBody(resp *http.Response) ([]byte, error) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	if encoding == "" || encoding == "identity" || resp.Uncompressed {
+		return io.ReadAll(resp.Body)
+	}
+	decoder, ok := c.cfg.decoders[encoding]
+	if !ok {
+		return nil, fmt.Errorf("unsupported Content-Encoding: %s", encoding)
+	}
+	r, err := decoder(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Whether the HTTP status code is considered a success; see WithSuccessStatuses.
+func (c *Client) isSuccess(code int) bool {
+	if len(c.cfg.successStatuses) == 0 {
+		return code == 200
+	}
+	for _, s := range c.cfg.successStatuses {
+		if s == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Generates a random (v4) UUID.
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
@@ -0,0 +1,93 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// A query that always fails, used to make ws4sqlite roll back a transaction.
+const diagnosisSentinel = "SELECT ws4_diagnosis_rollback()"
+
+// The outcome of a single query/statement, as diagnosed by Client.DiagnoseFailure.
+type NodeDiagnosis struct {
+	// Index of the node in the request
+	Index int
+	// Did the node succeed?
+	Success bool
+	// Reason for the error, if the node failed
+	Error string
+}
+
+// Report of Client.DiagnoseFailure, with an item per node of the request.
+type DiagnosisReport struct {
+	// Outcome of each node
+	Nodes []NodeDiagnosis
+	// Index of the first failing node, or -1 if none failed
+	FirstFailure int
+}
+
+// Diagnoses a failing transaction, to find out the outcome of each of its nodes: when
+// a transaction fails, ws4sqlite reports only the first error.
+//
+// For each node, a request is sent with the previous nodes (marked as "no fail"), the node
+// itself and a final query that always fails, so that the transaction is rolled back and
+// nothing is written. It's expensive (a request per node), so it's meant for debugging.
+func (c *Client) DiagnoseFailure(ctx context.Context, req *Request) (*DiagnosisReport, error) {
+	if len(req.req.Transaction) == 0 {
+		return nil, ErrEmptyTransaction
+	}
+
+	report := &DiagnosisReport{FirstFailure: -1}
+	for k := range req.req.Transaction {
+		probe := &Request{req: request{Transaction: make([]requestItem, 0, k+2)}}
+		for i := 0; i < k; i++ {
+			item := req.req.Transaction[i]
+			item.NoFail = true
+			probe.req.Transaction = append(probe.req.Transaction, item)
+		}
+		item := req.req.Transaction[k]
+		item.NoFail = false
+		probe.req.Transaction = append(probe.req.Transaction, item, requestItem{Query: diagnosisSentinel})
+
+		_, _, err := c.sendWithRetries(ctx, probe, c.cfg.attempts)
+		var wserr WsError
+		if !errors.As(err, &wserr) {
+			if err == nil {
+				err = errors.New("the diagnosis request didn't fail as expected")
+			}
+			return nil, err
+		}
+
+		diag := NodeDiagnosis{Index: k}
+		switch wserr.RequestIdx {
+		case k + 1:
+			diag.Success = true
+		case k:
+			diag.Error = wserr.Msg
+			if report.FirstFailure < 0 {
+				report.FirstFailure = k
+			}
+		default:
+			return nil, fmt.Errorf("unexpected failure of the diagnosis request: %w", wserr)
+		}
+		report.Nodes = append(report.Nodes, diag)
+	}
+	return report, nil
+}
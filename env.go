@@ -0,0 +1,80 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Names of the environment variables read by NewClientFromEnv.
+const (
+	// URL of the database remote; mandatory
+	ENV_URL = "WS4_URL"
+	// HTTP, INLINE or NONE (default); case insensitive
+	ENV_AUTH_MODE = "WS4_AUTH_MODE"
+	// User, for HTTP or INLINE authentication
+	ENV_USER = "WS4_USER"
+	// Password, for HTTP or INLINE authentication
+	ENV_PASSWORD = "WS4_PASSWORD"
+	// Pre-encoded credentials for HTTP (Basic) authentication, i.e. the base64 of
+	// "user:password", as in WithPreencodedBasicAuth; alternative to user and password.
+	// It's not a bearer token: AUTH_MODE_TOKEN can't be configured by environment
+	ENV_BASIC_AUTH = "WS4_BASIC_AUTH"
+)
+
+// Builds a Client configured by environment variables (see the ENV_... constants), e.g.
+// for twelve-factor apps. Combinations that don't make sense, like credentials without
+// authentication or pre-encoded credentials with INLINE authentication, are an error.
+func NewClientFromEnv() (*Client, error) {
+	url := os.Getenv(ENV_URL)
+	if url == "" {
+		return nil, fmt.Errorf("%s is not set", ENV_URL)
+	}
+	user := os.Getenv(ENV_USER)
+	password := os.Getenv(ENV_PASSWORD)
+	basicAuth := os.Getenv(ENV_BASIC_AUTH)
+
+	cb := NewClientBuilder().WithURL(url)
+	switch AuthMode(strings.ToUpper(os.Getenv(ENV_AUTH_MODE))) {
+	case "", AUTH_MODE_NONE:
+		if user != "" || password != "" || basicAuth != "" {
+			return nil, fmt.Errorf("credentials are set, but %s is not HTTP or INLINE", ENV_AUTH_MODE)
+		}
+	case AUTH_MODE_HTTP:
+		if basicAuth != "" {
+			if user != "" || password != "" {
+				return nil, fmt.Errorf("%s cannot be set together with %s and %s", ENV_BASIC_AUTH, ENV_USER, ENV_PASSWORD)
+			}
+			cb.WithPreencodedBasicAuth(basicAuth)
+		} else {
+			cb.WithHTTPAuth(user, password)
+		}
+	case AUTH_MODE_INLINE:
+		if basicAuth != "" {
+			return nil, fmt.Errorf("%s is only allowed with HTTP authentication", ENV_BASIC_AUTH)
+		}
+		cb.WithInlineAuth(user, password)
+	case AUTH_MODE_TOKEN:
+		return nil, fmt.Errorf("%s cannot be TOKEN: bearer tokens can't be configured by environment", ENV_AUTH_MODE)
+	default:
+		return nil, errors.New("invalid " + ENV_AUTH_MODE)
+	}
+	return cb.Build()
+}
@@ -0,0 +1,228 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// Tells if two Responses have the same results; see Diff for the details of the
+// comparison.
+func (r *Response) Equal(other *Response) bool {
+	return r.Diff(other) == ""
+}
+
+// Describes the first difference between two Responses, e.g.
+// `Results[1].ResultSet[0]["VAL"]: "A" != "B"`, or returns "" if they are equal. It's
+// meant for the assertions in tests.
+//
+// Success, Error, RowsUpdated, RowsUpdatedBatch, LastInsertID and ResultSet are compared;
+// Columns and OrderedResultSet are derived from ResultSet, so they are not. Numbers are
+// equal if they have the same value, regardless of their type (e.g. int 1, float64 1.0 and
+// json.Number "1"); a nil ResultSet (a statement) differs from an empty one (a query
+// without records).
+func (r *Response) Diff(other *Response) string {
+	if r == nil || other == nil {
+		if (r == nil) != (other == nil) {
+			return fmt.Sprintf("%s != %s", nilness(r == nil), nilness(other == nil))
+		}
+		return ""
+	}
+	if len(r.Results) != len(other.Results) {
+		return fmt.Sprintf("len(Results): %d != %d", len(r.Results), len(other.Results))
+	}
+	for i := range r.Results {
+		if d := r.Results[i].diff(&other.Results[i]); d != "" {
+			return fmt.Sprintf("Results[%d].%s", i, d)
+		}
+	}
+	return ""
+}
+
+func nilness(isNil bool) string {
+	if isNil {
+		return "nil"
+	}
+	return "non-nil"
+}
+
+func (ri *ResponseItem) diff(other *ResponseItem) string {
+	if ri.Success != other.Success {
+		return fmt.Sprintf("Success: %t != %t", ri.Success, other.Success)
+	}
+	if ri.Error != other.Error {
+		return fmt.Sprintf("Error: %q != %q", ri.Error, other.Error)
+	}
+	if (ri.RowsUpdated == nil) != (other.RowsUpdated == nil) {
+		return fmt.Sprintf("RowsUpdated: %s != %s", nilness(ri.RowsUpdated == nil), nilness(other.RowsUpdated == nil))
+	}
+	if ri.RowsUpdated != nil && *ri.RowsUpdated != *other.RowsUpdated {
+		return fmt.Sprintf("RowsUpdated: %d != %d", *ri.RowsUpdated, *other.RowsUpdated)
+	}
+	if (ri.LastInsertID == nil) != (other.LastInsertID == nil) {
+		return fmt.Sprintf("LastInsertID: %s != %s", nilness(ri.LastInsertID == nil), nilness(other.LastInsertID == nil))
+	}
+	if ri.LastInsertID != nil && *ri.LastInsertID != *other.LastInsertID {
+		return fmt.Sprintf("LastInsertID: %d != %d", *ri.LastInsertID, *other.LastInsertID)
+	}
+	if (ri.RowsUpdatedBatch == nil) != (other.RowsUpdatedBatch == nil) {
+		return fmt.Sprintf("RowsUpdatedBatch: %s != %s", nilness(ri.RowsUpdatedBatch == nil), nilness(other.RowsUpdatedBatch == nil))
+	}
+	if len(ri.RowsUpdatedBatch) != len(other.RowsUpdatedBatch) {
+		return fmt.Sprintf("len(RowsUpdatedBatch): %d != %d", len(ri.RowsUpdatedBatch), len(other.RowsUpdatedBatch))
+	}
+	for i := range ri.RowsUpdatedBatch {
+		if ri.RowsUpdatedBatch[i] != other.RowsUpdatedBatch[i] {
+			return fmt.Sprintf("RowsUpdatedBatch[%d]: %d != %d", i, ri.RowsUpdatedBatch[i], other.RowsUpdatedBatch[i])
+		}
+	}
+	if (ri.ResultSet == nil) != (other.ResultSet == nil) {
+		return fmt.Sprintf("ResultSet: %s != %s", nilness(ri.ResultSet == nil), nilness(other.ResultSet == nil))
+	}
+	if len(ri.ResultSet) != len(other.ResultSet) {
+		return fmt.Sprintf("len(ResultSet): %d != %d", len(ri.ResultSet), len(other.ResultSet))
+	}
+	for i := range ri.ResultSet {
+		if d := diffValues(ri.ResultSet[i], other.ResultSet[i]); d != "" {
+			return fmt.Sprintf("ResultSet[%d]%s", i, d)
+		}
+	}
+	return ""
+}
+
+// Compares two values as decoded from JSON (or built by hand), returning the path of the
+// first difference followed by the description of it, or "" if they are equal.
+func diffValues(a, b interface{}) string {
+	if na, ok := toNumber(a); ok {
+		if nb, ok := toNumber(b); ok && na.equal(nb) {
+			return ""
+		}
+		return fmt.Sprintf(": %#v != %#v", a, b)
+	}
+	switch va := a.(type) {
+	case map[string]interface{}:
+		vb, ok := b.(map[string]interface{})
+		if !ok {
+			return fmt.Sprintf(": %#v != %#v", a, b)
+		}
+		keys := make([]string, 0, len(va)+len(vb))
+		for k := range va {
+			keys = append(keys, k)
+		}
+		for k := range vb {
+			if _, ok := va[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ea, oka := va[k]
+			eb, okb := vb[k]
+			if oka != okb {
+				return fmt.Sprintf("[%q]: %s != %s", k, presence(oka), presence(okb))
+			}
+			if d := diffValues(ea, eb); d != "" {
+				return fmt.Sprintf("[%q]%s", k, d)
+			}
+		}
+		return ""
+	case []interface{}:
+		vb, ok := b.([]interface{})
+		if !ok {
+			return fmt.Sprintf(": %#v != %#v", a, b)
+		}
+		if len(va) != len(vb) {
+			return fmt.Sprintf(": len %d != %d", len(va), len(vb))
+		}
+		for i := range va {
+			if d := diffValues(va[i], vb[i]); d != "" {
+				return fmt.Sprintf("[%d]%s", i, d)
+			}
+		}
+		return ""
+	}
+	if !reflect.DeepEqual(a, b) {
+		return fmt.Sprintf(": %#v != %#v", a, b)
+	}
+	return ""
+}
+
+func presence(present bool) string {
+	if present {
+		return "present"
+	}
+	return "missing"
+}
+
+// A number of any type; integers are kept as such, to compare them exactly.
+type number struct {
+	isInt bool
+	i     int64
+	f     float64
+}
+
+func (n number) equal(other number) bool {
+	if n.isInt && other.isInt {
+		return n.i == other.i
+	}
+	return n.float() == other.float()
+}
+
+func (n number) float() float64 {
+	if n.isInt {
+		return float64(n.i)
+	}
+	return n.f
+}
+
+// Converts a value to a number, if it's one; floats with an integer value are treated as
+// integers.
+func toNumber(v interface{}) (number, bool) {
+	switch n := v.(type) {
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return number{isInt: true, i: i}, true
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return number{}, false
+		}
+		return toNumber(f)
+	case float32:
+		return toNumber(float64(n))
+	case float64:
+		if n == math.Trunc(n) && math.Abs(n) < 1<<63 {
+			return number{isInt: true, i: int64(n)}, true
+		}
+		return number{f: n}, true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return number{isInt: true, i: rv.Int()}, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if rv.Uint() > math.MaxInt64 {
+			return number{f: float64(rv.Uint())}, true
+		}
+		return number{isInt: true, i: int64(rv.Uint())}, true
+	}
+	return number{}, false
+}
@@ -16,6 +16,59 @@
 
 package ws4sqlite_client
 
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Returned when the server responds with success, but with an empty body (e.g. a
+// misconfigured proxy).
+var ErrEmptyResponse = errors.New("the server returned an empty response")
+
+// Returned when trying to send a Request that has no queries or statements; the request
+// is not sent.
+var ErrEmptyTransaction = errors.New("the request has an empty transaction")
+
+// Returned when the remote answers with a redirect (301, 302 or 303) that the HTTP
+// client would follow with a GET, dropping the request; the URL should be fixed, e.g.
+// with the final one. With REDIRECT_POLICY_NEVER, the redirect is returned as a WsError
+// instead.
+var ErrRedirectDroppedBody = errors.New("a redirect would drop the body of the request")
+
+// Returned when the remote answers with more than 10 redirects in a row.
+var ErrTooManyRedirects = errors.New("stopped after 10 redirects")
+
+// Returned when the remote redirects to a different host, with REDIRECT_POLICY_SAME_HOST.
+var ErrRedirectToOtherHost = errors.New("redirect to a different host is not allowed")
+
+// Returned when sending a request with a node that has a timeout (see
+// RequestBuilder.WithStatementTimeout) with a Client whose ServerProfile doesn't support
+// them; the request is not sent, as the server would silently ignore the timeout.
+var ErrStatementTimeoutUnsupported = errors.New("the server profile doesn't support statement timeouts")
+
+// Category of an error returned by ws4sqlite, derived from the HTTP code and the
+// index of the failing node.
+type ErrorCategory string
+
+const (
+	// Authentication failed (HTTP 401 or 403)
+	ERROR_CATEGORY_AUTH ErrorCategory = "AUTH"
+	// The request was malformed (HTTP 400)
+	ERROR_CATEGORY_MALFORMED ErrorCategory = "MALFORMED"
+	// The database was not found (HTTP 404)
+	ERROR_CATEGORY_NOT_FOUND ErrorCategory = "NOT_FOUND"
+	// A query/statement failed (HTTP 500 for a specific node)
+	ERROR_CATEGORY_SQL ErrorCategory = "SQL"
+	// Any other error
+	ERROR_CATEGORY_UNKNOWN ErrorCategory = "UNKNOWN"
+)
+
 // This is an exception that wraps the error structure of ws4sqlite. See the docs at
 // https://germ.gitbook.io/ws4sqlite/documentation/errors#global-errors
 //
@@ -27,8 +80,291 @@ type WsError struct {
 	Msg string `json:"error"`
 	// HTTP code
 	Code int `json:"-"`
+	// Category of the error, derived from the other fields
+	Category ErrorCategory `json:"-"`
+	// How long the server asked to wait before retrying, with a Retry-After header
+	// (e.g. along with a 429 or a 503); zero if not specified
+	RetryAfter time.Duration `json:"-"`
 }
 
 func (m WsError) Error() string {
 	return m.Msg
 }
+
+// Is the error an authentication failure?
+func (m WsError) IsAuth() bool {
+	return m.Category == ERROR_CATEGORY_AUTH
+}
+
+// Is the error caused by a malformed request?
+func (m WsError) IsMalformed() bool {
+	return m.Category == ERROR_CATEGORY_MALFORMED
+}
+
+// Is the error caused by a database that doesn't exist (HTTP 404)?
+func (m WsError) IsNotFound() bool {
+	return m.Category == ERROR_CATEGORY_NOT_FOUND
+}
+
+// Is the error caused by a failing query/statement?
+func (m WsError) IsSQL() bool {
+	return m.Category == ERROR_CATEGORY_SQL
+}
+
+// Does the message of the error contain any of the fragments?
+func (m WsError) msgContains(fragments ...string) bool {
+	for _, f := range fragments {
+		if strings.Contains(m.Msg, f) {
+			return true
+		}
+	}
+	return false
+}
+
+// Is the error caused by a UNIQUE (or PRIMARY KEY) constraint, e.g. a duplicate key? It's
+// detected from SQLite's error message.
+func (m WsError) IsUniqueViolation() bool {
+	return m.msgContains("UNIQUE constraint failed", "PRIMARY KEY must be unique", "is not unique")
+}
+
+// Is the error caused by a NOT NULL constraint? It's detected from SQLite's error message.
+func (m WsError) IsNotNullViolation() bool {
+	return m.msgContains("NOT NULL constraint failed", "may not be NULL")
+}
+
+// Is the error caused by a FOREIGN KEY constraint? It's detected from SQLite's error
+// message.
+func (m WsError) IsForeignKeyViolation() bool {
+	return m.msgContains("FOREIGN KEY constraint failed")
+}
+
+// Is the HTTP code a server error (5xx)? It includes failing queries/statements.
+func (m WsError) IsServerError() bool {
+	return m.Code >= 500 && m.Code < 600
+}
+
+// Is the HTTP code a client error (4xx)?
+func (m WsError) IsClientError() bool {
+	return m.Code >= 400 && m.Code < 500
+}
+
+// Is the HTTP code 401 or 403? It's an alias of IsAuth, that works from Code (with the
+// same rule that sets the Category), so also on a WsError whose Category is not set.
+func (m WsError) IsUnauthorized() bool {
+	return m.IsAuth() || categorize(m.Code, m.RequestIdx) == ERROR_CATEGORY_AUTH
+}
+
+// Content type of the documents returned by WsError.ToProblemJSON.
+const PROBLEM_JSON_CONTENT_TYPE = "application/problem+json"
+
+// An RFC 7807 problem detail.
+type problemDetail struct {
+	Type       string        `json:"type"`
+	Title      string        `json:"title"`
+	Status     int           `json:"status,omitempty"`
+	Detail     string        `json:"detail,omitempty"`
+	RequestIdx int           `json:"requestIdx"`
+	Category   ErrorCategory `json:"category,omitempty"`
+}
+
+// Converts the error to an RFC 7807 problem detail document (of content type
+// PROBLEM_JSON_CONTENT_TYPE), for services that expose the errors of ws4sqlite over
+// their own API. The title is the description of the HTTP code, the detail is the
+// message; the index of the failing node and the category are added as extension
+// members ("requestIdx" and "category").
+func (m WsError) ToProblemJSON() []byte {
+	title := http.StatusText(m.Code)
+	if title == "" {
+		title = "Unknown Error"
+	}
+	ret, _ := json.Marshal(problemDetail{
+		Type:       "about:blank",
+		Title:      title,
+		Status:     m.Code,
+		Detail:     m.Msg,
+		RequestIdx: m.RequestIdx,
+		Category:   m.Category,
+	})
+	return ret
+}
+
+func categorize(code, reqIdx int) ErrorCategory {
+	switch {
+	case code == 401 || code == 403:
+		return ERROR_CATEGORY_AUTH
+	case code == 400:
+		return ERROR_CATEGORY_MALFORMED
+	case code == 404:
+		return ERROR_CATEGORY_NOT_FOUND
+	case code == 500 && reqIdx >= 0:
+		return ERROR_CATEGORY_SQL
+	default:
+		return ERROR_CATEGORY_UNKNOWN
+	}
+}
+
+// Returned when a request, once marshalled, is larger than the limit set with
+// ClientBuilder.WithMaxRequestBytes. The request is not sent.
+type RequestTooLargeError struct {
+	// Size of the marshalled request, in bytes
+	Size int64
+	// The configured limit, in bytes
+	Limit int64
+}
+
+func (m RequestTooLargeError) Error() string {
+	return fmt.Sprintf("request is %d bytes, exceeding the limit of %d bytes", m.Size, m.Limit)
+}
+
+// Returned, with ClientBuilder.WithResponseContentTypeCheck, when a successful response
+// doesn't have a JSON Content-Type, e.g. an HTML page from a proxy.
+type UnexpectedContentTypeError struct {
+	// HTTP code of the response
+	Code int
+	// Content-Type of the response, possibly empty
+	ContentType string
+	// The beginning of the body of the response, up to MAX_BODY_SNIPPET bytes
+	BodySnippet string
+}
+
+// Maximum length of UnexpectedContentTypeError.BodySnippet.
+const MAX_BODY_SNIPPET = 200
+
+func newUnexpectedContentTypeError(code int, contentType string, body []byte) UnexpectedContentTypeError {
+	snippet := bytes.TrimSpace(body)
+	if len(snippet) > MAX_BODY_SNIPPET {
+		snippet = snippet[:MAX_BODY_SNIPPET]
+	}
+	return UnexpectedContentTypeError{Code: code, ContentType: contentType, BodySnippet: string(snippet)}
+}
+
+func (m UnexpectedContentTypeError) Error() string {
+	return fmt.Sprintf("the response (HTTP %d) has Content-Type '%s' instead of JSON: %s", m.Code, m.ContentType, m.BodySnippet)
+}
+
+// Returned when the validator set with ClientBuilder.WithResponseValidator rejects a
+// Response; it wraps the error of the validator.
+type ResponseValidationError struct {
+	// The error returned by the validator
+	Err error
+}
+
+func (m ResponseValidationError) Error() string {
+	return "invalid response: " + m.Err.Error()
+}
+
+func (m ResponseValidationError) Unwrap() error {
+	return m.Err
+}
+
+// Returned instead of WsError, with ClientBuilder.WithAuthChallengeErrors, when the server
+// answers 401 asking (with WWW-Authenticate) for an authentication scheme that the Client
+// doesn't use; use errors.As to extract the WsError.
+type AuthChallengeError struct {
+	WsError
+	// The scheme asked for by the server, e.g. "Basic"
+	Scheme string
+	// The realm of the challenge, if any
+	Realm string
+	// The authentication mode of the Client
+	AuthMode AuthMode
+}
+
+func (m AuthChallengeError) Error() string {
+	ret := fmt.Sprintf("the server requires %s authentication", m.Scheme)
+	if m.Realm != "" {
+		ret += fmt.Sprintf(" (realm \"%s\")", m.Realm)
+	}
+	ret += fmt.Sprintf(", but the client uses %s authentication", m.AuthMode)
+	switch strings.ToLower(m.Scheme) {
+	case "basic":
+		ret += "; see ClientBuilder.WithHTTPAuth"
+	case "bearer":
+		ret += "; see ClientBuilder.WithAuthTokenProvider"
+	}
+	return ret
+}
+
+func (m AuthChallengeError) Unwrap() error {
+	return m.WsError
+}
+
+var realmRegexp = regexp.MustCompile(`(?i)realm="([^"]*)"`)
+
+// Parses the WWW-Authenticate headers of a 401; returns nil if there are none, or if one
+// of them is for the scheme that the Client uses (so the credentials are wrong, rather
+// than missing). Only the first challenge of each header is considered.
+func newAuthChallengeError(wserr WsError, challenges []string, authMode AuthMode) *AuthChallengeError {
+	var used string
+	switch authMode {
+	case AUTH_MODE_HTTP:
+		used = "basic"
+	case AUTH_MODE_TOKEN:
+		used = "bearer"
+	}
+	var ret *AuthChallengeError
+	for _, challenge := range challenges {
+		fields := strings.Fields(challenge)
+		if len(fields) == 0 {
+			continue
+		}
+		scheme := strings.TrimSuffix(fields[0], ",")
+		if strings.EqualFold(scheme, used) {
+			return nil
+		}
+		if ret == nil {
+			ret = &AuthChallengeError{WsError: wserr, Scheme: scheme, AuthMode: authMode}
+			if m := realmRegexp.FindStringSubmatch(challenge); m != nil {
+				ret.Realm = m[1]
+			}
+		}
+	}
+	return ret
+}
+
+// Placeholder for the values that are not reported in a WsErrorWithValues.
+const REDACTED = "<redacted>"
+
+// A WsError that also reports the values that were bound to the failing query/statement.
+// It's returned instead of WsError when the Client is built with WithErrorValues; use
+// errors.As to extract the WsError.
+type WsErrorWithValues struct {
+	WsError
+	// Values of the failing node, if it wasn't a batch
+	Values map[string]interface{}
+	// Values of the failing node, if it was a batch
+	ValuesBatch []map[string]interface{}
+}
+
+func (m WsErrorWithValues) Unwrap() error {
+	return m.WsError
+}
+
+func newWsErrorWithValues(wserr WsError, item *requestItem) WsErrorWithValues {
+	var redacted []string
+	if item.Encoder != nil {
+		redacted = item.Encoder.Fields
+	}
+	ret := WsErrorWithValues{WsError: wserr, Values: redactValues(item.Values, redacted)}
+	for _, values := range item.ValuesBatch {
+		ret.ValuesBatch = append(ret.ValuesBatch, redactValues(values, redacted))
+	}
+	return ret
+}
+
+// Copies a values map, redacting the given keys.
+func redactValues(values map[string]interface{}, redacted []string) map[string]interface{} {
+	if values == nil {
+		return nil
+	}
+	ret := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		ret[k] = v
+	}
+	for _, k := range redacted {
+		if _, ok := ret[k]; ok {
+			ret[k] = REDACTED
+		}
+	}
+	return ret
+}
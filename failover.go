@@ -0,0 +1,86 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync/atomic"
+)
+
+// Builder method that sets several URLs of equivalent ws4sqlite remotes (e.g. replicas),
+// for a client-side failover: when the remote can't be reached, the request is sent to
+// the next URL, in order. The URL that last answered (also with an error, e.g. a failing
+// statement) is tried first by the following requests, also by the Clients derived with
+// Client.WithDatabase. Only communication failures cause a failover; with WithRetries,
+// each attempt tries all the URLs.
+//
+// It replaces the URL set with WithURL (or WithURLComponents), and a following call to
+// one of them replaces the URLs, disabling the failover. Path prefix and query parameters
+// are added to each URL.
+func (cb *ClientBuilder) WithURLs(urls ...string) *ClientBuilder {
+	if len(urls) == 0 {
+		cb.err = "cannot specify an empty list of urls"
+		return cb
+	}
+	for _, u := range urls {
+		if u == "" {
+			cb.err = "cannot specify an empty url"
+			return cb
+		}
+	}
+	cb.url = urls[0]
+	cb.urls = append([]string{}, urls...)
+	return cb
+}
+
+// The candidate URLs of a Client with failover, and the index of the preferred one.
+type failover struct {
+	urls      []string
+	preferred *atomic.Int32
+}
+
+// Sends the request to the preferred URL or, if it can't be reached, to the next ones.
+func (c *Client) sendFailover(ctx context.Context, req *Request, idempotencyKey string) (*Response, int, error) {
+	if c.failover == nil {
+		return c.send(ctx, req, idempotencyKey, c.cfg.url)
+	}
+	n := len(c.failover.urls)
+	start := int(c.failover.preferred.Load())
+	var res *Response
+	var code int
+	var err error
+	for i := 0; i < n; i++ {
+		idx := (start + i) % n
+		res, code, err = c.send(ctx, req, idempotencyKey, c.failover.urls[idx])
+		if !isUnreachable(ctx, code, err) {
+			c.failover.preferred.Store(int32(idx))
+			return res, code, err
+		}
+	}
+	return res, code, err
+}
+
+// Is the error a failure to communicate with the remote, that didn't answer?
+func isUnreachable(ctx context.Context, code int, err error) bool {
+	if err == nil || code != 0 || ctx.Err() != nil {
+		return false
+	}
+	var uerr *url.Error
+	return errors.As(err, &uerr)
+}
@@ -0,0 +1,79 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"context"
+	"fmt"
+)
+
+// Information about the remote, as detected by Client.ServerInfo.
+type ServerInfo struct {
+	// Version of SQLite used by the server
+	SQLiteVersion string
+	// Does the server support the encryption extension (encoders/decoders)?
+	Encryption bool
+	// Does the server support the compression of encrypted fields? It's part of
+	// the encryption extension.
+	Compression bool
+}
+
+// Detects the characteristics of the remote. ws4sqlite doesn't expose them, so they are
+// derived by sending a probe request, made of read-only queries: SQLite's version is
+// queried, and a decoder is applied to a non-encrypted value, that fails only if the
+// server supports encryption.
+func (c *Client) ServerInfo(ctx context.Context) (ServerInfo, error) {
+	req, err := NewRequestBuilder().
+		AddQuery("SELECT sqlite_version() AS VERSION").
+		AddQuery("SELECT 'not encrypted' AS PROBE").
+		WithNoFail().
+		WithDecoder("probe", "PROBE").
+		Build()
+	if err != nil {
+		return ServerInfo{}, err
+	}
+
+	res, _, err := c.SendWithContext(ctx, req)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	if len(res.Results) != 2 || len(res.Results[0].ResultSet) != 1 {
+		return ServerInfo{}, fmt.Errorf("unexpected response to the probe request")
+	}
+
+	version, _ := res.Results[0].ResultSet[0]["VERSION"].(string)
+	encryption := !res.Results[1].Success
+	return ServerInfo{
+		SQLiteVersion: version,
+		Encryption:    encryption,
+		Compression:   encryption,
+	}, nil
+}
+
+// Opens a connection to the remote (with the TLS handshake, if any) by sending a trivial
+// query, so that it's ready for the first Send; it's meant to be called at startup by
+// latency-sensitive services. The connection is kept alive by the transport for the
+// following requests, for as long as its idle timeout allows. It also checks the
+// credentials: any error of the query is returned. There are no retries.
+func (c *Client) Warmup(ctx context.Context) error {
+	req, err := NewRequestBuilder().AddQuery("SELECT 1").Build()
+	if err != nil {
+		return err
+	}
+	_, _, err = c.sendAuthenticated(ctx, req, "")
+	return err
+}
@@ -0,0 +1,122 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// The query appended after the statements with WithReturnLastInsertID.
+const lastInsertIDQuery = "SELECT last_insert_rowid() AS LAST_INSERT_ID"
+
+// Asks for the rowid of the last row inserted by the current statement, that is returned
+// in ResponseItem.LastInsertID. ws4sqlite (as of 0.12) doesn't return it, so the Client
+// sends a "SELECT last_insert_rowid()" query right after the statement, in the same
+// transaction, and removes its result from the Response. Allowed only for statements.
+//
+// As with SQLite's last_insert_rowid(), for a batch it's the rowid of the last inserted
+// row, and if the statement didn't insert any row it's the one of a previous insert (or
+// 0). It's not set if the statement fails (with WithNoFail).
+func (rb *RequestBuilder) WithReturnLastInsertID() *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	if rb.temp.Query != "" {
+		rb.err = "cannot ask for the last insert id of a query"
+		return rb
+	}
+	rb.temp.returnLastID = true
+	return rb
+}
+
+// Returns a copy of the request with a query for the last insert id after the nodes that
+// ask for it, and the index in the original request of each node; nil if there are none.
+func (req *Request) withLastInsertIDQueries() (*Request, []int) {
+	n := 0
+	for i := range req.req.Transaction {
+		if req.req.Transaction[i].returnLastID {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	ret := *req
+	ret.req.Transaction = make([]requestItem, 0, len(req.req.Transaction)+n)
+	origIdx := make([]int, 0, len(req.req.Transaction)+n)
+	for i, item := range req.req.Transaction {
+		returnLastID := item.returnLastID
+		item.returnLastID = false
+		ret.req.Transaction = append(ret.req.Transaction, item)
+		origIdx = append(origIdx, i)
+		if returnLastID {
+			ret.req.Transaction = append(ret.req.Transaction, requestItem{Query: lastInsertIDQuery, lastIDOf: true})
+			origIdx = append(origIdx, i)
+		}
+	}
+	return &ret, origIdx
+}
+
+// Sends a request, adding (and then removing) the queries for the last insert ids.
+func (c *Client) sendWithLastInsertIDs(ctx context.Context, req *Request, idempotencyKey string) (*Response, int, error) {
+	expanded, origIdx := req.withLastInsertIDQueries()
+	if expanded == nil {
+		return c.sendAuthenticated(ctx, req, idempotencyKey)
+	}
+	res, code, err := c.sendAuthenticated(ctx, expanded, idempotencyKey)
+	if err != nil {
+		return res, code, remapRequestIdx(err, origIdx)
+	}
+	if res == nil || len(res.Results) != len(expanded.req.Transaction) {
+		return res, code, nil
+	}
+	ret := &Response{Results: make([]ResponseItem, 0, len(req.req.Transaction))}
+	for i, item := range res.Results {
+		if !expanded.req.Transaction[i].lastIDOf {
+			ret.Results = append(ret.Results, item)
+			continue
+		}
+		prev := &ret.Results[len(ret.Results)-1]
+		if prev.Success && prev.LastInsertID == nil {
+			if v, ok := item.Value(0, "LAST_INSERT_ID"); ok {
+				prev.LastInsertID = toInt64(v)
+			}
+		}
+	}
+	return ret, code, nil
+}
+
+// Converts a number decoded from JSON to an int64, or returns nil.
+func toInt64(v interface{}) *int64 {
+	var n int64
+	switch v := v.(type) {
+	case float64:
+		n = int64(v)
+	case json.Number:
+		i, err := v.Int64()
+		if err != nil {
+			return nil
+		}
+		n = i
+	case int64:
+		n = v
+	default:
+		return nil
+	}
+	return &n
+}
@@ -0,0 +1,112 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// An option for a single call of Client.SendWithContext, that overrides the
+// configuration of the Client for that call only.
+type SendOption func(*sendConfig)
+
+type sendConfig struct {
+	timeout        time.Duration
+	headers        http.Header
+	idempotencyKey string
+	skipInline     bool
+	inline         *credentials
+}
+
+// Context key for the sendConfig of a call.
+type sendConfigKey struct{}
+
+// Option that sets a timeout for the call, retries included.
+func WithTimeout(d time.Duration) SendOption {
+	return func(cfg *sendConfig) {
+		cfg.timeout = d
+	}
+}
+
+// Option that sets an HTTP header for the call, replacing any value that the Client would
+// set. It can be used several times.
+func WithHeader(name, value string) SendOption {
+	return func(cfg *sendConfig) {
+		if cfg.headers == nil {
+			cfg.headers = make(http.Header)
+		}
+		cfg.headers.Set(name, value)
+	}
+}
+
+// Option that sets the idempotency key for the call, instead of the one of the Request
+// (see RequestBuilder.WithIdempotencyKey) or a generated one.
+func WithCallIdempotencyKey(key string) SendOption {
+	return func(cfg *sendConfig) {
+		cfg.idempotencyKey = key
+	}
+}
+
+// Option that doesn't add the INLINE credentials of the Client to the request, e.g. when
+// it's sent through a proxy that authenticates it.
+func WithoutInlineCredentials() SendOption {
+	return func(cfg *sendConfig) {
+		cfg.skipInline = true
+		cfg.inline = nil
+	}
+}
+
+// Option that adds the given credentials to the request, as for INLINE authentication,
+// whatever the authentication of the Client; they replace the ones of the Client, if any.
+func WithInlineCredentials(user, password string) SendOption {
+	return func(cfg *sendConfig) {
+		cfg.skipInline = false
+		cfg.inline = &credentials{User: user, Password: password}
+	}
+}
+
+// Applies the options to the call: returns the (possibly derived) context and request,
+// and the function to release the context.
+func applySendOptions(ctx context.Context, req *Request, opts []SendOption) (context.Context, *Request, context.CancelFunc) {
+	if len(opts) == 0 {
+		return ctx, req, func() {}
+	}
+	cfg := &sendConfig{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.idempotencyKey != "" {
+		r := *req
+		r.idempotencyKey = cfg.idempotencyKey
+		req = &r
+	}
+	ctx = context.WithValue(ctx, sendConfigKey{}, cfg)
+	if cfg.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.timeout)
+		return ctx, req, cancel
+	}
+	return ctx, req, func() {}
+}
+
+// Returns the sendConfig of the call, if any options were given.
+func callConfig(ctx context.Context) *sendConfig {
+	cfg, _ := ctx.Value(sendConfigKey{}).(*sendConfig)
+	return cfg
+}
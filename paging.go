@@ -0,0 +1,128 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Marker for the point of the SQL of Client.QueryPaged where the pagination clause is
+// injected.
+const PAGE_MARKER = "{{PAGE}}"
+
+// Names of the parameters that QueryPaged binds for the pagination.
+const (
+	PAGE_LIMIT_PARAM  = "ws4_limit"
+	PAGE_OFFSET_PARAM = "ws4_offset"
+)
+
+// Iterates over the records of a paged query; see Client.QueryPaged. Not thread safe.
+//
+// Example:
+//
+//	it, err := cli.QueryPaged(ctx, "SELECT * FROM TEMP ORDER BY ID", nil, 100)
+//	for it.Next() {
+//		row := it.Row()
+//		...
+//	}
+//	if it.Err() != nil { ... }
+type RowIterator struct {
+	ctx      context.Context
+	client   *Client
+	sql      string
+	values   map[string]interface{}
+	pageSize int
+	offset   int
+	page     []map[string]interface{}
+	idx      int
+	done     bool
+	err      error
+}
+
+// Runs a query one page at a time, using LIMIT and OFFSET: a page is fetched when the
+// records of the previous one are consumed, so large tables can be read without loading
+// them at once. The clause "LIMIT :ws4_limit OFFSET :ws4_offset" is injected in place of
+// PAGE_MARKER, or appended to the SQL if it's not present. Each page is a separate
+// request, so the query should have a stable ORDER BY. values can be nil.
+func (c *Client) QueryPaged(ctx context.Context, sql string, values map[string]interface{}, pageSize int) (*RowIterator, error) {
+	if pageSize < 1 {
+		return nil, errors.New("pageSize must be at least 1")
+	}
+	if _, ok := values[PAGE_LIMIT_PARAM]; ok {
+		return nil, fmt.Errorf("'%s' is reserved for the pagination", PAGE_LIMIT_PARAM)
+	}
+	if _, ok := values[PAGE_OFFSET_PARAM]; ok {
+		return nil, fmt.Errorf("'%s' is reserved for the pagination", PAGE_OFFSET_PARAM)
+	}
+	clause := fmt.Sprintf("LIMIT :%s OFFSET :%s", PAGE_LIMIT_PARAM, PAGE_OFFSET_PARAM)
+	if strings.Contains(sql, PAGE_MARKER) {
+		sql = strings.Replace(sql, PAGE_MARKER, clause, 1)
+	} else {
+		sql = strings.TrimRight(strings.TrimSpace(sql), ";") + " " + clause
+	}
+	return &RowIterator{ctx: ctx, client: c, sql: sql, values: values, pageSize: pageSize, idx: -1}, nil
+}
+
+// Advances to the next record, fetching a new page if needed. Returns false when there
+// are no more records, or on error (see Err).
+func (it *RowIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	it.idx++
+	if it.idx < len(it.page) {
+		return true
+	}
+	if it.done {
+		it.page = nil
+		return false
+	}
+
+	values := make(map[string]interface{}, len(it.values)+2)
+	for k, v := range it.values {
+		values[k] = v
+	}
+	values[PAGE_LIMIT_PARAM] = it.pageSize
+	values[PAGE_OFFSET_PARAM] = it.offset
+	ri, err := it.client.querySingle(it.ctx, it.sql, values)
+	if err != nil {
+		it.err = err
+		it.page = nil
+		return false
+	}
+	it.page = ri.ResultSet
+	it.idx = 0
+	it.offset += len(it.page)
+	it.done = len(it.page) < it.pageSize
+	return len(it.page) > 0
+}
+
+// The current record.
+func (it *RowIterator) Row() map[string]interface{} {
+	if it.idx < 0 || it.idx >= len(it.page) {
+		return nil
+	}
+	return it.page[it.idx]
+}
+
+// The error that stopped the iteration, if any.
+func (it *RowIterator) Err() error {
+	return it.err
+}
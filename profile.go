@@ -0,0 +1,159 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import "encoding/json"
+
+// Describes the wire format of a version of ws4sqlite, i.e. the names of the JSON fields
+// of requests and responses. The names of the parameters and of the columns in the
+// result sets are never changed.
+type ServerProfile struct {
+	name              string
+	fieldNames        map[string]string
+	statementTimeouts bool
+}
+
+// Profile for ws4sqlite 0.11.x up to the current version; it's the default.
+//
+// No later version is known to rename the fields, so there are no other predefined
+// profiles (e.g. for 0.16) yet; for a server that does, use NewServerProfile.
+var PROFILE_V0_11 = ServerProfile{name: "v0.11"}
+
+// Creates a custom ServerProfile, with a mapping from the current names of the JSON fields
+// (e.g. "valuesBatch") to the ones that the server expects. Fields that are not mapped
+// keep their name.
+func NewServerProfile(name string, fieldNames map[string]string) ServerProfile {
+	fn := make(map[string]string, len(fieldNames))
+	for k, v := range fieldNames {
+		fn[k] = v
+	}
+	return ServerProfile{name: name, fieldNames: fn}
+}
+
+// Name of the profile.
+func (p ServerProfile) Name() string {
+	return p.name
+}
+
+// Returns a copy of the profile that declares that the server supports per-node timeouts,
+// see RequestBuilder.WithStatementTimeout. ws4sqlite (as of 0.12) doesn't, so
+// PROFILE_V0_11 doesn't declare it.
+func (p ServerProfile) WithStatementTimeouts() ServerProfile {
+	p.statementTimeouts = true
+	return p
+}
+
+// Builder method that sets the ServerProfile, i.e. the wire format of the remote. By
+// default it's PROFILE_V0_11.
+func (cb *ClientBuilder) WithServerProfile(profile ServerProfile) *ClientBuilder {
+	cb.profile = profile
+	return cb
+}
+
+// Renames the keys of a JSON object, leaving the values untouched.
+func renameKeys(obj map[string]json.RawMessage, names map[string]string) {
+	for from, to := range names {
+		if v, ok := obj[from]; ok && from != to {
+			delete(obj, from)
+			obj[to] = v
+		}
+	}
+}
+
+// Renames the keys of the objects in a JSON array, leaving the values untouched.
+func renameKeysInArray(raw json.RawMessage, names map[string]string, nested ...string) (json.RawMessage, error) {
+	var items []map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, err
+	}
+	for i := range items {
+		for _, key := range nested {
+			if v, ok := items[i][key]; ok && string(v) != "null" {
+				var obj map[string]json.RawMessage
+				if err := json.Unmarshal(v, &obj); err != nil {
+					return nil, err
+				}
+				renameKeys(obj, names)
+				bs, err := json.Marshal(obj)
+				if err != nil {
+					return nil, err
+				}
+				items[i][key] = bs
+			}
+		}
+		renameKeys(items[i], names)
+	}
+	return json.Marshal(items)
+}
+
+// Adapts a marshalled request (top-level object, transaction items and their
+// encoder/decoder) to the field names of the profile.
+func (p ServerProfile) adaptRequest(body []byte) ([]byte, error) {
+	if len(p.fieldNames) == 0 {
+		return body, nil
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return nil, err
+	}
+	if tx, ok := obj["transaction"]; ok {
+		tx, err := renameKeysInArray(tx, p.fieldNames, "encoder", "decoder")
+		if err != nil {
+			return nil, err
+		}
+		obj["transaction"] = tx
+	}
+	if cred, ok := obj["credentials"]; ok {
+		var c map[string]json.RawMessage
+		if err := json.Unmarshal(cred, &c); err != nil {
+			return nil, err
+		}
+		renameKeys(c, p.fieldNames)
+		bs, err := json.Marshal(c)
+		if err != nil {
+			return nil, err
+		}
+		obj["credentials"] = bs
+	}
+	renameKeys(obj, p.fieldNames)
+	return json.Marshal(obj)
+}
+
+// Adapts a response (or an error) from the field names of the profile to the current
+// ones.
+func (p ServerProfile) adaptResponse(body []byte) ([]byte, error) {
+	if len(p.fieldNames) == 0 {
+		return body, nil
+	}
+	inverse := make(map[string]string, len(p.fieldNames))
+	for k, v := range p.fieldNames {
+		inverse[v] = k
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return nil, err
+	}
+	renameKeys(obj, inverse)
+	if results, ok := obj["results"]; ok && string(results) != "null" {
+		results, err := renameKeysInArray(results, inverse)
+		if err != nil {
+			return nil, err
+		}
+		obj["results"] = results
+	}
+	return json.Marshal(obj)
+}
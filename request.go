@@ -16,7 +16,14 @@
 
 package ws4sqlite_client
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
 
 type credentials struct {
 	User     string `json:"user"`
@@ -37,11 +44,108 @@ type requestItem struct {
 	ValuesBatch []map[string]interface{} `json:"valuesBatch,omitempty"`
 	Encoder     *requestItemCrypto       `json:"encoder,omitempty"`
 	Decoder     *requestItemCrypto       `json:"decoder,omitempty"`
+	Timeout     int64                    `json:"timeout,omitempty"`
+	Extra       map[string]interface{}   `json:"-"`
+	// see WithReturnLastInsertID
+	returnLastID bool
+	lastIDOf     bool
+	// see WithResultSchema
+	schema map[string]reflect.Kind
+}
+
+// Returns what to marshal for the node: the node itself or, if it has Extra fields, a map
+// with its fields and the Extra ones, that can't override them. This way the values are
+// encoded as they are, by the Marshaller of the Client.
+func (ri requestItem) wire() interface{} {
+	if len(ri.Extra) == 0 {
+		return ri
+	}
+	ret := make(map[string]interface{}, len(ri.Extra)+4)
+	for k, v := range ri.Extra {
+		ret[k] = v
+	}
+	for k, v := range jsonFields(ri) {
+		ret[k] = v
+	}
+	return ret
 }
 
 type request struct {
-	Credentials *credentials  `json:"credentials,omitempty"`
-	Transaction []requestItem `json:"transaction"`
+	Credentials *credentials           `json:"credentials,omitempty"`
+	ReadOnly    bool                   `json:"readOnly,omitempty"`
+	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	Transaction []requestItem          `json:"transaction"`
+	Extra       map[string]interface{} `json:"-"`
+}
+
+// Returns what to marshal for the request; see requestItem.wire.
+func (r request) wire() interface{} {
+	hasExtra := len(r.Extra) > 0
+	for i := range r.Transaction {
+		if len(r.Transaction[i].Extra) > 0 {
+			hasExtra = true
+			break
+		}
+	}
+	if !hasExtra {
+		return r
+	}
+	ret := r.fields()
+	items := make([]interface{}, len(r.Transaction))
+	for i := range r.Transaction {
+		items[i] = r.Transaction[i].wire()
+	}
+	ret["transaction"] = items
+	return ret
+}
+
+// Returns the fields of the request, Extra ones included, by their JSON name.
+func (r request) fields() map[string]interface{} {
+	ret := make(map[string]interface{}, len(r.Extra)+4)
+	for k, v := range r.Extra {
+		ret[k] = v
+	}
+	for k, v := range jsonFields(r) {
+		ret[k] = v
+	}
+	return ret
+}
+
+// Returns the fields of a struct that encoding/json marshals, by their JSON name, honoring
+// the "-" name and the omitempty option.
+func jsonFields(v interface{}) map[string]interface{} {
+	rv := reflect.ValueOf(v)
+	rt := rv.Type()
+	ret := make(map[string]interface{}, rt.NumField())
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		name := tag[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fv := rv.Field(i)
+		if len(tag) > 1 && tag[1] == "omitempty" && isEmptyJSONValue(fv) {
+			continue
+		}
+		ret[name] = fv.Interface()
+	}
+	return ret
+}
+
+// Is the value omitted by encoding/json when the field has the omitempty option?
+func isEmptyJSONValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	}
+	return v.IsZero()
 }
 
 // A builder class to build a Request to send to the ws4sqlite server with the <Client>.Send(Request) method.
@@ -49,14 +153,33 @@ type request struct {
 // If an error is encountered during built, it's returned at Build() time, to be
 // able to chain.
 type RequestBuilder struct {
-	err  string
-	list request
-	temp *requestItem
+	err            string
+	list           request
+	temp           *requestItem
+	valueEncoder   func(v interface{}) (interface{}, bool)
+	valuesCheck    func(key string, value interface{}) error
+	idempotencyKey string
+	strictBatch    bool
+	noFailAll      bool
+	validateParams bool
+	singleStmt     bool
+	globalValues   map[string]interface{}
 }
 
 // Container class for a request to ws4sqlite. Built with RequestBuilder.
+//
+// Each AddQuery/AddStatement (and the other Add... methods) creates exactly one node, in
+// the order of the calls; values, also when they make a batch, are part of the node, so
+// the i-th node always matches the i-th item of Response.Results.
 type Request struct {
-	req request
+	req            request
+	idempotencyKey string
+}
+
+// Number of nodes (queries and statements) of the request, i.e. the expected length of
+// Response.Results.
+func (req *Request) NodeCount() int {
+	return len(req.req.Transaction)
 }
 
 // First step when building. Generates a new RequestBuilder instance.
@@ -92,6 +215,184 @@ func (rb *RequestBuilder) AddStatement(statement string) *RequestBuilder {
 	return rb
 }
 
+// Adds a new request to the list, for a statement written with positional parameters
+// ("?"), as many SQL libraries use; as ws4sqlite binds named parameters, each "?" is
+// rewritten as ":p0", ":p1"... (see POSITIONAL_PARAM_PREFIX), and args become the values
+// with those names. Question marks in string literals, quoted identifiers and comments are
+// not parameters. The number of args must match the number of parameters.
+func (rb *RequestBuilder) AddStatementPositional(sql string, args ...interface{}) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	named, n, err := positionalToNamed(sql)
+	if err != nil {
+		rb.err = err.Error()
+		return rb
+	}
+	if n != len(args) {
+		rb.err = fmt.Sprintf("the statement has %d parameters, but %d arguments were given", n, len(args))
+		return rb
+	}
+	rb.AddStatement(named)
+	if n > 0 {
+		values := make(map[string]interface{}, n)
+		for i, arg := range args {
+			values[fmt.Sprintf("%s%d", POSITIONAL_PARAM_PREFIX, i)] = arg
+		}
+		rb.temp.Values = values
+	}
+	return rb
+}
+
+// Prefix that marks a query or statement as a reference to a stored statement, i.e.
+// a statement declared by id in the configuration of the database on the server.
+const STORED_STATEMENT_PREFIX = "#"
+
+// Adds a new request to the list, for a query that was stored on the server with the given
+// id; only the reference is sent. It must be configured later on with the proper methods.
+func (rb *RequestBuilder) AddStoredQuery(id string) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	if err := checkStoredID(id); err != "" {
+		rb.err = err
+		return rb
+	}
+	return rb.AddQuery(STORED_STATEMENT_PREFIX + id)
+}
+
+// Adds a new request to the list, for a statement that was stored on the server with the
+// given id; only the reference is sent. It must be configured later on with the proper
+// methods.
+func (rb *RequestBuilder) AddStoredStatement(id string) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	if err := checkStoredID(id); err != "" {
+		rb.err = err
+		return rb
+	}
+	return rb.AddStatement(STORED_STATEMENT_PREFIX + id)
+}
+
+func checkStoredID(id string) string {
+	if id == "" {
+		return "the id of a stored statement cannot be empty"
+	}
+	if strings.TrimSpace(id) != id || strings.HasPrefix(id, STORED_STATEMENT_PREFIX) {
+		return fmt.Sprintf("invalid id for a stored statement: '%s'", id)
+	}
+	return ""
+}
+
+// Whether the item references a stored statement, so its SQL is not known to the client.
+func (ri *requestItem) isStored() bool {
+	return strings.HasPrefix(ri.Query+ri.Statement, STORED_STATEMENT_PREFIX)
+}
+
+// Adds a new request to the list, for a statement that is executed once per item of rows,
+// as a batch; it's the same as calling WithValues for each row, but it always creates a
+// batch, also for a single row. It's an error if rows is empty or contains nil items.
+func (rb *RequestBuilder) AddBatchInsert(statement string, rows []map[string]interface{}) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	if len(rows) == 0 {
+		rb.err = "cannot specify an empty batch"
+		return rb
+	}
+	for i := range rows {
+		if rows[i] == nil {
+			rb.err = fmt.Sprintf("batch item #%d is nil", i)
+			return rb
+		}
+	}
+	rb.AddStatement(statement)
+	rb.temp.ValuesBatch = append([]map[string]interface{}{}, rows...)
+	return rb
+}
+
+// Adds a new request to the list, for a statement that inserts row into table or, if a
+// record with the same values of keyCols already exists, updates its other columns to the
+// values of row, i.e.
+//
+//	INSERT INTO "table" ("k", "c") VALUES (:k, :c) ON CONFLICT ("k") DO UPDATE SET "c" = excluded."c"
+//
+// If all the columns are keys, an existing record is left untouched (DO NOTHING). The
+// keys must be the columns of a unique index (or of the primary key) of the table.
+//
+// Table and column names are quoted, and the values of row are bound as parameters named
+// after the columns, so each column name must be a valid parameter name (letters, digits
+// and underscores); row must contain all of keyCols. The columns are in alphabetical order.
+func (rb *RequestBuilder) AddUpsert(table string, keyCols []string, row map[string]interface{}) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	if table == "" {
+		rb.err = "cannot specify an empty table"
+		return rb
+	}
+	if len(keyCols) == 0 {
+		rb.err = "cannot specify an upsert without key columns"
+		return rb
+	}
+	if len(row) == 0 {
+		rb.err = "cannot specify an empty row"
+		return rb
+	}
+	keys := make(map[string]bool, len(keyCols))
+	for _, k := range keyCols {
+		if _, ok := row[k]; !ok {
+			rb.err = fmt.Sprintf("key column '%s' is not in the row", k)
+			return rb
+		}
+		if keys[k] {
+			rb.err = fmt.Sprintf("duplicate key column '%s'", k)
+			return rb
+		}
+		keys[k] = true
+	}
+	cols := make([]string, 0, len(row))
+	for col := range row {
+		if !isParamName(col) {
+			rb.err = fmt.Sprintf("column '%s' cannot be bound as a parameter", col)
+			return rb
+		}
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+
+	quotedCols := make([]string, len(cols))
+	params := make([]string, len(cols))
+	var updates []string
+	for i, col := range cols {
+		quotedCols[i] = quoteIdentifier(col)
+		params[i] = ":" + col
+		if !keys[col] {
+			updates = append(updates, quotedCols[i]+" = excluded."+quotedCols[i])
+		}
+	}
+	quotedKeys := make([]string, len(keyCols))
+	for i, k := range keyCols {
+		quotedKeys[i] = quoteIdentifier(k)
+	}
+	action := "NOTHING"
+	if len(updates) > 0 {
+		action = "UPDATE SET " + strings.Join(updates, ", ")
+	}
+	statement := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (%s) DO %s",
+		quoteIdentifier(table), strings.Join(quotedCols, ", "), strings.Join(params, ", "),
+		strings.Join(quotedKeys, ", "), action)
+
+	values := make(map[string]interface{}, len(row))
+	for k, v := range row {
+		values[k] = v
+	}
+	rb.AddStatement(statement)
+	rb.temp.Values = values
+	return rb
+}
+
 // Specify that the request must not cause a general failure.
 func (rb *RequestBuilder) WithNoFail() *RequestBuilder {
 	if rb.err != "" {
@@ -103,10 +404,23 @@ func (rb *RequestBuilder) WithNoFail() *RequestBuilder {
 
 // Adds a list of values (ok, amap) for the request. If there's already one,
 // it creates a batch.
-func (rb *RequestBuilder) WithValues(values map[string]interface{}) *RequestBuilder {
+//
+// The values can be a map with string keys or a struct (or a pointer to it); for
+// structs, the parameter names are the field names, or the ones specified in a
+// `ws4:"name"` tag (see TAG_NAME).
+func (rb *RequestBuilder) WithValues(v interface{}) *RequestBuilder {
 	if rb.err != "" {
 		return rb
 	}
+	if v == nil {
+		rb.err = "cannot specify a nil argument"
+		return rb
+	}
+	values, err := toValues(v)
+	if err != nil {
+		rb.err = err.Error()
+		return rb
+	}
 	if values == nil {
 		rb.err = "cannot specify a nil argument"
 		return rb
@@ -126,7 +440,92 @@ func (rb *RequestBuilder) WithValues(values map[string]interface{}) *RequestBuil
 	return rb
 }
 
-// Add an encoder to the request, with compression. Allowed only for statements.
+// Merges several maps of values into the values of the current node; for the same key,
+// the value of the last map wins, and the values already set are overridden. It's meant for
+// parameters that come from different sources, for a single node: unlike calling WithValues
+// several times, it doesn't create a batch. If the node is already a batch, the maps are
+// merged into its last item, as WithValue does. Nil maps are skipped. The maps are not
+// modified.
+func (rb *RequestBuilder) WithMergedValues(maps ...map[string]interface{}) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	if len(maps) == 0 {
+		rb.err = "cannot specify an empty list of maps"
+		return rb
+	}
+	target := &rb.temp.Values
+	if n := len(rb.temp.ValuesBatch); n > 0 {
+		target = &rb.temp.ValuesBatch[n-1]
+	}
+	merged := make(map[string]interface{}, len(*target))
+	for k, v := range *target {
+		merged[k] = v
+	}
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	*target = merged
+	return rb
+}
+
+// Sets the value of a single parameter for the request, so that values can be built
+// incrementally. Several calls (also after WithValues) accumulate in the same values; if
+// the request is already a batch, the value is set in its last item. A following call to
+// WithValues still creates a batch.
+func (rb *RequestBuilder) WithValue(key string, value interface{}) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	if key == "" {
+		rb.err = "cannot specify an empty key"
+		return rb
+	}
+	target := &rb.temp.Values
+	if n := len(rb.temp.ValuesBatch); n > 0 {
+		target = &rb.temp.ValuesBatch[n-1]
+	}
+	values := make(map[string]interface{}, len(*target)+1)
+	for k, v := range *target {
+		values[k] = v
+	}
+	values[key] = value
+	*target = values
+	return rb
+}
+
+// Sets a timeout for the execution of the current query or statement on the server, sent
+// as a "timeout" field of the node, in milliseconds; it must be at least a millisecond.
+//
+// ws4sqlite (as of 0.12) doesn't support it, so a request with a timeout can only be sent
+// by a Client whose ServerProfile declares it (see ServerProfile.WithStatementTimeouts),
+// otherwise it fails with ErrStatementTimeoutUnsupported.
+func (rb *RequestBuilder) WithStatementTimeout(d time.Duration) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	if d < time.Millisecond {
+		rb.err = "a statement timeout must be at least a millisecond"
+		return rb
+	}
+	rb.temp.Timeout = d.Milliseconds()
+	return rb
+}
+
+// Whether any node of the request has a timeout.
+func (req *Request) hasStatementTimeouts() bool {
+	for i := range req.req.Transaction {
+		if req.req.Transaction[i].Timeout > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Add an encoder to the request, with compression. Allowed only for statements. See
+// WithEncoder for batches.
 func (rb *RequestBuilder) WithEncoderAndCompression(password string, compressionLevel int, fields ...string) *RequestBuilder {
 	if rb.err != "" {
 		return rb
@@ -151,7 +550,9 @@ func (rb *RequestBuilder) WithEncoderAndCompression(password string, compression
 	return rb
 }
 
-// Add an encoder to the request. Allowed only for statements.
+// Add an encoder to the request. Allowed only for statements. If the statement has a
+// batch of values, the fields are encoded in each item of the batch; at Build time, every
+// field must have a value in each item.
 func (rb *RequestBuilder) WithEncoder(password string, fields ...string) *RequestBuilder {
 	if rb.err != "" {
 		return rb
@@ -191,6 +592,207 @@ func (rb *RequestBuilder) WithDecoder(password string, fields ...string) *Reques
 	return rb
 }
 
+// Marks the whole request as read-only, as a hint for the server. The request must contain
+// only queries, or Build will return an error.
+//
+// ws4sqlite (as of 0.12) doesn't support this yet and ignores it; it's a forward-compatible
+// flag, that is sent as a top-level "readOnly" field.
+func (rb *RequestBuilder) WithReadOnly() *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	rb.list.ReadOnly = true
+	return rb
+}
+
+// Attaches free-form metadata (labels, the caller's name...) to the whole request, for
+// logging and auditing on the server; it's sent as a top-level "metadata" field. Calling it
+// again replaces the previous metadata. The map is copied.
+//
+// ws4sqlite (as of 0.12) ignores it, as it does with all the unknown fields; it's
+// forward-compatible.
+func (rb *RequestBuilder) WithRequestMetadata(meta map[string]interface{}) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	if len(meta) == 0 {
+		rb.err = "cannot specify empty metadata"
+		return rb
+	}
+	rb.list.Metadata = make(map[string]interface{}, len(meta))
+	for k, v := range meta {
+		rb.list.Metadata[k] = v
+	}
+	return rb
+}
+
+// Adds a field to the top-level object of the request, for request-level features of
+// ws4sqlite that the builder doesn't support (yet); see AddRaw for the nodes. Calling it
+// again with the same key replaces the value. It can't set the fields that the builder
+// manages: credentials, readOnly, metadata and transaction.
+func (rb *RequestBuilder) WithExtraField(key string, value interface{}) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	switch key {
+	case "":
+		rb.err = "cannot specify an empty key"
+		return rb
+	case "credentials", "readOnly", "metadata", "transaction":
+		rb.err = fmt.Sprintf("cannot specify %q as an extra field", key)
+		return rb
+	}
+	if rb.list.Extra == nil {
+		rb.list.Extra = make(map[string]interface{})
+	}
+	rb.list.Extra[key] = value
+	return rb
+}
+
+// Sets the key to send as Idempotency-Key header; it's the same for all the retries of
+// a Send. See also ClientBuilder.WithIdempotencyKeys.
+func (rb *RequestBuilder) WithIdempotencyKey(key string) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	if key == "" {
+		rb.err = "cannot specify an empty idempotency key"
+		return rb
+	}
+	rb.idempotencyKey = key
+	return rb
+}
+
+// Sets values that are added, at Build time, to every node of the request (and to each
+// item of a batch), e.g. a ":now" timestamp or a ":tenant" shared by all the queries and
+// statements. The values of each node take precedence, so keys that it already defines are
+// not overridden. Several calls accumulate; the map is copied.
+func (rb *RequestBuilder) WithGlobalValues(values map[string]interface{}) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	if values == nil {
+		rb.err = "cannot specify a nil argument"
+		return rb
+	}
+	if rb.globalValues == nil {
+		rb.globalValues = make(map[string]interface{}, len(values))
+	}
+	for k, v := range values {
+		rb.globalValues[k] = v
+	}
+	return rb
+}
+
+// Specify that no request must cause a general failure, as if WithNoFail was called on
+// each of them; it's applied at Build time. Nodes that were explicitly configured with
+// WithNoFail are not affected.
+func (rb *RequestBuilder) WithContinueOnError() *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	rb.noFailAll = true
+	return rb
+}
+
+// Enables the validation of the parameters at Build time: every named parameter in the SQL
+// (e.g. ":id") must have a value, also in each batch item; the fields of an encoder must be
+// parameters of the statement, and the fields of a decoder must be referenced in the query
+// (unless it selects "*"). Crypto fields that don't match would silently not be processed.
+// Stored statements are not validated, as their SQL is only known to the server.
+func (rb *RequestBuilder) WithParamValidation() *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	rb.validateParams = true
+	return rb
+}
+
+// Enables the check, at Build time, that the SQL of each node is a single statement without
+// comments (a trailing semicolon is allowed), as a safety measure against SQL injected by
+// concatenating strings: use parameters instead. Semicolons and comment markers inside
+// string literals or quoted identifiers are not considered. Stored statements are not
+// checked.
+func (rb *RequestBuilder) WithRejectMultiStatement() *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	rb.singleStmt = true
+	return rb
+}
+
+// Enables the check, at Build time, that all the values of a batch have the same set
+// of keys; a missing key would be silently bound to null by the server.
+func (rb *RequestBuilder) WithStrictBatch() *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	rb.strictBatch = true
+	return rb
+}
+
+// Sets a function that is applied to each value (also in batches) at Build time, before
+// marshalling. It can be used to convert custom types (decimals, UUIDs, enums...) to a form
+// that ws4sqlite understands. If the function returns false, the value is left untouched.
+func (rb *RequestBuilder) WithValueEncoder(fn func(v interface{}) (interface{}, bool)) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	if fn == nil {
+		rb.err = "cannot specify a nil argument"
+		return rb
+	}
+	rb.valueEncoder = fn
+	return rb
+}
+
+// Sets a function that is applied to each value (also in batches) at Build time, to reject
+// the ones that the application doesn't allow (e.g. too long strings, or unexpected types).
+// If it returns an error, Build fails with it, wrapped with the node and the key of the
+// value. It sees the values as they are sent, i.e. after WithValueEncoder and
+// WithGlobalValues.
+func (rb *RequestBuilder) WithValuesValidator(fn func(key string, value interface{}) error) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	if fn == nil {
+		rb.err = "cannot specify a nil argument"
+		return rb
+	}
+	rb.valuesCheck = fn
+	return rb
+}
+
+// Applies the values validator to a values map, in the order of the keys.
+func (rb *RequestBuilder) checkValues(values map[string]interface{}) error {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := rb.valuesCheck(k, values[k]); err != nil {
+			return fmt.Errorf("invalid value for %q: %w", k, err)
+		}
+	}
+	return nil
+}
+
+// Applies the value encoder to a values map, returning a new map.
+func (rb *RequestBuilder) encodeValues(values map[string]interface{}) map[string]interface{} {
+	if values == nil {
+		return nil
+	}
+	ret := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		if v2, ok := rb.valueEncoder(v); ok {
+			v = v2
+		}
+		ret[k] = v
+	}
+	return ret
+}
+
 // Returns the Request that was built, returning also any error that was
 // encountered during build.
 func (rb *RequestBuilder) Build() (*Request, error) {
@@ -201,5 +803,213 @@ func (rb *RequestBuilder) Build() (*Request, error) {
 		return nil, errors.New(rb.err)
 	}
 	rb.list.Transaction = append(rb.list.Transaction, *rb.temp)
-	return &Request{rb.list}, nil
+	if rb.list.ReadOnly {
+		for i := range rb.list.Transaction {
+			if rb.list.Transaction[i].Statement != "" {
+				return nil, errors.New("cannot specify a statement in a read-only request")
+			}
+		}
+	}
+	if len(rb.globalValues) > 0 {
+		rb.list.Transaction = mergeDefaultValues(rb.list.Transaction, rb.globalValues)
+	}
+	if rb.noFailAll {
+		for i := range rb.list.Transaction {
+			rb.list.Transaction[i].NoFail = true
+		}
+	}
+	for i := range rb.list.Transaction {
+		if err := checkEncoderFields(&rb.list.Transaction[i]); err != nil {
+			return nil, fmt.Errorf("in request #%d: %w", i, err)
+		}
+	}
+	if rb.strictBatch {
+		for i := range rb.list.Transaction {
+			if err := checkBatchKeys(rb.list.Transaction[i].ValuesBatch); err != nil {
+				return nil, fmt.Errorf("in request #%d: %w", i, err)
+			}
+		}
+	}
+	if rb.singleStmt {
+		for i := range rb.list.Transaction {
+			item := &rb.list.Transaction[i]
+			if item.isStored() {
+				continue
+			}
+			if err := checkSingleStatement(item.Query + item.Statement); err != nil {
+				return nil, fmt.Errorf("in request #%d: %w", i, err)
+			}
+		}
+	}
+	if rb.validateParams {
+		for i := range rb.list.Transaction {
+			if rb.list.Transaction[i].isStored() {
+				continue
+			}
+			if err := validateParams(&rb.list.Transaction[i]); err != nil {
+				return nil, fmt.Errorf("in request #%d: %w", i, err)
+			}
+		}
+	}
+	if rb.valueEncoder != nil {
+		for i := range rb.list.Transaction {
+			item := &rb.list.Transaction[i]
+			item.Values = rb.encodeValues(item.Values)
+			if item.ValuesBatch != nil {
+				batch := make([]map[string]interface{}, len(item.ValuesBatch))
+				for i2 := range item.ValuesBatch {
+					batch[i2] = rb.encodeValues(item.ValuesBatch[i2])
+				}
+				item.ValuesBatch = batch
+			}
+		}
+	}
+	if rb.valuesCheck != nil {
+		for i := range rb.list.Transaction {
+			item := &rb.list.Transaction[i]
+			if err := rb.checkValues(item.Values); err != nil {
+				return nil, fmt.Errorf("in request #%d: %w", i, err)
+			}
+			for i2 := range item.ValuesBatch {
+				if err := rb.checkValues(item.ValuesBatch[i2]); err != nil {
+					return nil, fmt.Errorf("in request #%d, batch item #%d: %w", i, i2, err)
+				}
+			}
+		}
+	}
+	return &Request{rb.list, rb.idempotencyKey}, nil
+}
+
+// Checks that the fields of the encoder, if any, have a value in all the items of the
+// batch, if the node has one.
+func checkEncoderFields(item *requestItem) error {
+	if item.Encoder == nil {
+		return nil
+	}
+	for _, field := range item.Encoder.Fields {
+		for i, row := range item.ValuesBatch {
+			if _, ok := row[field]; !ok {
+				return fmt.Errorf("encoder field '%s' has no value in batch item #%d", field, i)
+			}
+		}
+	}
+	return nil
+}
+
+// Checks that all the items of a batch have the same keys as the first one.
+func checkBatchKeys(batch []map[string]interface{}) error {
+	for i := 1; i < len(batch); i++ {
+		if len(batch[i]) != len(batch[0]) {
+			return fmt.Errorf("batch item #%d has a different set of keys than #0", i)
+		}
+		for k := range batch[0] {
+			if _, ok := batch[i][k]; !ok {
+				return fmt.Errorf("batch item #%d has no key '%s'", i, k)
+			}
+		}
+	}
+	return nil
+}
+
+// A single query or statement, to be used with NewRequestFromPairs.
+type SQLPair struct {
+	// The SQL text of the query or statement
+	SQL string
+	// Is it a query (true) or a statement (false)?
+	IsQuery bool
+	// Optional values for the parameters
+	Values map[string]interface{}
+	// Optional batch of values for the parameters; only for statements, and
+	// exclusive with Values
+	ValuesBatch []map[string]interface{}
+	// Specify that the request must not cause a general failure
+	NoFail bool
+}
+
+// Builds a Request from a slice of SQLPair, without using the fluent methods of
+// RequestBuilder; useful when the request is generated programmatically. The same
+// validations of RequestBuilder are performed.
+func NewRequestFromPairs(pairs []SQLPair) (*Request, error) {
+	rb := NewRequestBuilder()
+	for i := range pairs {
+		if pairs[i].Values != nil && pairs[i].ValuesBatch != nil {
+			return nil, errors.New("cannot specify both values and a batch")
+		}
+		if pairs[i].IsQuery {
+			rb.AddQuery(pairs[i].SQL)
+		} else {
+			rb.AddStatement(pairs[i].SQL)
+		}
+		if pairs[i].NoFail {
+			rb.WithNoFail()
+		}
+		if pairs[i].Values != nil {
+			rb.WithValues(pairs[i].Values)
+		}
+		for _, values := range pairs[i].ValuesBatch {
+			rb.WithValues(values)
+		}
+	}
+	return rb.Build()
+}
+
+// Crypto configuration of a RequestItem; see RequestBuilder.WithEncoder and
+// RequestBuilder.WithDecoder.
+type RequestItemCrypto struct {
+	Password         string
+	Fields           []string
+	CompressionLevel int
+}
+
+// A raw query or statement, to add with RequestBuilder.AddRaw. It mirrors the JSON
+// node of the request, see https://germ.gitbook.io/ws4sqlite/documentation/requests
+type RequestItem struct {
+	Query       string
+	Statement   string
+	NoFail      bool
+	Values      map[string]interface{}
+	ValuesBatch []map[string]interface{}
+	Encoder     *RequestItemCrypto
+	Decoder     *RequestItemCrypto
+	// Other fields to add to the JSON node, for features not yet supported by the
+	// builder. They can't override the fields above.
+	Extra map[string]interface{}
+}
+
+func toRequestItemCrypto(c *RequestItemCrypto) *requestItemCrypto {
+	if c == nil {
+		return nil
+	}
+	return &requestItemCrypto{
+		Password:         c.Password,
+		Fields:           append([]string{}, c.Fields...),
+		CompressionLevel: c.CompressionLevel,
+	}
+}
+
+// Adds a raw node to the list; it's an escape hatch for features that the builder doesn't
+// support (yet). It must have exactly one of Query and Statement; no other check is
+// performed.
+func (rb *RequestBuilder) AddRaw(item RequestItem) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	if (item.Query == "") == (item.Statement == "") {
+		rb.err = "a raw item must have exactly one of query and statement"
+		return rb
+	}
+	if rb.temp != nil {
+		rb.list.Transaction = append(rb.list.Transaction, *rb.temp)
+	}
+	rb.temp = &requestItem{
+		Query:       item.Query,
+		Statement:   item.Statement,
+		NoFail:      item.NoFail,
+		Values:      item.Values,
+		ValuesBatch: item.ValuesBatch,
+		Encoder:     toRequestItemCrypto(item.Encoder),
+		Decoder:     toRequestItemCrypto(item.Decoder),
+		Extra:       item.Extra,
+	}
+	return rb
 }
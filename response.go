@@ -16,14 +16,26 @@
 
 package ws4sqlite_client
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+)
 
 type responseItem struct {
-	Success          bool                         `json:"success"`
-	RowsUpdated      *int64                       `json:"rowsUpdated"`
-	RowsUpdatedBatch []int64                      `json:"rowsUpdatedBatch"`
-	ResultSet        []map[string]json.RawMessage `json:"resultSet"`
-	Error            string                       `json:"error"`
+	Success          bool            `json:"success"`
+	RowsUpdated      *int64          `json:"rowsUpdated"`
+	RowsUpdatedBatch []int64         `json:"rowsUpdatedBatch"`
+	LastInsertID     *int64          `json:"lastInsertId"`
+	ResultSet        json.RawMessage `json:"resultSet"`
+	Error            string          `json:"error"`
 }
 
 type response struct {
@@ -43,6 +55,9 @@ type response struct {
 //
 // - ResultSet: if the node was a query; it's a slice of maps with an item per returned
 // record, and each map has the name of the filed as a key of each entry, and the value as a value.
+//
+// ResultSet is guaranteed to be non-nil (but possibly empty) for successful queries, and nil
+// for statements.
 type ResponseItem struct {
 	// Was the request successful?
 	Success bool
@@ -52,13 +67,60 @@ type ResponseItem struct {
 	// If the node was a statement and a batch of values was provided, it's a slice of the
 	// numbers of updated rows for each batch item
 	RowsUpdatedBatch []int64
+	// If the node was a statement, the rowid of the last inserted row, when returned by the
+	// server or requested with RequestBuilder.WithReturnLastInsertID
+	LastInsertID *int64
 	// If the node was a query, it's a slice of maps with an item per returned record, and
-	// each map has the name of the filed as a key of each entry, and the value as a value
+	// each map has the name of the filed as a key of each entry, and the value as a value.
+	// Never nil for a successful query, even if it returned no records
 	ResultSet []map[string]interface{}
+	// If the node was a query, the columns of the result set, in the order they were
+	// returned by the server (ws4sqlite up to 0.12 sorts them alphabetically)
+	Columns []ColumnMeta
+	// If the node was a query and the Client was built with WithOrderedRows, the same
+	// records of ResultSet, preserving the order of the columns as sent by the server
+	OrderedResultSet []OrderedRow
 	// Reason for the error, if the request wasn't successful
 	Error string
 }
 
+// A record of a result set, that preserves the order of the columns as sent by the
+// server. See ClientBuilder.WithOrderedRows.
+type OrderedRow struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+// Returns the names of the columns, in order.
+func (r OrderedRow) Keys() []string {
+	return append([]string{}, r.keys...)
+}
+
+// Returns the value of a column, and whether the column is present.
+func (r OrderedRow) Get(key string) (interface{}, bool) {
+	v, ok := r.values[key]
+	return v, ok
+}
+
+// Returns the values of the record, in the order of Keys().
+func (r OrderedRow) Values() []interface{} {
+	ret := make([]interface{}, len(r.keys))
+	for i, k := range r.keys {
+		ret[i] = r.values[k]
+	}
+	return ret
+}
+
+// Describes a column of a ResultSet.
+type ColumnMeta struct {
+	// Name of the column
+	Name string
+	// Type of the column. ws4sqlite doesn't report it, so it's inferred from the first
+	// non-null value: "INTEGER", "REAL", "TEXT", "BOOLEAN", or "" if all values are null
+	// or the type can't be determined
+	DeclaredType string
+}
+
 // Response coming from the endpoint, that is a list of single responses
 // matching the list of request that were submitted. The single responses
 // are of type ResponseItem.
@@ -66,3 +128,417 @@ type Response struct {
 	// Slice with the results, each one is a ResponseItem
 	Results []ResponseItem
 }
+
+// Returns the number of rows updated by a non-batch statement, and whether it was present
+// (i.e. the node was a non-batch statement). Avoids dealing with the RowsUpdated pointer.
+func (ri ResponseItem) AffectedRows() (int64, bool) {
+	if ri.RowsUpdated == nil {
+		return 0, false
+	}
+	return *ri.RowsUpdated, true
+}
+
+// Returns the total number of rows updated by a statement; for a batch, it's the sum of
+// RowsUpdatedBatch. Returns 0 for queries and failed nodes.
+func (ri ResponseItem) TotalAffected() int64 {
+	if ri.RowsUpdated != nil {
+		return *ri.RowsUpdated
+	}
+	var ret int64
+	for _, n := range ri.RowsUpdatedBatch {
+		ret += n
+	}
+	return ret
+}
+
+// Returns the value of a column in the rowIdx-th record of the ResultSet, and whether it's
+// present; it's false if the row is out of range or the column doesn't exist. A NULL value
+// is nil and present.
+func (ri ResponseItem) Value(rowIdx int, col string) (interface{}, bool) {
+	if rowIdx < 0 || rowIdx >= len(ri.ResultSet) {
+		return nil, false
+	}
+	v, ok := ri.ResultSet[rowIdx][col]
+	return v, ok
+}
+
+// An item of a batch, paired with the number of rows it updated; see
+// ResponseItem.BatchResults.
+type BatchItemResult struct {
+	// The values of the item, as given to BatchResults
+	Input map[string]interface{}
+	// Number of rows updated by the item
+	RowsUpdated int64
+}
+
+// Pairs each item of the batch that was sent (i.e. the values given with WithValues or
+// AddBatchInsert, in order) with the number of rows it updated, e.g. to find which rows
+// actually took effect. It's an error if the node isn't a batch, or if the number of
+// inputs doesn't match the number of results.
+func (ri ResponseItem) BatchResults(inputs []map[string]interface{}) ([]BatchItemResult, error) {
+	if ri.RowsUpdatedBatch == nil {
+		return nil, errors.New("the node is not a batch")
+	}
+	if len(inputs) != len(ri.RowsUpdatedBatch) {
+		return nil, fmt.Errorf("%d inputs given, but the batch has %d results", len(inputs), len(ri.RowsUpdatedBatch))
+	}
+	ret := make([]BatchItemResult, len(inputs))
+	for i := range inputs {
+		ret[i] = BatchItemResult{Input: inputs[i], RowsUpdated: ri.RowsUpdatedBatch[i]}
+	}
+	return ret, nil
+}
+
+// Writes the ResultSet as CSV, with a header row. The columns are written in the order
+// given, or (if none is specified) in the sorted order of all the field names. Nulls are
+// written as empty fields, numbers and booleans in their plain form.
+func (ri ResponseItem) WriteCSV(w io.Writer, columns ...string) error {
+	if len(columns) == 0 {
+		set := make(map[string]bool)
+		for _, row := range ri.ResultSet {
+			for k := range row {
+				if !set[k] {
+					set[k] = true
+					columns = append(columns, k)
+				}
+			}
+		}
+		sort.Strings(columns)
+	}
+
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	record := make([]string, len(columns))
+	for _, row := range ri.ResultSet {
+		for i, col := range columns {
+			record[i] = csvField(row[col])
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvField(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		if bs, err := json.Marshal(v); err == nil {
+			return string(bs)
+		}
+		return fmt.Sprint(v)
+	}
+}
+
+// Returns the total number of records returned by all the queries in the Response.
+func (r *Response) TotalRows() int {
+	ret := 0
+	for i := range r.Results {
+		ret += len(r.Results[i].ResultSet)
+	}
+	return ret
+}
+
+// Returns the total number of rows updated by all the statements in the Response,
+// including batches.
+func (r *Response) TotalAffected() int64 {
+	var ret int64
+	for i := range r.Results {
+		ret += r.Results[i].TotalAffected()
+	}
+	return ret
+}
+
+// Returns the records of all the queries in the Response, in order, as a single slice;
+// statements and failed nodes are skipped. The records are not copied.
+func (r *Response) AllRows() []map[string]interface{} {
+	ret := make([]map[string]interface{}, 0, r.TotalRows())
+	for i := range r.Results {
+		ret = append(ret, r.Results[i].ResultSet...)
+	}
+	return ret
+}
+
+// An overview of a Response, e.g. for logging; see Response.Summary.
+type ResponseSummary struct {
+	// Number of nodes that were successful
+	Succeeded int
+	// Number of nodes that failed; with noFail, the transaction can succeed anyway
+	Failed int
+	// Total number of rows updated by the statements, as in Response.TotalAffected
+	RowsAffected int64
+	// Total number of records returned by the queries, as in Response.TotalRows
+	RowsReturned int
+}
+
+// Returns an overview of the Response in one call: how many nodes succeeded or failed
+// (with noFail), and how many rows were affected and returned. A partial success is
+// when both Succeeded and Failed are non-zero.
+func (r *Response) Summary() ResponseSummary {
+	ret := ResponseSummary{
+		RowsAffected: r.TotalAffected(),
+		RowsReturned: r.TotalRows(),
+	}
+	for i := range r.Results {
+		if r.Results[i].Success {
+			ret.Succeeded++
+		} else {
+			ret.Failed++
+		}
+	}
+	return ret
+}
+
+// Returns a deep copy of the Response, that can be modified (or handed to other
+// goroutines) without affecting the original.
+func (r *Response) Clone() *Response {
+	if r == nil {
+		return nil
+	}
+	ret := &Response{}
+	if r.Results != nil {
+		ret.Results = make([]ResponseItem, len(r.Results))
+		for i := range r.Results {
+			ret.Results[i] = r.Results[i].clone()
+		}
+	}
+	return ret
+}
+
+func (ri *ResponseItem) clone() ResponseItem {
+	ret := ResponseItem{
+		Success: ri.Success,
+		Error:   ri.Error,
+	}
+	if ri.RowsUpdated != nil {
+		n := *ri.RowsUpdated
+		ret.RowsUpdated = &n
+	}
+	if ri.LastInsertID != nil {
+		n := *ri.LastInsertID
+		ret.LastInsertID = &n
+	}
+	if ri.RowsUpdatedBatch != nil {
+		ret.RowsUpdatedBatch = append([]int64{}, ri.RowsUpdatedBatch...)
+	}
+	if ri.Columns != nil {
+		ret.Columns = append([]ColumnMeta{}, ri.Columns...)
+	}
+	// the records of OrderedResultSet share the maps of ResultSet; so do the copies
+	copies := make(map[uintptr]map[string]interface{})
+	cloneRow := func(row map[string]interface{}) map[string]interface{} {
+		if row == nil {
+			return nil
+		}
+		ptr := reflect.ValueOf(row).Pointer()
+		if c, ok := copies[ptr]; ok {
+			return c
+		}
+		c := cloneValue(row).(map[string]interface{})
+		copies[ptr] = c
+		return c
+	}
+	if ri.ResultSet != nil {
+		ret.ResultSet = make([]map[string]interface{}, len(ri.ResultSet))
+		for i, row := range ri.ResultSet {
+			ret.ResultSet[i] = cloneRow(row)
+		}
+	}
+	if ri.OrderedResultSet != nil {
+		ret.OrderedResultSet = make([]OrderedRow, len(ri.OrderedResultSet))
+		for i, row := range ri.OrderedResultSet {
+			ret.OrderedResultSet[i] = OrderedRow{
+				keys:   append([]string{}, row.keys...),
+				values: cloneRow(row.values),
+			}
+		}
+	}
+	return ret
+}
+
+// Deep-copies a value decoded from JSON.
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(v))
+		for k, v2 := range v {
+			ret[k] = cloneValue(v2)
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(v))
+		for i, v2 := range v {
+			ret[i] = cloneValue(v2)
+		}
+		return ret
+	case []byte:
+		return append([]byte{}, v...)
+	default:
+		return v
+	}
+}
+
+// Counts the items of a JSON array, scanning for the commas at its top level; it's much
+// cheaper than decoding. Returns 0 if raw is not an array.
+func countArrayItems(raw []byte) int {
+	depth := 0
+	inString := false
+	count := 0
+	empty := true
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
+		if inString {
+			if ch == '\\' {
+				i++
+			} else if ch == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch ch {
+		case '"':
+			inString = true
+			empty = empty && depth != 1
+		case '[', '{':
+			if depth == 1 {
+				empty = false
+			}
+			depth++
+		case ']', '}':
+			depth--
+		case ',':
+			if depth == 1 {
+				count++
+			}
+		case ' ', '\t', '\r', '\n':
+		default:
+			if depth == 1 {
+				empty = false
+			}
+		}
+	}
+	if empty {
+		return 0
+	}
+	return count + 1
+}
+
+// Decodes a result set, i.e. an array of objects, preserving the order of the keys: the
+// columns are returned in the order they appear in the first row (with any other column
+// found in subsequent rows appended).
+//
+// If ordered is true, the rows are also returned as OrderedRows.
+func decodeResultSet(raw json.RawMessage, ordered bool, expectedRows int) ([]map[string]interface{}, []string, []OrderedRow, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if err := expectDelim(dec, '['); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if expectedRows <= 0 {
+		expectedRows = countArrayItems(raw)
+	}
+	rows := make([]map[string]interface{}, 0, expectedRows)
+	var orderedRows []OrderedRow
+	if ordered {
+		orderedRows = make([]OrderedRow, 0, expectedRows)
+	}
+	var columns []string
+	seen := make(map[string]bool)
+	for dec.More() {
+		if err := expectDelim(dec, '{'); err != nil {
+			return nil, nil, nil, err
+		}
+		row := make(map[string]interface{}, len(columns))
+		var keys []string
+		if ordered {
+			keys = make([]string, 0, len(columns))
+		}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			key, ok := tok.(string)
+			if !ok {
+				return nil, nil, nil, fmt.Errorf("unexpected token %v in result set", tok)
+			}
+			var val interface{}
+			if err = dec.Decode(&val); err != nil {
+				return nil, nil, nil, err
+			}
+			row[key] = val
+			if ordered {
+				keys = append(keys, key)
+			}
+			if !seen[key] {
+				seen[key] = true
+				columns = append(columns, key)
+			}
+		}
+		if err := expectDelim(dec, '}'); err != nil {
+			return nil, nil, nil, err
+		}
+		rows = append(rows, row)
+		if ordered {
+			orderedRows = append(orderedRows, OrderedRow{keys: keys, values: row})
+		}
+	}
+	if err := expectDelim(dec, ']'); err != nil {
+		return nil, nil, nil, err
+	}
+	return rows, columns, orderedRows, nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expected %v in result set, found %v", delim, tok)
+	}
+	return nil
+}
+
+// Builds the metadata of the columns, inferring the types from the values.
+func inferColumns(columns []string, rows []map[string]interface{}) []ColumnMeta {
+	ret := make([]ColumnMeta, 0, len(columns))
+	for _, col := range columns {
+		meta := ColumnMeta{Name: col}
+		for _, row := range rows {
+			if v := row[col]; v != nil {
+				meta.DeclaredType = inferType(v)
+				break
+			}
+		}
+		ret = append(ret, meta)
+	}
+	return ret
+}
+
+func inferType(v interface{}) string {
+	switch v := v.(type) {
+	case float64:
+		if v == math.Trunc(v) {
+			return "INTEGER"
+		}
+		return "REAL"
+	case string:
+		return "TEXT"
+	case bool:
+		return "BOOLEAN"
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,209 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Default wait before the first retry
+	DEFAULT_BACKOFF = 100 * time.Millisecond
+	// Default maximum wait between two retries
+	DEFAULT_MAX_BACKOFF = 5 * time.Second
+	// Default maximum wait requested by the server with Retry-After that is honored
+	DEFAULT_MAX_RETRY_AFTER = 30 * time.Second
+)
+
+// Builder method that sets how many times a request is attempted (1 means no retries).
+// Only communication failures, 429 (Too Many Requests) and 5xx errors not caused by a
+// failing query/statement are retried; the wait between attempts starts from the backoff
+// set with WithBackoff, and doubles at each retry. If the server specifies a Retry-After,
+// that wait is used instead, see WithMaxRetryAfter.
+//
+// Beware that retrying a write transaction may apply it twice, if the failure happened
+// after the server processed it.
+func (cb *ClientBuilder) WithRetries(attempts int) *ClientBuilder {
+	cb.attempts = attempts
+	cb.attemptsSet = true
+	return cb
+}
+
+// Builder method that sets the exponential backoff for the retries: the first retry waits
+// for initial, and each subsequent one doubles the wait, up to max.
+func (cb *ClientBuilder) WithBackoff(initial, max time.Duration) *ClientBuilder {
+	cb.backoff = initial
+	cb.maxBackoff = max
+	return cb
+}
+
+// Builder method that caps the wait requested by the server with a Retry-After header
+// (in seconds or as an HTTP date) when retrying; the wait is max if the server asks for
+// more. The default is DEFAULT_MAX_RETRY_AFTER; 0 means that Retry-After is ignored and
+// the normal backoff is used.
+func (cb *ClientBuilder) WithMaxRetryAfter(max time.Duration) *ClientBuilder {
+	cb.maxRetryAfter = max
+	return cb
+}
+
+// Parses the value of a Retry-After header, either a number of seconds or an HTTP date;
+// returns 0 if it's missing or not valid, or if the date is in the past.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// Builder method that bounds the retries by time rather than by count: no retry is
+// performed if the time elapsed since the first attempt, plus the backoff before the next
+// one, would exceed d. If WithRetries is not set, the attempts are not limited otherwise;
+// if it is, both limits apply.
+func (cb *ClientBuilder) WithMaxRetryElapsedTime(d time.Duration) *ClientBuilder {
+	cb.maxRetryElapsed = d
+	return cb
+}
+
+// Builder method that randomizes each wait between retries by up to the given fraction
+// (between 0 and 1) of it, in both directions; e.g. with 0.2, a backoff of 1s becomes a
+// wait between 800ms and 1.2s. This avoids that many clients retry in sync. The
+// exponential growth is computed on the backoff before the jitter.
+func (cb *ClientBuilder) WithBackoffJitter(fraction float64) *ClientBuilder {
+	cb.jitter = fraction
+	return cb
+}
+
+// Builder method that sets the seed of the random source for WithBackoffJitter, for
+// reproducible waits (e.g. in tests). By default, it's seeded with the current time.
+func (cb *ClientBuilder) WithBackoffJitterSeed(seed int64) *ClientBuilder {
+	cb.jitterSeed = &seed
+	return cb
+}
+
+// A random source that can be used concurrently.
+type lockedRand struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{rnd: rand.New(rand.NewSource(seed))}
+}
+
+// Returns a random number in [0.0,1.0).
+func (lr *lockedRand) float64() float64 {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	return lr.rnd.Float64()
+}
+
+// Applies the jitter, if configured, to a backoff.
+func (c *Client) jittered(backoff time.Duration) time.Duration {
+	if c.jitterRand == nil {
+		return backoff
+	}
+	return time.Duration(float64(backoff) * (1 + c.cfg.jitter*(2*c.jitterRand.float64()-1)))
+}
+
+// Sends a request like Send, but attempting it up to the given number of times, regardless
+// of the configuration of the Client. It uses the backoff of the Client (by default,
+// DEFAULT_BACKOFF and DEFAULT_MAX_BACKOFF); the rest of the configuration (e.g. the chunking
+// of the batches, or the cache) applies as for Send.
+func (c *Client) SendWithRetry(req *Request, attempts int) (*Response, int, error) {
+	if attempts < 1 {
+		return nil, 0, errors.New("attempts must be at least 1")
+	}
+	return c.sendWith(context.Background(), req, attempts, nil)
+}
+
+func (c *Client) sendWithRetries(ctx context.Context, req *Request, attempts int) (*Response, int, error) {
+	idempotencyKey := req.idempotencyKey
+	if idempotencyKey == "" && c.cfg.idempotencyKeys {
+		var err error
+		if idempotencyKey, err = newUUID(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	start := time.Now()
+	backoff := c.cfg.backoff
+	for attempt := 1; ; attempt++ {
+		res, code, err := c.sendWithLastInsertIDs(ctx, req, idempotencyKey)
+		if err == nil || attempt >= attempts || !retriable(err) {
+			return res, code, err
+		}
+		wait := c.jittered(backoff)
+		var wserr WsError
+		if c.cfg.maxRetryAfter > 0 && errors.As(err, &wserr) && wserr.RetryAfter > 0 {
+			wait = wserr.RetryAfter
+			if wait > c.cfg.maxRetryAfter {
+				wait = c.cfg.maxRetryAfter
+			}
+		}
+		if c.cfg.maxRetryElapsed > 0 && time.Since(start)+wait > c.cfg.maxRetryElapsed {
+			return res, code, err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, 0, ctx.Err()
+		case <-timer.C:
+		}
+
+		backoff *= 2
+		if backoff > c.cfg.maxBackoff {
+			backoff = c.cfg.maxBackoff
+		}
+	}
+}
+
+// Is it worth to retry after this error?
+func retriable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	// the redirect policy fails in the same way every time
+	if errors.Is(err, ErrRedirectDroppedBody) || errors.Is(err, ErrTooManyRedirects) || errors.Is(err, ErrRedirectToOtherHost) {
+		return false
+	}
+	var wserr WsError
+	if errors.As(err, &wserr) {
+		return wserr.Code == http.StatusTooManyRequests || (wserr.Code >= 500 && wserr.Category != ERROR_CATEGORY_SQL)
+	}
+	var uerr *url.Error
+	return errors.As(err, &uerr)
+}
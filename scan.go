@@ -0,0 +1,250 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// Decodes the ResultSet into dest, that must be a pointer to a slice of structs (or of
+// pointers to structs). Each column is mapped to the field with the same name, or with
+// the name specified in a `ws4:"name"` tag (see TAG_NAME); if there's no exact match,
+// the name is matched case-insensitively. Columns without a matching field are ignored.
+func (ri ResponseItem) Scan(dest interface{}) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Slice {
+		return errors.New("dest must be a non-nil pointer to a slice")
+	}
+	slice := v.Elem()
+	elemType := slice.Type().Elem()
+	structType := elemType
+	if structType.Kind() == reflect.Pointer {
+		structType = structType.Elem()
+	}
+	if structType.Kind() != reflect.Struct {
+		return errors.New("dest must be a pointer to a slice of structs")
+	}
+
+	ret := reflect.MakeSlice(slice.Type(), 0, len(ri.ResultSet))
+	for i := range ri.ResultSet {
+		item := reflect.New(structType)
+		if err := scanRow(ri.ResultSet[i], item.Elem()); err != nil {
+			return fmt.Errorf("in row #%d: %w", i, err)
+		}
+		if elemType.Kind() == reflect.Pointer {
+			ret = reflect.Append(ret, item)
+		} else {
+			ret = reflect.Append(ret, item.Elem())
+		}
+	}
+	slice.Set(ret)
+	return nil
+}
+
+// Returned by ResponseItem.ScanOne and Client.QueryScalar when the result set has no records.
+var ErrNoRows = errors.New("the result set has no records")
+
+// Returned by ResponseItem.ScanOne when the result set has more than one record.
+var ErrTooManyRows = errors.New("the result set has more than one record")
+
+// Decodes the only record of the ResultSet into dest, that must be a pointer to a struct
+// (see Scan for the mapping); e.g. when fetching by primary key. Returns ErrNoRows if there
+// are no records, and ErrTooManyRows if there are more than one; use ScanFirst to accept
+// several records.
+func (ri ResponseItem) ScanOne(dest interface{}) error {
+	return ri.scanSingle(dest, false)
+}
+
+// Like ScanOne, but decodes the first record if there are more than one.
+func (ri ResponseItem) ScanFirst(dest interface{}) error {
+	return ri.scanSingle(dest, true)
+}
+
+func (ri ResponseItem) scanSingle(dest interface{}, allowMore bool) error {
+	v := reflect.ValueOf(dest)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return errors.New("dest must be a non-nil pointer to a struct")
+	}
+	if len(ri.ResultSet) == 0 {
+		return ErrNoRows
+	}
+	if len(ri.ResultSet) > 1 && !allowMore {
+		return ErrTooManyRows
+	}
+	return scanRow(ri.ResultSet[0], v.Elem())
+}
+
+// Decodes a row into a struct value.
+func scanRow(row map[string]interface{}, dest reflect.Value) error {
+	fields := make(map[string][]int)
+	lowerFields := make(map[string][]int)
+	collectFields(dest.Type(), nil, fields, lowerFields)
+
+	for col, val := range row {
+		idx, ok := fields[col]
+		if !ok {
+			if idx, ok = lowerFields[strings.ToLower(col)]; !ok {
+				continue
+			}
+		}
+		if err := assign(dest.FieldByIndex(idx), val); err != nil {
+			return fmt.Errorf("column '%s': %w", col, err)
+		}
+	}
+	return nil
+}
+
+func collectFields(t reflect.Type, prefix []int, fields, lowerFields map[string][]int) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := fieldName(f)
+		if !ok {
+			continue
+		}
+		idx := append(append([]int{}, prefix...), i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && f.Tag.Get(TAG_NAME) == "" {
+			collectFields(f.Type, idx, fields, lowerFields)
+			continue
+		}
+		fields[name] = idx
+		lowerFields[strings.ToLower(name)] = idx
+	}
+}
+
+// Assigns a value decoded from JSON to a field, converting it if needed.
+func assign(field reflect.Value, val interface{}) error {
+	if val == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+	if field.Kind() == reflect.Pointer {
+		ptr := reflect.New(field.Type().Elem())
+		if err := assign(ptr.Elem(), val); err != nil {
+			return err
+		}
+		field.Set(ptr)
+		return nil
+	}
+
+	v := reflect.ValueOf(val)
+	if v.Type().AssignableTo(field.Type()) {
+		field.Set(v)
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		f, ok := val.(float64)
+		if !ok || f != math.Trunc(f) {
+			return fmt.Errorf("cannot convert %v to %s", val, field.Type())
+		}
+		if field.CanInt() {
+			if field.OverflowInt(int64(f)) {
+				return fmt.Errorf("value %v overflows %s", val, field.Type())
+			}
+			field.SetInt(int64(f))
+		} else {
+			if f < 0 || field.OverflowUint(uint64(f)) {
+				return fmt.Errorf("value %v overflows %s", val, field.Type())
+			}
+			field.SetUint(uint64(f))
+		}
+		return nil
+	}
+
+	if v.Type().ConvertibleTo(field.Type()) && v.Kind() == field.Kind() {
+		field.Set(v.Convert(field.Type()))
+		return nil
+	}
+	return fmt.Errorf("cannot convert %v to %s", val, field.Type())
+}
+
+// Runs a query and decodes the records into a slice of T, that must be a struct (see
+// ResponseItem.Scan for the mapping). If the query returns no records, an empty slice
+// is returned. values can be nil.
+func Query[T any](c *Client, ctx context.Context, sql string, values map[string]interface{}) ([]T, error) {
+	ri, err := c.querySingle(ctx, sql, values)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]T, 0)
+	if err = ri.Scan(&ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Runs a query and returns the value of the first column of the first record, e.g. for
+// "SELECT COUNT(*) ...". If the query returns no records, it returns ErrNoRows. Note that
+// ws4sqlite returns the columns sorted by name, so it's meant for single-column queries.
+// values can be nil.
+func (c *Client) QueryScalar(ctx context.Context, sql string, values map[string]interface{}) (interface{}, error) {
+	ri, err := c.querySingle(ctx, sql, values)
+	if err != nil {
+		return nil, err
+	}
+	if len(ri.ResultSet) == 0 {
+		return nil, ErrNoRows
+	}
+	if len(ri.Columns) == 0 {
+		return nil, errors.New("the query returned no columns")
+	}
+	return ri.ResultSet[0][ri.Columns[0].Name], nil
+}
+
+// Like Client.QueryScalar, but converts the value to T, with the same rules of
+// ResponseItem.Scan.
+func QueryScalar[T any](c *Client, ctx context.Context, sql string, values map[string]interface{}) (T, error) {
+	var ret T
+	val, err := c.QueryScalar(ctx, sql, values)
+	if err != nil {
+		return ret, err
+	}
+	if err = assign(reflect.ValueOf(&ret).Elem(), val); err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+// Runs a single query, returning its result.
+func (c *Client) querySingle(ctx context.Context, sql string, values map[string]interface{}) (*ResponseItem, error) {
+	rb := NewRequestBuilder().AddQuery(sql)
+	if values != nil {
+		rb.WithValues(values)
+	}
+	req, err := rb.Build()
+	if err != nil {
+		return nil, err
+	}
+	res, _, err := c.SendWithContext(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Results) != 1 {
+		return nil, fmt.Errorf("expected 1 result, got %d", len(res.Results))
+	}
+	if !res.Results[0].Success {
+		return nil, errors.New(res.Results[0].Error)
+	}
+	return &res.Results[0], nil
+}
@@ -0,0 +1,182 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+)
+
+// Wrapped by the errors of Send when a result set doesn't match the schema given with
+// RequestBuilder.WithResultSchema.
+var ErrSchemaMismatch = errors.New("the result set doesn't match the schema")
+
+// The layouts accepted for the time.Time columns of a schema, after RFC 3339; the second
+// one is what SQLite's datetime() returns.
+var schemaTimeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006-01-02"}
+
+// Sets the expected types of the columns of the current query, so that the values of the
+// ResultSet are converted while parsing the response, instead of being float64, string or
+// bool as decoded from JSON. The kinds are:
+//
+//   - reflect.Int64: an int64, from an integer number (note that JSON numbers lose
+//     precision over 2^53);
+//   - reflect.Float64: a float64, from a number;
+//   - reflect.String: a string;
+//   - reflect.Bool: a bool, from a boolean or from the numbers 0 and 1, as SQLite stores
+//     them;
+//   - reflect.Struct: a time.Time, from a string in RFC 3339 format, or as returned by
+//     SQLite's datetime() or date() (in UTC), or from an integer number of seconds since
+//     the Unix epoch;
+//   - reflect.Slice: a []byte, from a base64 string, as ws4sqlite encodes the BLOBs.
+//
+// NULLs are left as nil, and the columns not in the schema are left untouched; the
+// Columns of the ResponseItem still describe the values as received. If a record lacks
+// a column of the schema, or a value can't be converted, Send fails with an error that
+// wraps ErrSchemaMismatch. Allowed only for queries.
+func (rb *RequestBuilder) WithResultSchema(schema map[string]reflect.Kind) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	if len(schema) == 0 {
+		rb.err = "cannot specify an empty schema"
+		return rb
+	}
+	if rb.temp.Query == "" {
+		rb.err = "cannot specify a result schema for a statement"
+		return rb
+	}
+	rb.temp.schema = make(map[string]reflect.Kind, len(schema))
+	for col, kind := range schema {
+		switch kind {
+		case reflect.Int64, reflect.Float64, reflect.String, reflect.Bool, reflect.Struct, reflect.Slice:
+			rb.temp.schema[col] = kind
+		default:
+			rb.err = fmt.Sprintf("unsupported kind %s for column '%s'", kind, col)
+			return rb
+		}
+	}
+	return rb
+}
+
+// Returns the schemas of the nodes, or nil if no node has one.
+func (req *Request) schemas() []map[string]reflect.Kind {
+	var ret []map[string]reflect.Kind
+	for i := range req.req.Transaction {
+		if schema := req.req.Transaction[i].schema; schema != nil {
+			if ret == nil {
+				ret = make([]map[string]reflect.Kind, len(req.req.Transaction))
+			}
+			ret[i] = schema
+		}
+	}
+	return ret
+}
+
+// Converts the values of the records according to the schema, in place.
+func applySchema(rows []map[string]interface{}, schema map[string]reflect.Kind) error {
+	for i, row := range rows {
+		for col, kind := range schema {
+			val, ok := row[col]
+			if !ok {
+				return fmt.Errorf("%w: in row #%d: missing column '%s'", ErrSchemaMismatch, i, col)
+			}
+			if val == nil {
+				continue
+			}
+			conv, ok := coerce(val, kind)
+			if !ok {
+				return fmt.Errorf("%w: in row #%d: column '%s': cannot convert %#v to %s", ErrSchemaMismatch, i, col, val, schemaTypeName(kind))
+			}
+			row[col] = conv
+		}
+	}
+	return nil
+}
+
+// Converts a value decoded from JSON to the type for the kind, if possible.
+func coerce(val interface{}, kind reflect.Kind) (interface{}, bool) {
+	if n, ok := val.(json.Number); ok {
+		f, err := n.Float64()
+		if err != nil {
+			return nil, false
+		}
+		val = f
+	}
+	switch kind {
+	case reflect.Int64:
+		f, ok := val.(float64)
+		if !ok || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+			return nil, false
+		}
+		return int64(f), true
+	case reflect.Float64:
+		f, ok := val.(float64)
+		return f, ok
+	case reflect.String:
+		s, ok := val.(string)
+		return s, ok
+	case reflect.Bool:
+		switch v := val.(type) {
+		case bool:
+			return v, true
+		case float64:
+			if v == 0 || v == 1 {
+				return v == 1, true
+			}
+		}
+		return nil, false
+	case reflect.Struct:
+		switch v := val.(type) {
+		case string:
+			for _, layout := range schemaTimeLayouts {
+				if t, err := time.Parse(layout, v); err == nil {
+					return t, true
+				}
+			}
+		case float64:
+			if v == math.Trunc(v) {
+				return time.Unix(int64(v), 0).UTC(), true
+			}
+		}
+		return nil, false
+	case reflect.Slice:
+		s, ok := val.(string)
+		if !ok {
+			return nil, false
+		}
+		bs, err := base64.StdEncoding.DecodeString(s)
+		return bs, err == nil
+	}
+	return nil, false
+}
+
+// The name of the Go type for a kind of a schema, for the errors.
+func schemaTypeName(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Struct:
+		return "time.Time"
+	case reflect.Slice:
+		return "[]byte"
+	}
+	return kind.String()
+}
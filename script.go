@@ -0,0 +1,162 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Renders the request as a standalone SQL script, e.g. to review a migration or to debug
+// a failing transaction: a statement per node, wrapped in a transaction as the server
+// does, with the values interpolated as SQL literals. A batch gives a statement per item.
+//
+// THE SCRIPT IS FOR INSPECTION ONLY, don't execute it against a live database: values are
+// escaped, but the server binds them as parameters, and that's the only safe way. Values
+// are rendered as the server receives them, i.e. after a JSON round-trip (booleans become 1
+// and 0); encoders and decoders are not applied. Stored statements are rendered as
+// comments, as their SQL is only known to the server.
+//
+// It's an error if a parameter in the SQL has no value, or if a value is not a scalar.
+func (req *Request) ToSQLScript() (string, error) {
+	var sb strings.Builder
+	sb.WriteString("-- For inspection only: values are interpolated, not bound as parameters.\n")
+	sb.WriteString("BEGIN TRANSACTION;\n")
+	for i := range req.req.Transaction {
+		item := &req.req.Transaction[i]
+		batch := item.ValuesBatch
+		if batch == nil {
+			batch = []map[string]interface{}{item.Values}
+		}
+		for j, values := range batch {
+			sb.WriteString(fmt.Sprintf("-- node #%d", i))
+			if item.ValuesBatch != nil {
+				sb.WriteString(fmt.Sprintf(", batch item #%d", j))
+			}
+			if item.NoFail {
+				sb.WriteString(", noFail")
+			}
+			sb.WriteString("\n")
+
+			sql := item.Query + item.Statement
+			if item.isStored() {
+				bs, err := json.Marshal(values)
+				if err != nil {
+					return "", fmt.Errorf("in request #%d: %w", i, err)
+				}
+				sb.WriteString(fmt.Sprintf("-- stored statement %s, values: %s\n", sql, bs))
+				continue
+			}
+			interpolated, err := interpolateParams(sql, values)
+			if err != nil {
+				return "", fmt.Errorf("in request #%d: %w", i, err)
+			}
+			interpolated = strings.TrimRight(strings.TrimSpace(interpolated), ";")
+			sb.WriteString(interpolated)
+			// a trailing line comment would swallow the semicolon
+			if segs := splitSQL(interpolated); len(segs) > 0 && strings.HasPrefix(segs[len(segs)-1].text, "--") {
+				sb.WriteString("\n")
+			}
+			sb.WriteString(";\n")
+		}
+	}
+	sb.WriteString("COMMIT;\n")
+	return sb.String(), nil
+}
+
+// Replaces the named parameters in the code of the SQL text with the literals of their
+// values.
+func interpolateParams(sql string, values map[string]interface{}) (string, error) {
+	normalized, err := normalizeValues(values)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for _, seg := range splitSQL(sql) {
+		if seg.kind != sqlCode {
+			sb.WriteString(seg.text)
+			continue
+		}
+		text := seg.text
+		for i := 0; i < len(text); i++ {
+			if (text[i] != ':' && text[i] != '@' && text[i] != '$') || (i > 0 && isIdentChar(text[i-1])) {
+				sb.WriteByte(text[i])
+				continue
+			}
+			j := i + 1
+			for j < len(text) && isIdentChar(text[j]) {
+				j++
+			}
+			if j == i+1 {
+				sb.WriteByte(text[i])
+				continue
+			}
+			name := text[i+1 : j]
+			v, ok := lookupParam(normalized, name)
+			if !ok {
+				return "", fmt.Errorf("missing value for parameter '%s'", name)
+			}
+			literal, err := sqlLiteral(v)
+			if err != nil {
+				return "", fmt.Errorf("parameter '%s': %w", name, err)
+			}
+			sb.WriteString(literal)
+			i = j - 1
+		}
+	}
+	return sb.String(), nil
+}
+
+// Converts the values to what the server receives, i.e. marshals and unmarshals them,
+// keeping the numbers as they are written.
+func normalizeValues(values map[string]interface{}) (map[string]interface{}, error) {
+	if len(values) == 0 {
+		return values, nil
+	}
+	bs, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.UseNumber()
+	var ret map[string]interface{}
+	if err = dec.Decode(&ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Renders a value, as decoded from JSON, as an SQL literal.
+func sqlLiteral(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "NULL", nil
+	case bool:
+		if v {
+			return "1", nil
+		}
+		return "0", nil
+	case json.Number:
+		return v.String(), nil
+	case string:
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'", nil
+	default:
+		return "", fmt.Errorf("cannot render a value of type %T as a literal", v)
+	}
+}
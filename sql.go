@@ -0,0 +1,357 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Kind of a segment of SQL text.
+type sqlSegmentKind int
+
+const (
+	sqlCode sqlSegmentKind = iota
+	sqlString
+	sqlQuotedIdentifier
+	sqlComment
+)
+
+// A segment of SQL text, that is homogeneous for the purpose of parsing.
+type sqlSegment struct {
+	kind sqlSegmentKind
+	text string
+}
+
+// Splits SQL text into segments of code, string literals, quoted identifiers and
+// comments, following SQLite's lexical rules. An unterminated segment extends to
+// the end of the text.
+func splitSQL(sql string) []sqlSegment {
+	var ret []sqlSegment
+	start := 0
+	emit := func(kind sqlSegmentKind, end int) {
+		if end > start {
+			ret = append(ret, sqlSegment{kind, sql[start:end]})
+		}
+		start = end
+	}
+	// finds the end of a segment delimited by a quote char, that is escaped by doubling it
+	quoted := func(from int, quote byte) int {
+		for i := from + 1; i < len(sql); i++ {
+			if sql[i] == quote {
+				if i+1 < len(sql) && sql[i+1] == quote {
+					i++
+					continue
+				}
+				return i + 1
+			}
+		}
+		return len(sql)
+	}
+
+	for i := 0; i < len(sql); {
+		switch {
+		case sql[i] == '\'':
+			emit(sqlCode, i)
+			i = quoted(i, '\'')
+			emit(sqlString, i)
+		case sql[i] == '"' || sql[i] == '`':
+			emit(sqlCode, i)
+			i = quoted(i, sql[i])
+			emit(sqlQuotedIdentifier, i)
+		case sql[i] == '[':
+			emit(sqlCode, i)
+			if end := strings.IndexByte(sql[i:], ']'); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(sql)
+			}
+			emit(sqlQuotedIdentifier, i)
+		case strings.HasPrefix(sql[i:], "--"):
+			emit(sqlCode, i)
+			if end := strings.IndexByte(sql[i:], '\n'); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(sql)
+			}
+			emit(sqlComment, i)
+		case strings.HasPrefix(sql[i:], "/*"):
+			emit(sqlCode, i)
+			if end := strings.Index(sql[i+2:], "*/"); end >= 0 {
+				i += end + 4
+			} else {
+				i = len(sql)
+			}
+			emit(sqlComment, i)
+		default:
+			i++
+		}
+	}
+	emit(sqlCode, len(sql))
+	return ret
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
+
+// Prefix of the names of the parameters generated by RequestBuilder.AddStatementPositional.
+const POSITIONAL_PARAM_PREFIX = "p"
+
+// Rewrites each "?" in the code of the SQL text as a named parameter (":p0", ":p1"...),
+// returning the new text and the number of parameters. Question marks in string literals,
+// quoted identifiers and comments are left untouched; numbered parameters ("?1") are not
+// supported.
+func positionalToNamed(sql string) (string, int, error) {
+	var sb strings.Builder
+	n := 0
+	for _, seg := range splitSQL(sql) {
+		if seg.kind != sqlCode {
+			sb.WriteString(seg.text)
+			continue
+		}
+		text := seg.text
+		for i := 0; i < len(text); i++ {
+			if text[i] != '?' {
+				sb.WriteByte(text[i])
+				continue
+			}
+			if i+1 < len(text) && text[i+1] >= '0' && text[i+1] <= '9' {
+				return "", 0, errors.New("numbered parameters (e.g. '?1') are not supported")
+			}
+			sb.WriteString(fmt.Sprintf(":%s%d", POSITIONAL_PARAM_PREFIX, n))
+			n++
+		}
+	}
+	return sb.String(), n, nil
+}
+
+// Quotes an identifier (a table or column name) for SQLite, escaping the double quotes
+// in it, so that it's never interpreted as SQL or as a keyword.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// Can the name be used for a named parameter, as in ":name"?
+func isParamName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if name[i] == '$' || !isIdentChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the names of the named parameters (":name", "@name", "$name") in the SQL
+// text, without the prefix, in order of appearance and without duplicates.
+func sqlParameters(sql string) []string {
+	var ret []string
+	seen := make(map[string]bool)
+	for _, seg := range splitSQL(sql) {
+		if seg.kind != sqlCode {
+			continue
+		}
+		text := seg.text
+		for i := 0; i < len(text); i++ {
+			if text[i] != ':' && text[i] != '@' && text[i] != '$' {
+				continue
+			}
+			if i > 0 && isIdentChar(text[i-1]) {
+				continue
+			}
+			j := i + 1
+			for j < len(text) && isIdentChar(text[j]) {
+				j++
+			}
+			if j > i+1 {
+				name := text[i+1 : j]
+				if !seen[name] {
+					seen[name] = true
+					ret = append(ret, name)
+				}
+			}
+			i = j - 1
+		}
+	}
+	return ret
+}
+
+// Returns the identifiers (words, and quoted identifiers without quotes) in the SQL text,
+// uppercased; also returns whether a "*" (as in SELECT *) is present.
+func sqlIdentifiers(sql string) (map[string]bool, bool) {
+	ret := make(map[string]bool)
+	star := false
+	for _, seg := range splitSQL(sql) {
+		switch seg.kind {
+		case sqlQuotedIdentifier:
+			if len(seg.text) >= 2 {
+				ret[strings.ToUpper(seg.text[1:len(seg.text)-1])] = true
+			}
+		case sqlCode:
+			star = star || strings.Contains(seg.text, "*")
+			for _, word := range strings.FieldsFunc(seg.text, func(r rune) bool { return r < 0x80 && !isIdentChar(byte(r)) }) {
+				ret[strings.ToUpper(word)] = true
+			}
+		}
+	}
+	return ret, star
+}
+
+// Checks that the parameters in the SQL of a node have a value, and that the fields of
+// encoders and decoders are referenced in the SQL.
+func validateParams(item *requestItem) error {
+	sql := item.Query + item.Statement
+	params := sqlParameters(sql)
+
+	rows := item.ValuesBatch
+	if item.Values != nil {
+		rows = []map[string]interface{}{item.Values}
+	}
+	if len(rows) == 0 && len(params) > 0 {
+		return fmt.Errorf("no values specified for parameter '%s'", params[0])
+	}
+	for i, row := range rows {
+		for _, param := range params {
+			if !hasParam(row, param) {
+				if len(rows) > 1 {
+					return fmt.Errorf("parameter '%s' has no value in batch item #%d", param, i)
+				}
+				return fmt.Errorf("parameter '%s' has no value", param)
+			}
+		}
+	}
+
+	if item.Encoder != nil {
+		isParam := make(map[string]bool)
+		for _, param := range params {
+			isParam[param] = true
+		}
+		var unmatched []string
+		for _, field := range item.Encoder.Fields {
+			if !isParam[field] {
+				unmatched = append(unmatched, field)
+			}
+		}
+		if len(unmatched) > 0 {
+			return fmt.Errorf("encoder fields not used as parameters: %s", strings.Join(unmatched, ", "))
+		}
+	}
+
+	if item.Decoder != nil {
+		idents, star := sqlIdentifiers(sql)
+		var unmatched []string
+		for _, field := range item.Decoder.Fields {
+			if !star && !idents[strings.ToUpper(field)] {
+				unmatched = append(unmatched, field)
+			}
+		}
+		if len(unmatched) > 0 {
+			return fmt.Errorf("decoder fields not found in the query: %s", strings.Join(unmatched, ", "))
+		}
+	}
+	return nil
+}
+
+// Is the parameter in the values, with or without prefix?
+func hasParam(values map[string]interface{}, param string) bool {
+	_, ok := lookupParam(values, param)
+	return ok
+}
+
+// Returns the value of the parameter, that can be in the values with or without prefix.
+func lookupParam(values map[string]interface{}, param string) (interface{}, bool) {
+	for _, prefix := range []string{"", ":", "@", "$"} {
+		if v, ok := values[prefix+param]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// Checks that the SQL text is a single statement without comments: a semicolon in code
+// is only allowed at the end. Semicolons and comment markers in string literals and quoted
+// identifiers are fine.
+func checkSingleStatement(sql string) error {
+	segments := splitSQL(sql)
+	for i, seg := range segments {
+		switch seg.kind {
+		case sqlComment:
+			return fmt.Errorf("comments are not allowed: '%s'", strings.TrimSpace(seg.text))
+		case sqlCode:
+			semi := strings.IndexByte(seg.text, ';')
+			if semi < 0 {
+				continue
+			}
+			if strings.Trim(seg.text[semi+1:], "; \t\r\n") != "" || i < len(segments)-1 {
+				return fmt.Errorf("multiple statements are not allowed")
+			}
+		}
+	}
+	return nil
+}
+
+// Expands a named parameter that stands for a list, e.g. in "WHERE ID IN (:ids)", as
+// named parameters don't bind slices: each occurrence of the placeholder (":ids", or
+// just "ids") is rewritten as ":ids0, :ids1, ...", and the returned map has a value for
+// each of them, to add to the values of the query. Occurrences in string literals,
+// quoted identifiers and comments are left untouched.
+//
+// If values is empty, the placeholder is removed, giving "IN ()": SQLite accepts it, as
+// an empty set.
+func ExpandIn(sql string, placeholder string, values []interface{}) (string, map[string]interface{}) {
+	prefix := byte(':')
+	if placeholder != "" && (placeholder[0] == ':' || placeholder[0] == '@' || placeholder[0] == '$') {
+		prefix = placeholder[0]
+		placeholder = placeholder[1:]
+	}
+
+	named := make(map[string]interface{}, len(values))
+	expanded := make([]string, len(values))
+	for i, v := range values {
+		name := fmt.Sprintf("%s%d", placeholder, i)
+		named[name] = v
+		expanded[i] = string(prefix) + name
+	}
+	replacement := strings.Join(expanded, ", ")
+	if placeholder == "" {
+		return sql, named
+	}
+
+	var sb strings.Builder
+	for _, seg := range splitSQL(sql) {
+		if seg.kind != sqlCode {
+			sb.WriteString(seg.text)
+			continue
+		}
+		text := seg.text
+		for i := 0; i < len(text); i++ {
+			end := i + 1 + len(placeholder)
+			if text[i] == prefix && (i == 0 || !isIdentChar(text[i-1])) && strings.HasPrefix(text[i+1:], placeholder) &&
+				(end == len(text) || !isIdentChar(text[end])) {
+				sb.WriteString(replacement)
+				i = end - 1
+				continue
+			}
+			sb.WriteByte(text[i])
+		}
+	}
+	return sb.String(), named
+}
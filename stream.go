@@ -0,0 +1,100 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"context"
+	"errors"
+)
+
+// Result of sending a chunk of rows with Client.StreamInsert.
+type BatchResult struct {
+	// Index of the first row of the chunk, counting from the first row read
+	Offset int
+	// Number of rows of the chunk
+	Rows int
+	// Number of updated rows for each row of the chunk; nil if the chunk failed
+	RowsUpdated []int64
+	// Reason for the failure of the chunk, that was not applied; nil if successful
+	Err error
+}
+
+// Reads rows from a channel and inserts them with statement, in chunks of chunkSize rows;
+// each chunk is sent as a batch, in its own transaction, when it's full or when rows is
+// closed. A result per chunk is emitted, in order, on the returned channel, that is
+// closed after the last chunk or when ctx is done.
+//
+// Chunks are sent one at a time, and the next rows are read only after the result was
+// received, so that a slow server or consumer slows down the producer. A failed chunk
+// doesn't stop the stream. The caller must receive all the results or cancel ctx, and
+// should close rows when done: the goroutine that reads rows and sends the chunks ends when
+// either rows is closed and drained or ctx is done, also if a chunk is in flight.
+func (c *Client) StreamInsert(ctx context.Context, statement string, rows <-chan map[string]interface{}, chunkSize int) (<-chan BatchResult, error) {
+	if statement == "" {
+		return nil, errors.New("cannot specify an empty statement")
+	}
+	if rows == nil {
+		return nil, errors.New("cannot specify a nil channel")
+	}
+	if chunkSize < 1 {
+		return nil, errors.New("chunkSize must be at least 1")
+	}
+
+	results := make(chan BatchResult)
+	go func() {
+		defer close(results)
+		offset := 0
+		chunk := make([]map[string]interface{}, 0, chunkSize)
+		flush := func() bool {
+			res := BatchResult{Offset: offset, Rows: len(chunk)}
+			req, err := NewRequestBuilder().AddBatchInsert(statement, chunk).Build()
+			if err == nil {
+				var resp *Response
+				if resp, _, err = c.SendWithContext(ctx, req); err == nil && len(resp.Results) > 0 {
+					res.RowsUpdated = resp.Results[0].RowsUpdatedBatch
+				}
+			}
+			res.Err = err
+			offset += len(chunk)
+			chunk = chunk[:0]
+			select {
+			case results <- res:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case row, ok := <-rows:
+				if !ok {
+					if len(chunk) > 0 {
+						flush()
+					}
+					return
+				}
+				chunk = append(chunk, row)
+				if len(chunk) == chunkSize && !flush() {
+					return
+				}
+			}
+		}
+	}()
+	return results, nil
+}
@@ -0,0 +1,96 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"context"
+	"errors"
+)
+
+// Returned when using a Tx that was already committed or rolled back.
+var ErrTxDone = errors.New("the transaction was already committed or rolled back")
+
+// A transaction, in the style of database/sql: the queries and statements are
+// accumulated, and sent as a single (atomic) request at Commit. Built with Client.Begin;
+// not thread safe.
+//
+// Example:
+//
+//	tx := cli.Begin()
+//	tx.Exec("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)", map[string]interface{}{"id": 1, "val": "a"})
+//	idx := tx.Query("SELECT * FROM TEMP", nil)
+//	res, err := tx.Commit(ctx)
+//	// res.Results[idx] is the result of the query
+type Tx struct {
+	client *Client
+	rb     *RequestBuilder
+	nodes  int
+	done   bool
+}
+
+// Starts a transaction. Nothing is sent until Commit.
+func (c *Client) Begin() *Tx {
+	return &Tx{client: c, rb: NewRequestBuilder()}
+}
+
+// Adds a statement to the transaction; values can be nil, or anything accepted by
+// RequestBuilder.WithValues. Returns the index of its result in the Response of Commit.
+// Errors are reported by Commit.
+func (tx *Tx) Exec(sql string, values interface{}) int {
+	tx.rb.AddStatement(sql)
+	return tx.add(values)
+}
+
+// Adds a query to the transaction; values can be nil, or anything accepted by
+// RequestBuilder.WithValues. Returns the index of its result in the Response of Commit.
+// Errors are reported by Commit.
+func (tx *Tx) Query(sql string, values interface{}) int {
+	tx.rb.AddQuery(sql)
+	return tx.add(values)
+}
+
+func (tx *Tx) add(values interface{}) int {
+	if values != nil {
+		tx.rb.WithValues(values)
+	}
+	tx.nodes++
+	return tx.nodes - 1
+}
+
+// Sends all the queries and statements in a single request, that is executed atomically
+// by the server; if one fails, none is applied and the error is returned. The Tx can't be
+// used afterwards.
+func (tx *Tx) Commit(ctx context.Context) (*Response, error) {
+	if tx.done {
+		return nil, ErrTxDone
+	}
+	tx.done = true
+	req, err := tx.rb.Build()
+	if err != nil {
+		return nil, err
+	}
+	res, _, err := tx.client.SendWithContext(ctx, req)
+	return res, err
+}
+
+// Discards the queries and statements; nothing is sent to the server. The Tx can't be
+// used afterwards. It's a no-op if the Tx was already committed or rolled back, so it
+// can be deferred.
+func (tx *Tx) Rollback() {
+	tx.done = true
+	tx.rb = NewRequestBuilder()
+}
@@ -0,0 +1,217 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4sqlite_client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Name of the struct tag that specifies the name of the parameter (or column) that
+// a field maps to. "-" means that the field is ignored. If not specified, the field
+// name is used.
+const TAG_NAME = "ws4"
+
+// Type of Null.
+type nullValue struct{}
+
+func (nullValue) MarshalJSON() ([]byte, error) {
+	return []byte("null"), nil
+}
+
+// A value that is always sent as SQL NULL. A nil value, also a typed one (e.g. a nil *int),
+// is sent as NULL as well; Null makes the intent explicit.
+var Null = nullValue{}
+
+// Converts a map with string keys, or a struct (or a pointer to it) to a values map.
+// The fields of a struct are mapped according to the TAG_NAME tag; embedded structs
+// are flattened.
+func toValues(values interface{}) (map[string]interface{}, error) {
+	if m, ok := values.(map[string]interface{}); ok {
+		return m, nil
+	}
+
+	v := reflect.ValueOf(values)
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil, errors.New("cannot specify a nil argument")
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, errors.New("values must be a map with string keys or a struct")
+		}
+		if v.IsNil() {
+			return nil, errors.New("cannot specify a nil argument")
+		}
+		ret := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			ret[iter.Key().String()] = iter.Value().Interface()
+		}
+		return ret, nil
+	case reflect.Struct:
+		ret := make(map[string]interface{})
+		structToValues(v, ret)
+		return ret, nil
+	default:
+		return nil, errors.New("values must be a map with string keys or a struct")
+	}
+}
+
+func structToValues(v reflect.Value, ret map[string]interface{}) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, ok := fieldName(f)
+		if !ok {
+			continue
+		}
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && f.Tag.Get(TAG_NAME) == "" {
+			structToValues(v.Field(i), ret)
+			continue
+		}
+		ret[name] = v.Field(i).Interface()
+	}
+}
+
+// Adds the items of rows, that must be a non-empty slice of structs (or of pointers to
+// them), as a batch of values for the current statement; each struct is mapped as in
+// RequestBuilder.WithValues. It always creates a batch, also for a single item, and values
+// already present are kept as the first items of the batch.
+func WithStructBatch(rb *RequestBuilder, rows interface{}) *RequestBuilder {
+	if rb.err != "" {
+		return rb
+	}
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Slice || !isStructType(v.Type().Elem()) {
+		rb.err = "rows must be a slice of structs"
+		return rb
+	}
+	if v.Len() == 0 {
+		rb.err = "cannot specify an empty batch"
+		return rb
+	}
+	if rb.temp == nil {
+		rb.err = "no statement to add the batch to"
+		return rb
+	}
+	if rb.temp.Query != "" {
+		rb.err = "cannot specify a batch for a query"
+		return rb
+	}
+	batch := make([]map[string]interface{}, 0, len(rb.temp.ValuesBatch)+v.Len()+1)
+	batch = append(batch, rb.temp.ValuesBatch...)
+	if rb.temp.Values != nil {
+		batch = append(batch, rb.temp.Values)
+	}
+	for i := 0; i < v.Len(); i++ {
+		item := v.Index(i)
+		if item.Kind() == reflect.Pointer {
+			if item.IsNil() {
+				rb.err = fmt.Sprintf("batch item #%d is nil", i)
+				return rb
+			}
+			item = item.Elem()
+		}
+		values := make(map[string]interface{})
+		structToValues(item, values)
+		batch = append(batch, values)
+	}
+	rb.temp.Values = nil
+	rb.temp.ValuesBatch = batch
+	return rb
+}
+
+func isStructType(t reflect.Type) bool {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// Returns the parameter/column name of a struct field, and whether it's mapped at all.
+func fieldName(f reflect.StructField) (string, bool) {
+	if !f.IsExported() {
+		return "", false
+	}
+	tag := f.Tag.Get(TAG_NAME)
+	if tag == "-" {
+		return "", false
+	}
+	if name, _, _ := strings.Cut(tag, ","); name != "" {
+		return name, true
+	}
+	return f.Name, true
+}
+
+// Builder method that sets a function that gives values to add to every node of the
+// requests, at send time; e.g. to bind a tenant id that is carried by the context. The
+// values are added to the values of each node, and to each item of a batch; the values
+// set in the request take precedence, so keys that are already there are not overridden.
+// Nodes without values receive them too. The Request is not modified.
+func (cb *ClientBuilder) WithContextValues(fn func(ctx context.Context) map[string]interface{}) *ClientBuilder {
+	cb.contextValues = fn
+	return cb
+}
+
+// Returns a copy of the request, with the given values added to each node where the
+// key is not already present.
+func withDefaultValues(req *Request, defaults map[string]interface{}) *Request {
+	if len(defaults) == 0 {
+		return req
+	}
+	ret := *req
+	ret.req.Transaction = mergeDefaultValues(req.req.Transaction, defaults)
+	return &ret
+}
+
+// Returns a copy of the items, where the values of each item (and of each item of its
+// batch) are merged with the defaults; the values of the items take precedence.
+func mergeDefaultValues(items []requestItem, defaults map[string]interface{}) []requestItem {
+	merge := func(values map[string]interface{}) map[string]interface{} {
+		ret := make(map[string]interface{}, len(values)+len(defaults))
+		for k, v := range defaults {
+			ret[k] = v
+		}
+		for k, v := range values {
+			ret[k] = v
+		}
+		return ret
+	}
+
+	ret := make([]requestItem, len(items))
+	for i, item := range items {
+		if item.ValuesBatch != nil {
+			batch := make([]map[string]interface{}, len(item.ValuesBatch))
+			for i2 := range item.ValuesBatch {
+				batch[i2] = merge(item.ValuesBatch[i2])
+			}
+			item.ValuesBatch = batch
+		} else {
+			item.Values = merge(item.Values)
+		}
+		ret[i] = item
+	}
+	return ret
+}
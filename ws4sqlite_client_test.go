@@ -17,10 +17,26 @@
 package ws4sqlite_client_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
 	"os"
 	"os/exec"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -35,6 +51,36 @@ func kill(cmd *exec.Cmd) {
 	}
 }
 
+// Starts a fake ws4sqlite that records the body of the last request and answers
+// with the given response body.
+func captureServer(t *testing.T, respBody string, body *[]byte) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		*body = b
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, respBody)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Returns the body that is sent to the server for the given request.
+func sentBody(t *testing.T, request *ws4.Request) []byte {
+	var body []byte
+	srv := captureServer(t, `{"results":[]}`, &body)
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
 func TestMain(m *testing.M) {
 	// the ws4sqlite binary in the test/ folder is for Linux/amd64; make sure it's executable (chmod +x test/ws4sqlite-0.12.2)
 	cmd := exec.Command("test/ws4sqlite-0.12.2", "--mem-db", "mydb:test/mydb.yaml", "--mem-db", "mydb2:test/mydb2.yaml")
@@ -283,3 +329,5455 @@ func TestCancel(t *testing.T) {
 		t.Error("err is not a Context Cancelled")
 	}
 }
+
+type color int
+
+func (c color) String() string {
+	return [...]string{"red", "green"}[c]
+}
+
+func TestValueEncoder(t *testing.T) {
+	var body []byte
+	srv := captureServer(t, `{"results":[{"success":true,"rowsUpdatedBatch":[1,1]}]}`, &body)
+
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().
+		WithValueEncoder(func(v interface{}) (interface{}, bool) {
+			if s, ok := v.(fmt.Stringer); ok {
+				return s.String(), true
+			}
+			return nil, false
+		}).
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 1, "val": color(0)}).
+		WithValues(map[string]interface{}{"id": 2, "val": color(1)}).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+
+	var sent struct {
+		Transaction []struct {
+			ValuesBatch []map[string]interface{} `json:"valuesBatch"`
+		} `json:"transaction"`
+	}
+	if err = json.Unmarshal(body, &sent); err != nil {
+		t.Error(err)
+	}
+	if sent.Transaction[0].ValuesBatch[0]["val"] != "red" {
+		t.Error("ValuesBatch[0][\"val\"] != \"red\"")
+	}
+	if sent.Transaction[0].ValuesBatch[1]["val"] != "green" {
+		t.Error("ValuesBatch[1][\"val\"] != \"green\"")
+	}
+	if sent.Transaction[0].ValuesBatch[1]["id"] != float64(2) {
+		t.Error("ValuesBatch[1][\"id\"] != 2")
+	}
+}
+
+func TestAffectedRows(t *testing.T) {
+	three := int64(3)
+	single := ws4.ResponseItem{Success: true, RowsUpdated: &three}
+	if n, ok := single.AffectedRows(); !ok || n != 3 {
+		t.Error("single.AffectedRows() != 3, true")
+	}
+	if single.TotalAffected() != 3 {
+		t.Error("single.TotalAffected() != 3")
+	}
+
+	batch := ws4.ResponseItem{Success: true, RowsUpdatedBatch: []int64{1, 0, 2}}
+	if _, ok := batch.AffectedRows(); ok {
+		t.Error("batch.AffectedRows() is present")
+	}
+	if batch.TotalAffected() != 3 {
+		t.Error("batch.TotalAffected() != 3")
+	}
+
+	query := ws4.ResponseItem{Success: true, ResultSet: []map[string]interface{}{{"ID": 1}}}
+	if n, ok := query.AffectedRows(); ok || n != 0 {
+		t.Error("query.AffectedRows() != 0, false")
+	}
+	if query.TotalAffected() != 0 {
+		t.Error("query.TotalAffected() != 0")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	var body []byte
+	srv := captureServer(t, `{"results":[{"success":true,"resultSet":[]}]}`, &body)
+
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().
+		WithReadOnly().
+		AddQuery("SELECT * FROM TEMP").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+
+	var sent map[string]interface{}
+	if err = json.Unmarshal(body, &sent); err != nil {
+		t.Error(err)
+	}
+	if sent["readOnly"] != true {
+		t.Error("readOnly is not true")
+	}
+
+	_, err = ws4.NewRequestBuilder().
+		WithReadOnly().
+		AddQuery("SELECT * FROM TEMP").
+		AddStatement("DELETE FROM TEMP").
+		Build()
+	if err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	ri := ws4.ResponseItem{
+		Success: true,
+		ResultSet: []map[string]interface{}{
+			{"ID": float64(1), "VAL": "ONE", "OK": true},
+			{"ID": float64(2.5), "VAL": "a, \"quoted\" one", "OK": false},
+			{"ID": float64(3), "VAL": nil, "OK": nil},
+		},
+	}
+
+	var sb strings.Builder
+	if err := ri.WriteCSV(&sb); err != nil {
+		t.Error(err)
+	}
+	expected := "ID,OK,VAL\n1,true,ONE\n2.5,false,\"a, \"\"quoted\"\" one\"\n3,,\n"
+	if sb.String() != expected {
+		t.Errorf("unexpected CSV: %q", sb.String())
+	}
+
+	sb.Reset()
+	if err := ri.WriteCSV(&sb, "VAL", "ID"); err != nil {
+		t.Error(err)
+	}
+	expected = "VAL,ID\nONE,1\n\"a, \"\"quoted\"\" one\",2.5\n,3\n"
+	if sb.String() != expected {
+		t.Errorf("unexpected CSV: %q", sb.String())
+	}
+}
+
+func TestTransportSettings(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURL("http://localhost:12321/mydb").
+		WithMaxIdleConns(7).
+		WithIdleConnTimeout(42 * time.Second).
+		WithMaxConnsPerHost(3).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	transport, ok := client.HTTPClient().Transport.(*http.Transport)
+	if !ok {
+		t.Fatal("transport is not an *http.Transport")
+	}
+	if transport.MaxIdleConns != 7 {
+		t.Error("MaxIdleConns != 7")
+	}
+	if transport.IdleConnTimeout != 42*time.Second {
+		t.Error("IdleConnTimeout != 42s")
+	}
+	if transport.MaxConnsPerHost != 3 {
+		t.Error("MaxConnsPerHost != 3")
+	}
+
+	custom := &http.Client{}
+	client, err = ws4.NewClientBuilder().
+		WithURL("http://localhost:12321/mydb").
+		WithHTTPClient(custom).
+		WithMaxIdleConns(7).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+	if client.HTTPClient() != custom {
+		t.Error("custom http.Client was not used")
+	}
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	var body []byte
+	other := captureServer(t, `{"results":[{"success":true,"resultSet":[]}]}`, &body)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/same", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/target", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/other", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL, http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/target", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	send := func(policy ws4.RedirectPolicy, path string) (int, error) {
+		client, err := ws4.NewClientBuilder().
+			WithURL(srv.URL + path).
+			WithRedirectPolicy(policy).
+			Build()
+		if err != nil {
+			t.Error(err)
+		}
+		_, code, err := client.Send(request)
+		return code, err
+	}
+
+	if _, err := send(ws4.REDIRECT_POLICY_DEFAULT, "/other"); err != nil {
+		t.Error(err)
+	}
+
+	code, err := send(ws4.REDIRECT_POLICY_NEVER, "/same")
+	if code != http.StatusTemporaryRedirect {
+		t.Error("code is not 307")
+	}
+	if _, ok := err.(ws4.WsError); !ok {
+		t.Error("err is not a WsError")
+	}
+
+	if _, err := send(ws4.REDIRECT_POLICY_SAME_HOST, "/same"); err != nil {
+		t.Error(err)
+	}
+	if _, err := send(ws4.REDIRECT_POLICY_SAME_HOST, "/other"); err == nil {
+		t.Error("did not fail, but should have")
+	}
+
+	if _, err := ws4.NewClientBuilder().WithURL(srv.URL).WithRedirectPolicy("WHATEVER").Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestErrorCategory(t *testing.T) {
+	request, err := ws4.NewRequestBuilder().AddQuery("SELENCT * FROM TEMP").Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	categoryOf := func(cb *ws4.ClientBuilder) ws4.WsError {
+		client, err := cb.Build()
+		if err != nil {
+			t.Error(err)
+		}
+		_, _, err = client.Send(request)
+		wserr, ok := err.(ws4.WsError)
+		if !ok {
+			t.Error("err is not a WsError")
+		}
+		return wserr
+	}
+
+	wserr := categoryOf(ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword"))
+	if wserr.Category != ws4.ERROR_CATEGORY_SQL || !wserr.IsSQL() {
+		t.Error("error is not SQL")
+	}
+
+	wserr = categoryOf(ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "wrongPassword"))
+	if !wserr.IsAuth() {
+		t.Error("error is not AUTH")
+	}
+
+	wserr = categoryOf(ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "nope"))
+	if !wserr.IsNotFound() {
+		t.Error("error is not NOT_FOUND")
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"reqIdx":-1,"error":"missing statements list ('transaction' node)"}`)
+	}))
+	defer srv.Close()
+
+	wserr = categoryOf(ws4.NewClientBuilder().WithURL(srv.URL))
+	if !wserr.IsMalformed() {
+		t.Error("error is not MALFORMED")
+	}
+}
+
+func TestContentType(t *testing.T) {
+	var contentType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	defer srv.Close()
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).Build()
+	if err != nil {
+		t.Error(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+	if contentType != "application/json" {
+		t.Error("Content-Type is not application/json")
+	}
+
+	client, err = ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithContentType("application/vnd.ws4sqlite+json").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+	if contentType != "application/vnd.ws4sqlite+json" {
+		t.Error("Content-Type is not application/vnd.ws4sqlite+json")
+	}
+
+	if _, err = ws4.NewClientBuilder().WithURL(srv.URL).WithContentType("").Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestURLComponentsEscaping(t *testing.T) {
+	var uri string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uri = r.RequestURI
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	defer srv.Close()
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	host, port := srv.Listener.Addr().(*net.TCPAddr).IP.String(), srv.Listener.Addr().(*net.TCPAddr).Port
+
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, host, port, "my db/2").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+	if uri != "/my%20db%2F2" {
+		t.Errorf("unexpected URI: %s", uri)
+	}
+
+	client, err = ws4.NewClientBuilder().
+		WithURLComponentsNoPort(ws4.PROTOCOL_HTTP, fmt.Sprintf("%s:%d", host, port), "a?b").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+	if uri != "/a%3Fb" {
+		t.Errorf("unexpected URI: %s", uri)
+	}
+
+	for _, badHost := range []string{"", "local host", "host/path", "user@host"} {
+		if _, err = ws4.NewClientBuilder().WithURLComponents(ws4.PROTOCOL_HTTP, badHost, 80, "db").Build(); err == nil {
+			t.Errorf("host %q did not fail, but should have", badHost)
+		}
+	}
+}
+
+// Starts a fake ws4sqlite that fails with a 503 for the given number of calls,
+// then succeeds. The number of calls received is counted in calls.
+func flakyServer(t *testing.T, failures int, calls *int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(atomic.AddInt32(calls, 1)) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "Service Unavailable")
+			return
+		}
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// SendWithRetry goes through the same path as Send: chunking, context values and cache.
+func TestSendWithRetryConfiguration(t *testing.T) {
+	var calls int32
+	var bodies [][]byte
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, b)
+		mu.Unlock()
+		var req struct {
+			Transaction []struct {
+				Query       string
+				ValuesBatch []map[string]interface{}
+			}
+		}
+		json.Unmarshal(b, &req)
+		if req.Transaction[0].Query != "" {
+			io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+			return
+		}
+		counts := strings.TrimSuffix(strings.Repeat("1,", len(req.Transaction[0].ValuesBatch)), ",")
+		io.WriteString(w, `{"results":[{"success":true,"rowsUpdatedBatch":[`+counts+`]}]}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithBatchChunkSize(2).
+		WithResponseCache(time.Minute, 10).
+		WithContextValues(func(ctx context.Context) map[string]interface{} {
+			return map[string]interface{}{"tenant": "t1"}
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := ws4.NewRequestBuilder().
+		AddBatchInsert("INSERT INTO TEMP (ID) VALUES (:id)", []map[string]interface{}{{"id": 1}, {"id": 2}, {"id": 3}, {"id": 4}}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.SendWithRetry(batch, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&calls) != 2 || len(res.Results[0].RowsUpdatedBatch) != 4 {
+		t.Errorf("unexpected calls or results: %d %v", calls, res.Results[0].RowsUpdatedBatch)
+	}
+	if !bytes.Contains(bodies[0], []byte(`"tenant":"t1"`)) {
+		t.Errorf("unexpected body: %s", bodies[0])
+	}
+
+	query, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err = client.SendWithRetry(query, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if atomic.LoadInt32(&calls) != 3 {
+		t.Errorf("unexpected calls: %d", calls)
+	}
+}
+
+func TestSendWithRetry(t *testing.T) {
+	var calls int32
+	srv := flakyServer(t, 2, &calls)
+
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithBackoff(time.Millisecond, 10*time.Millisecond).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, code, err := client.SendWithRetry(request, 2)
+	if err == nil {
+		t.Error("did not fail, but should have")
+	}
+	if code != http.StatusServiceUnavailable {
+		t.Error("code is not 503")
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	_, code, err = client.SendWithRetry(request, 3)
+	if err != nil {
+		t.Error(err)
+	}
+	if code != 200 {
+		t.Error("return code is not 200")
+	}
+	if atomic.LoadInt32(&calls) != 3 {
+		t.Error("calls != 3")
+	}
+
+	// SQL errors are not retried
+	client, err = ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb2").
+		WithInlineAuth("myUser1", "myHotPassword").
+		WithRetries(3).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+	request, err = ws4.NewRequestBuilder().AddQuery("SELENCT * FROM TEMP").Build()
+	if err != nil {
+		t.Error(err)
+	}
+	start := time.Now()
+	if _, _, err = client.SendWithRetry(request, 3); err == nil {
+		t.Error("did not fail, but should have")
+	}
+	if time.Since(start) >= ws4.DEFAULT_BACKOFF {
+		t.Error("SQL error was retried")
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	var keys []string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if len(keys)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, `{"results":[{"success":true,"rowsUpdated":1}]}`)
+	}))
+	defer srv.Close()
+
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithRetries(3).
+		WithBackoff(time.Millisecond, time.Millisecond).
+		WithIdempotencyKeys().
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().AddStatement("DELETE FROM TEMP").Build()
+	if err != nil {
+		t.Error(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+
+	if len(keys) != 6 {
+		t.Fatal("len(keys) != 6")
+	}
+	if keys[0] == "" || keys[0] != keys[1] || keys[1] != keys[2] {
+		t.Error("key is not stable across retries")
+	}
+	if keys[3] == keys[0] {
+		t.Error("key is the same for different sends")
+	}
+
+	keys = nil
+	request, err = ws4.NewRequestBuilder().
+		AddStatement("DELETE FROM TEMP").
+		WithIdempotencyKey("my-key").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+	for _, key := range keys {
+		if key != "my-key" {
+			t.Errorf("unexpected key: %s", key)
+		}
+	}
+}
+
+func TestResponseTotals(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb2").
+		WithInlineAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT * FROM TEMP WHERE ID IN (1, 4)").
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 100, "val": "x"}).
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 101, "val": "y"}).
+		WithValues(map[string]interface{}{"id": 102, "val": "z"}).
+		AddQuery("SELECT * FROM TEMP WHERE ID >= 100").
+		AddStatement("DELETE FROM TEMP WHERE ID >= 100").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.TotalRows() != 5 {
+		t.Error("res.TotalRows() != 5")
+	}
+	if res.TotalAffected() != 6 {
+		t.Error("res.TotalAffected() != 6")
+	}
+}
+
+func TestStrictBatch(t *testing.T) {
+	_, err := ws4.NewRequestBuilder().
+		WithStrictBatch().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 2, "val": "b"}).
+		WithValues(map[string]interface{}{"id": 3, "val": "c"}).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = ws4.NewRequestBuilder().
+		WithStrictBatch().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 2, "val": "b"}).
+		WithValues(map[string]interface{}{"id": 3, "vla": "c"}).
+		Build()
+	if err == nil {
+		t.Error("did not fail, but should have")
+	}
+
+	_, err = ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 2, "val": "b"}).
+		WithValues(map[string]interface{}{"id": 3, "vla": "c"}).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMaxRequestBytes(t *testing.T) {
+	var calls int32
+	srv := flakyServer(t, 0, &calls)
+
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithMaxRequestBytes(1024).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	rb := ws4.NewRequestBuilder().AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)")
+	for i := 0; i < 100; i++ {
+		rb.WithValues(map[string]interface{}{"id": i, "val": "some value"})
+	}
+	request, err := rb.Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, _, err = client.Send(request)
+	var rtlerr ws4.RequestTooLargeError
+	if !errors.As(err, &rtlerr) {
+		t.Fatal("err is not a RequestTooLargeError")
+	}
+	if rtlerr.Limit != 1024 || rtlerr.Size <= 1024 {
+		t.Errorf("unexpected error: %s", rtlerr.Error())
+	}
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Error("request was sent")
+	}
+
+	request, err = ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Error(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRequestFromPairs(t *testing.T) {
+	request, err := ws4.NewRequestFromPairs([]ws4.SQLPair{
+		{SQL: "SELECT * FROM TEMP", IsQuery: true},
+		{SQL: "SELECT * FROM TEMP WHERE ID = :id", IsQuery: true, Values: map[string]interface{}{"id": 1}},
+		{SQL: "INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)", NoFail: true, Values: map[string]interface{}{"id": 1, "val": "a"}},
+		{SQL: "INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)", ValuesBatch: []map[string]interface{}{
+			{"id": 2, "val": "b"},
+			{"id": 3, "val": "c"},
+		}},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	expected, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT * FROM TEMP").
+		AddQuery("SELECT * FROM TEMP WHERE ID = :id").
+		WithValues(map[string]interface{}{"id": 1}).
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithNoFail().
+		WithValues(map[string]interface{}{"id": 1, "val": "a"}).
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 2, "val": "b"}).
+		WithValues(map[string]interface{}{"id": 3, "val": "c"}).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(sentBody(t, request)) != string(sentBody(t, expected)) {
+		t.Error("request differs from the one built with RequestBuilder")
+	}
+
+	_, err = ws4.NewRequestFromPairs([]ws4.SQLPair{
+		{SQL: "SELECT * FROM TEMP WHERE ID = :id", IsQuery: true, ValuesBatch: []map[string]interface{}{
+			{"id": 2},
+			{"id": 3},
+		}},
+	})
+	if err == nil {
+		t.Error("did not fail, but should have")
+	}
+
+	if _, err = ws4.NewRequestFromPairs(nil); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestServerProfile(t *testing.T) {
+	var body []byte
+	srv := captureServer(t, `{"results":[{"success":true,"rowsUpdatedBatch":[1,1]},{"success":true,"rows":[{"batch":1}]}]}`, &body)
+
+	profile := ws4.NewServerProfile("custom", map[string]string{"valuesBatch": "batch", "resultSet": "rows"})
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithServerProfile(profile).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :valuesBatch)").
+		WithValues(map[string]interface{}{"id": 2, "valuesBatch": "b"}).
+		WithValues(map[string]interface{}{"id": 3, "valuesBatch": "c"}).
+		AddQuery("SELECT 1 AS batch").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sent struct {
+		Transaction []map[string]json.RawMessage `json:"transaction"`
+	}
+	if err = json.Unmarshal(body, &sent); err != nil {
+		t.Error(err)
+	}
+	if _, ok := sent.Transaction[0]["valuesBatch"]; ok {
+		t.Error("valuesBatch was not renamed")
+	}
+	if string(sent.Transaction[0]["batch"]) != `[{"id":2,"valuesBatch":"b"},{"id":3,"valuesBatch":"c"}]` {
+		t.Errorf("unexpected batch: %s", sent.Transaction[0]["batch"])
+	}
+
+	if len(res.Results[1].ResultSet) != 1 || res.Results[1].ResultSet[0]["batch"] != float64(1) {
+		t.Error("resultSet was not parsed with the profile")
+	}
+
+	if string(sentBody(t, request)) == string(body) {
+		t.Error("default profile produced the same request")
+	}
+}
+
+func TestEmptyResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, code, err := client.Send(request)
+	if code != 200 {
+		t.Error("return code is not 200")
+	}
+	if !errors.Is(err, ws4.ErrEmptyResponse) {
+		t.Error("err is not ErrEmptyResponse")
+	}
+}
+
+type tempRecord struct {
+	ID     int    `ws4:"id"`
+	Val    string `ws4:"val"`
+	Ignore string `ws4:"-"`
+	hidden string
+}
+
+func TestValuesFromStruct(t *testing.T) {
+	request, err := ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(tempRecord{ID: 1, Val: "a", Ignore: "x", hidden: "y"}).
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(&tempRecord{ID: 2, Val: "b"}).
+		WithValues(map[string]interface{}{"id": 3, "val": "c"}).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	expected, err := ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 1, "val": "a"}).
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 2, "val": "b"}).
+		WithValues(map[string]interface{}{"id": 3, "val": "c"}).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(sentBody(t, request)) != string(sentBody(t, expected)) {
+		t.Error("struct values differ from the equivalent map")
+	}
+
+	if _, err = ws4.NewRequestBuilder().AddQuery("SELECT 1").WithValues(nil).Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+	if _, err = ws4.NewRequestBuilder().AddQuery("SELECT 1").WithValues((*tempRecord)(nil)).Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+	if _, err = ws4.NewRequestBuilder().AddQuery("SELECT 1").WithValues(42).Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestContinueOnError(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb2").
+		WithInlineAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().
+		WithContinueOnError().
+		AddQuery("SELENCT * FROM TEMP").
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (1, 'DUPLICATE')").
+		WithNoFail().
+		AddQuery("SELECT * FROM TEMP WHERE ID = 1").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	var sent struct {
+		Transaction []struct {
+			NoFail bool `json:"noFail"`
+		} `json:"transaction"`
+	}
+	if err = json.Unmarshal(sentBody(t, request), &sent); err != nil {
+		t.Error(err)
+	}
+	for i := range sent.Transaction {
+		if !sent.Transaction[i].NoFail {
+			t.Errorf("node #%d has no noFail", i)
+		}
+	}
+
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Results[0].Success || res.Results[1].Success || !res.Results[2].Success {
+		t.Error("unexpected results")
+	}
+}
+
+type temp struct {
+	ID  int64
+	Val *string `ws4:"VAL"`
+}
+
+func TestQueryGeneric(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb2").
+		WithInlineAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	rows, err := ws4.Query[temp](client, context.Background(), "SELECT * FROM TEMP WHERE ID IN (1, 4) ORDER BY ID", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatal("len(rows) != 2")
+	}
+	if rows[0].ID != 1 || *rows[0].Val != "ONE" || rows[1].ID != 4 || *rows[1].Val != "FOUR" {
+		t.Errorf("unexpected rows: %v", rows)
+	}
+
+	rows, err = ws4.Query[temp](client, context.Background(), "SELECT * FROM TEMP WHERE ID = :id", map[string]interface{}{"id": -1})
+	if err != nil {
+		t.Error(err)
+	}
+	if rows == nil || len(rows) != 0 {
+		t.Error("rows is not an empty slice")
+	}
+
+	if _, err = ws4.Query[temp](client, context.Background(), "SELECT 'x' AS ID", nil); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestServerInfo(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	info, err := client.ServerInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.SQLiteVersion != "3.39.3" {
+		t.Errorf("unexpected SQLite version: %s", info.SQLiteVersion)
+	}
+	if !info.Encryption || !info.Compression {
+		t.Error("encryption is not detected")
+	}
+}
+
+func TestEmptyTransaction(t *testing.T) {
+	var calls int32
+	srv := flakyServer(t, 0, &calls)
+
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, _, err = client.Send(&ws4.Request{}); !errors.Is(err, ws4.ErrEmptyTransaction) {
+		t.Error("err is not ErrEmptyTransaction")
+	}
+	if _, _, err = client.SendWithRetry(&ws4.Request{}, 2); !errors.Is(err, ws4.ErrEmptyTransaction) {
+		t.Error("err is not ErrEmptyTransaction")
+	}
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Error("request was sent")
+	}
+}
+
+// Returns the address of a socket that accepts a single connection in its backlog
+// and never accepts it, so that subsequent connections hang.
+func unresponsiveAddress(t *testing.T) string {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err = syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return addr
+}
+
+func TestDialAndHeaderTimeouts(t *testing.T) {
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	client, err := ws4.NewClientBuilder().
+		WithURL("http://" + unresponsiveAddress(t) + "/db").
+		WithDialTimeout(100 * time.Millisecond).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+	start := time.Now()
+	_, _, err = client.Send(request)
+	var nerr net.Error
+	if !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Errorf("err is not a timeout: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("dial timeout was not applied")
+	}
+
+	slowBody := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	defer slowBody.Close()
+	slowHeader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	defer slowHeader.Close()
+
+	for _, tc := range []struct {
+		url        string
+		shouldFail bool
+	}{{slowBody.URL, false}, {slowHeader.URL, true}} {
+		client, err = ws4.NewClientBuilder().
+			WithURL(tc.url).
+			WithDialTimeout(100 * time.Millisecond).
+			WithResponseHeaderTimeout(100 * time.Millisecond).
+			Build()
+		if err != nil {
+			t.Error(err)
+		}
+		if _, _, err = client.Send(request); (err != nil) != tc.shouldFail {
+			t.Errorf("unexpected outcome for %s: %v", tc.url, err)
+		}
+	}
+}
+
+func TestErrorValues(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb2").
+		WithInlineAuth("myUser1", "myHotPassword").
+		WithErrorValues().
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT * FROM TEMP").
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithEncoder("secret", "val").
+		WithValues(map[string]interface{}{"id": 1, "val": "duplicate"}).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, _, err = client.Send(request)
+	werr, ok := err.(ws4.WsErrorWithValues)
+	if !ok {
+		t.Fatal("err is not a WsErrorWithValues")
+	}
+	if werr.RequestIdx != 1 {
+		t.Error("RequestIdx != 1")
+	}
+	if werr.Values["id"] != 1 {
+		t.Error("Values[\"id\"] != 1")
+	}
+	if werr.Values["val"] != ws4.REDACTED {
+		t.Error("Values[\"val\"] is not redacted")
+	}
+	var wserr ws4.WsError
+	if !errors.As(err, &wserr) || !wserr.IsSQL() {
+		t.Error("err does not wrap a SQL WsError")
+	}
+}
+
+func TestBatchChunkSizeFailingChunk(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Transaction []struct {
+				ValuesBatch []map[string]interface{} `json:"valuesBatch"`
+			} `json:"transaction"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		batch := req.Transaction[0].ValuesBatch
+		if batch[0]["id"] == float64(3) {
+			io.WriteString(w, `{"results":[{"success":false,"error":"UNIQUE constraint failed: TEMP.ID"}]}`)
+			return
+		}
+		counts := strings.TrimSuffix(strings.Repeat("1,", len(batch)), ",")
+		io.WriteString(w, `{"results":[{"success":true,"rowsUpdatedBatch":[`+counts+`]}]}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).WithBatchChunkSize(2).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := ws4.NewRequestBuilder().
+		AddBatchInsert("INSERT INTO TEMP (ID) VALUES (:id)", []map[string]interface{}{
+			{"id": 1}, {"id": 2}, {"id": 3}, {"id": 4}, {"id": 5},
+		}).
+		WithNoFail().
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := res.Results[0]
+	if item.Success || item.Error == "" {
+		t.Errorf("unexpected result: %+v", item)
+	}
+	if !reflect.DeepEqual(item.RowsUpdatedBatch, []int64{1, 1, 0, 0, 1}) {
+		t.Errorf("unexpected counts: %v", item.RowsUpdatedBatch)
+	}
+}
+
+func TestBatchChunkSize(t *testing.T) {
+	var bodies [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, b)
+		var req struct {
+			Transaction []struct {
+				ValuesBatch []interface{} `json:"valuesBatch"`
+			} `json:"transaction"`
+		}
+		json.Unmarshal(b, &req)
+		var results []string
+		for _, item := range req.Transaction {
+			if item.ValuesBatch == nil {
+				results = append(results, `{"success":true,"resultSet":[]}`)
+				continue
+			}
+			rows := strings.Repeat("1,", len(item.ValuesBatch))
+			results = append(results, fmt.Sprintf(`{"success":true,"rowsUpdatedBatch":[%s]}`, rows[:len(rows)-1]))
+		}
+		fmt.Fprintf(w, `{"results":[%s]}`, strings.Join(results, ","))
+	}))
+	defer srv.Close()
+
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithBatchChunkSize(1000).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	rb := ws4.NewRequestBuilder().AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)")
+	for i := 0; i < 10000; i++ {
+		rb.WithValues(map[string]interface{}{"id": i, "val": "x"})
+	}
+	request, err := rb.Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 10 {
+		t.Errorf("%d sub-requests were sent instead of 10", len(bodies))
+	}
+	if len(res.Results) != 1 {
+		t.Fatal("len(res.Results) != 1")
+	}
+	if len(res.Results[0].RowsUpdatedBatch) != 10000 || res.Results[0].TotalAffected() != 10000 {
+		t.Error("batch results were not aggregated")
+	}
+
+	// other nodes are sent along with the chunks, and keep their position
+	bodies = nil
+	rb = ws4.NewRequestBuilder().
+		AddQuery("SELECT * FROM TEMP").
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)")
+	for i := 0; i < 1500; i++ {
+		rb.WithValues(map[string]interface{}{"id": i, "val": "x"})
+	}
+	request, err = rb.AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, _, err = client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bodies) != 3 {
+		t.Errorf("%d sub-requests were sent instead of 3", len(bodies))
+	}
+	if len(res.Results) != 3 {
+		t.Fatal("len(res.Results) != 3")
+	}
+	if res.Results[0].ResultSet == nil || res.Results[2].ResultSet == nil {
+		t.Error("query results are missing")
+	}
+	if len(res.Results[1].RowsUpdatedBatch) != 1500 {
+		t.Error("batch results were not aggregated")
+	}
+}
+
+func TestPreencodedBasicAuth(t *testing.T) {
+	var authorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	defer srv.Close()
+
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithPreencodedBasicAuth("c29tZS10b2tlbg==").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Error(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+	if authorization != "Basic c29tZS10b2tlbg==" {
+		t.Errorf("unexpected Authorization header: %s", authorization)
+	}
+
+	// against the real server
+	client, err = ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithPreencodedBasicAuth(base64.StdEncoding.EncodeToString([]byte("myUser1:myHotPassword"))).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = ws4.NewClientBuilder().WithURL(srv.URL).WithPreencodedBasicAuth("").Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+type traceKey struct{}
+
+func TestTraceHeaderFromContext(t *testing.T) {
+	var traceId string
+	var present bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, present = r.Header["X-Trace-Id"]
+		traceId = r.Header.Get("X-Trace-Id")
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	defer srv.Close()
+
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithTraceHeaderFromContext("X-Trace-Id", traceKey{}).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	ctx := context.WithValue(context.Background(), traceKey{}, "abc-123")
+	if _, _, err = client.SendWithContext(ctx, request); err != nil {
+		t.Error(err)
+	}
+	if traceId != "abc-123" {
+		t.Errorf("unexpected trace id: %s", traceId)
+	}
+
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+	if present {
+		t.Error("header was sent without a value in context")
+	}
+
+	ctx = context.WithValue(context.Background(), traceKey{}, "")
+	if _, _, err = client.SendWithContext(ctx, request); err != nil {
+		t.Error(err)
+	}
+	if present {
+		t.Error("header was sent with a zero value in context")
+	}
+}
+
+func TestParamValidation(t *testing.T) {
+	_, err := ws4.NewRequestBuilder().
+		WithParamValidation().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, ':notAParam' || :val)").
+		WithEncoder("secret", "val").
+		WithValues(map[string]interface{}{"id": 1, "val": "a"}).
+		AddQuery("SELECT ID, VAL FROM TEMP").
+		WithDecoder("secret", "val").
+		AddQuery("SELECT * FROM TEMP").
+		WithDecoder("secret", "WHATEVER").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = ws4.NewRequestBuilder().
+		WithParamValidation().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithEncoder("secret", "SECRET").
+		WithValues(map[string]interface{}{"id": 1, "val": "a"}).
+		Build()
+	if err == nil || !strings.Contains(err.Error(), "SECRET") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = ws4.NewRequestBuilder().
+		WithParamValidation().
+		AddQuery("SELECT ID, VAL FROM TEMP").
+		WithDecoder("secret", "SECRET").
+		Build()
+	if err == nil || !strings.Contains(err.Error(), "SECRET") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = ws4.NewRequestBuilder().
+		WithParamValidation().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 1, "val": "a"}).
+		WithValues(map[string]interface{}{"id": 2}).
+		Build()
+	if err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	var calls int32
+	srv := flakyServer(t, 0, &calls)
+
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithResponseCache(200*time.Millisecond, 1).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	query1, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Error(err)
+	}
+	query2, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP WHERE ID = 1").Build()
+	if err != nil {
+		t.Error(err)
+	}
+	statement, err := ws4.NewRequestBuilder().AddStatement("DELETE FROM TEMP WHERE ID = 1").Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	send := func(req *ws4.Request, expectedCalls int32) {
+		t.Helper()
+		if _, _, err := client.Send(req); err != nil {
+			t.Error(err)
+		}
+		if c := atomic.LoadInt32(&calls); c != expectedCalls {
+			t.Errorf("calls = %d, expected %d", c, expectedCalls)
+		}
+	}
+
+	send(query1, 1)
+	send(query1, 1) // hit
+	send(statement, 2)
+	send(statement, 3) // never cached
+	send(query2, 4)    // evicts query1
+	send(query1, 5)
+	time.Sleep(300 * time.Millisecond)
+	send(query1, 6) // expired
+	send(query1, 6)
+}
+
+func TestResponseCacheCallOptions(t *testing.T) {
+	var calls int32
+	srv := flakyServer(t, 0, &calls)
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithInlineAuth("alice", "secret").
+		WithResponseCache(time.Minute, 10).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	query, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range []struct {
+		opts          []ws4.SendOption
+		expectedCalls int32
+	}{
+		{nil, 1},
+		{nil, 1},
+		{[]ws4.SendOption{ws4.WithInlineCredentials("mallory", "wrong")}, 2},
+		{[]ws4.SendOption{ws4.WithInlineCredentials("mallory", "wrong")}, 2},
+		{[]ws4.SendOption{ws4.WithInlineCredentials("mallory", "other")}, 3},
+		{[]ws4.SendOption{ws4.WithoutInlineCredentials()}, 4},
+		{[]ws4.SendOption{ws4.WithHeader("Authorization", "Bearer x")}, 5},
+		{[]ws4.SendOption{ws4.WithHeader("Authorization", "Bearer y")}, 6},
+		{[]ws4.SendOption{ws4.WithTimeout(time.Minute)}, 6},
+	} {
+		if _, _, err := client.SendWithContext(context.Background(), query, c.opts...); err != nil {
+			t.Fatal(err)
+		}
+		if n := atomic.LoadInt32(&calls); n != c.expectedCalls {
+			t.Errorf("#%d: calls = %d, expected %d", i, n, c.expectedCalls)
+		}
+	}
+}
+
+func TestEmptyResultSet(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"results":[{"success":true},{"success":true,"resultSet":null},{"success":true,"rowsUpdated":0}]}`)
+	}))
+	defer srv.Close()
+
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT * FROM TEMP WHERE ID = -1").
+		AddQuery("SELECT * FROM TEMP WHERE ID = -2").
+		AddStatement("DELETE FROM TEMP WHERE ID = -1").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, url := range []string{srv.URL, "http://localhost:12321/mydb2"} {
+		client, err := ws4.NewClientBuilder().
+			WithURL(url).
+			WithInlineAuth("myUser1", "myHotPassword").
+			Build()
+		if err != nil {
+			t.Error(err)
+		}
+
+		res, _, err := client.Send(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if res.Results[i].ResultSet == nil || len(res.Results[i].ResultSet) != 0 {
+				t.Errorf("res.Results[%d].ResultSet is not empty", i)
+			}
+		}
+		if res.Results[2].ResultSet != nil {
+			t.Error("res.Results[2].ResultSet is not nil")
+		}
+	}
+}
+
+func TestDiagnoseFailure(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb2").
+		WithInlineAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (200, 'A')").
+		AddQuery("SELECT * FROM TEMP WHERE ID = 200").
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (200, 'DUPLICATE')").
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (201, 'B')").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, _, err = client.Send(request)
+	if err == nil {
+		t.Error("did not fail, but should have")
+	}
+
+	report, err := client.DiagnoseFailure(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.FirstFailure != 2 {
+		t.Error("report.FirstFailure != 2")
+	}
+	if len(report.Nodes) != 4 {
+		t.Fatal("len(report.Nodes) != 4")
+	}
+	for i, expected := range []bool{true, true, false, true} {
+		if report.Nodes[i].Success != expected {
+			t.Errorf("report.Nodes[%d].Success != %t", i, expected)
+		}
+	}
+	if !strings.Contains(report.Nodes[2].Error, "UNIQUE") {
+		t.Errorf("unexpected error: %s", report.Nodes[2].Error)
+	}
+
+	// nothing was written
+	rows, err := ws4.Query[temp](client, context.Background(), "SELECT * FROM TEMP WHERE ID >= 200", nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(rows) != 0 {
+		t.Error("the diagnosis wrote to the database")
+	}
+}
+
+func TestColumns(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb2").
+		WithInlineAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT VAL, ID, 1.5 AS R, NULL AS N FROM TEMP WHERE ID = 1").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ws4sqlite 0.12 returns the columns in alphabetical order
+	expected := []ws4.ColumnMeta{
+		{Name: "ID", DeclaredType: "INTEGER"},
+		{Name: "N", DeclaredType: ""},
+		{Name: "R", DeclaredType: "REAL"},
+		{Name: "VAL", DeclaredType: "TEXT"},
+	}
+	if !reflect.DeepEqual(res.Results[0].Columns, expected) {
+		t.Errorf("unexpected columns: %v", res.Results[0].Columns)
+	}
+
+	// the order of the server is preserved
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[{"VAL":"ONE","ID":1,"N":null},{"VAL":"TWO","ID":2,"N":true}]}]}`)
+	}))
+	defer srv.Close()
+
+	client, err = ws4.NewClientBuilder().WithURL(srv.URL).Build()
+	if err != nil {
+		t.Error(err)
+	}
+	res, _, err = client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []ws4.ColumnMeta{
+		{Name: "VAL", DeclaredType: "TEXT"},
+		{Name: "ID", DeclaredType: "INTEGER"},
+		{Name: "N", DeclaredType: "BOOLEAN"},
+	}
+	if !reflect.DeepEqual(res.Results[0].Columns, expected) {
+		t.Errorf("unexpected columns: %v", res.Results[0].Columns)
+	}
+}
+
+type recordingMarshaller struct {
+	marshals, unmarshals int
+}
+
+func (m *recordingMarshaller) Marshal(v interface{}) ([]byte, error) {
+	m.marshals++
+	return json.Marshal(v)
+}
+
+func (m *recordingMarshaller) Unmarshal(data []byte, v interface{}) error {
+	m.unmarshals++
+	return json.Unmarshal(data, v)
+}
+
+func TestMarshaller(t *testing.T) {
+	m := &recordingMarshaller{}
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb2").
+		WithInlineAuth("myUser1", "myHotPassword").
+		WithMarshaller(m).
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP WHERE ID = 1").Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Results[0].ResultSet[0]["VAL"] != "ONE" {
+		t.Error("res.Results[0].ResultSet[0][\"VAL\"] != \"ONE\"")
+	}
+	if m.marshals != 1 || m.unmarshals != 1 {
+		t.Errorf("marshaller was invoked %d/%d times instead of 1/1", m.marshals, m.unmarshals)
+	}
+}
+
+func TestOrderedRows(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[{"VAL":"ONE","ID":1,"A":null},{"VAL":"FOUR","ID":4,"A":true}]}]}`)
+	}))
+	defer srv.Close()
+
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).WithOrderedRows().Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT VAL, ID, A FROM TEMP").Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := res.Results[0].OrderedResultSet
+	if len(rows) != 2 {
+		t.Fatal("len(rows) != 2")
+	}
+	if !reflect.DeepEqual(rows[0].Keys(), []string{"VAL", "ID", "A"}) {
+		t.Errorf("unexpected keys: %v", rows[0].Keys())
+	}
+	if !reflect.DeepEqual(rows[1].Values(), []interface{}{"FOUR", float64(4), true}) {
+		t.Errorf("unexpected values: %v", rows[1].Values())
+	}
+	if v, ok := rows[0].Get("VAL"); !ok || v != "ONE" {
+		t.Error("rows[0].Get(\"VAL\") != \"ONE\"")
+	}
+	if _, ok := rows[0].Get("NOPE"); ok {
+		t.Error("rows[0].Get(\"NOPE\") is present")
+	}
+}
+
+func TestWithDatabase(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	defer srv.Close()
+
+	base, err := ws4.NewClientBuilder().
+		WithURL(srv.URL+"/api/base").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+	db1 := base.WithDatabase("db1")
+	db2 := base.WithDatabase("my db")
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Error(err)
+	}
+	for _, c := range []*ws4.Client{db1, db2, base} {
+		if _, _, err = c.Send(request); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if !reflect.DeepEqual(paths, []string{"/api/db1", "/api/my%20db", "/api/base"}) {
+		t.Errorf("unexpected paths: %v", paths)
+	}
+	if db1.HTTPClient() != base.HTTPClient() {
+		t.Error("http.Client is not shared")
+	}
+
+	// against the real server
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb2").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+	if _, _, err = client.WithDatabase("mydb").Send(request); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNullValues(t *testing.T) {
+	request, err := ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 300, "val": nil}).
+		WithValues(map[string]interface{}{"id": 301, "val": (*int)(nil)}).
+		WithValues(map[string]interface{}{"id": 302, "val": ws4.Null}).
+		WithValues(struct {
+			ID  int     `ws4:"id"`
+			Val *string `ws4:"val"`
+		}{ID: 303}).
+		AddQuery("SELECT * FROM TEMP WHERE ID >= 300 AND ID < 400 AND VAL IS NULL").
+		AddStatement("DELETE FROM TEMP WHERE ID >= 300 AND ID < 400").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	var sent struct {
+		Transaction []struct {
+			ValuesBatch []map[string]json.RawMessage `json:"valuesBatch"`
+		} `json:"transaction"`
+	}
+	if err = json.Unmarshal(sentBody(t, request), &sent); err != nil {
+		t.Error(err)
+	}
+	for i, values := range sent.Transaction[0].ValuesBatch {
+		if string(values["val"]) != "null" {
+			t.Errorf("val of batch item #%d is %s", i, values["val"])
+		}
+	}
+
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb2").
+		WithInlineAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Results[1].ResultSet) != 4 {
+		t.Error("len(res.Results[1].ResultSet) != 4")
+	}
+}
+
+func TestAddRaw(t *testing.T) {
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT * FROM TEMP").
+		AddRaw(ws4.RequestItem{
+			Statement: "INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)",
+			Values:    map[string]interface{}{"id": 1, "val": "a"},
+			Extra:     map[string]interface{}{"futureField": true, "statement": "IGNORED"},
+		}).
+		WithNoFail().
+		Build()
+	if err != nil {
+		t.Error(err)
+	}
+
+	var sent struct {
+		Transaction []map[string]interface{} `json:"transaction"`
+	}
+	if err = json.Unmarshal(sentBody(t, request), &sent); err != nil {
+		t.Error(err)
+	}
+	if len(sent.Transaction) != 2 {
+		t.Fatal("len(sent.Transaction) != 2")
+	}
+	raw := sent.Transaction[1]
+	if raw["futureField"] != true {
+		t.Error("futureField is not true")
+	}
+	if raw["statement"] != "INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)" {
+		t.Error("statement was overridden")
+	}
+	if raw["noFail"] != true {
+		t.Error("noFail is not true")
+	}
+
+	for _, item := range []ws4.RequestItem{{}, {Query: "SELECT 1", Statement: "DELETE FROM TEMP"}} {
+		if _, err = ws4.NewRequestBuilder().AddRaw(item).Build(); err == nil {
+			t.Error("did not fail, but should have")
+		}
+	}
+}
+
+// A Marshaller that doesn't escape HTML characters, unlike encoding/json.
+type noEscapeMarshaller struct{}
+
+func (noEscapeMarshaller) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func (noEscapeMarshaller) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func TestAddRawExtraMarshalling(t *testing.T) {
+	request, err := ws4.NewRequestBuilder().
+		AddRaw(ws4.RequestItem{
+			Statement: "INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)",
+			Values:    map[string]interface{}{"id": int64(9007199254740993), "val": "<b>"},
+			Extra:     map[string]interface{}{"hint": "<i>"},
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := sentBody(t, request)
+	if !bytes.Contains(body, []byte(`"id":9007199254740993`)) {
+		t.Errorf("unexpected body: %s", body)
+	}
+
+	var captured []byte
+	srv := captureServer(t, `{"results":[]}`, &captured)
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).WithMarshaller(noEscapeMarshaller{}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"transaction":[{"hint":"<i>","statement":"INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)","values":{"id":9007199254740993,"val":"<b>"}}]}`
+	if string(captured) != expected {
+		t.Errorf("unexpected body: %s", captured)
+	}
+}
+
+func TestStoredStatements(t *testing.T) {
+	request, err := ws4.NewRequestBuilder().
+		AddStoredQuery("Q_BY_ID").
+		WithValues(map[string]interface{}{"id": 4}).
+		WithParamValidation().
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sent struct {
+		Transaction []map[string]interface{} `json:"transaction"`
+	}
+	if err = json.Unmarshal(sentBody(t, request), &sent); err != nil {
+		t.Error(err)
+	}
+	if len(sent.Transaction) != 1 || sent.Transaction[0]["query"] != "#Q_BY_ID" {
+		t.Error("the stored reference was not serialized correctly")
+	}
+
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Results[0].ResultSet) != 1 || res.Results[0].ResultSet[0]["VAL"] != "FOUR" {
+		t.Error("the stored query did not return the expected record")
+	}
+
+	for _, id := range []string{"", "#Q", " Q"} {
+		if _, err = ws4.NewRequestBuilder().AddStoredStatement(id).Build(); err == nil {
+			t.Errorf("id '%s' did not fail, but should have", id)
+		}
+	}
+}
+
+func TestSendBatchCancelOnError(t *testing.T) {
+	var cancelled int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "FAIL") {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, `{"reqIdx":-1,"error":"failed"}`)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			atomic.AddInt32(&cancelled, 1)
+		case <-time.After(5 * time.Second):
+			io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reqs []*ws4.Request
+	for _, query := range []string{"SELECT 1", "SELECT 2", "SELECT 'FAIL'", "SELECT 3"} {
+		req, err := ws4.NewRequestBuilder().AddQuery(query).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqs = append(reqs, req)
+	}
+
+	start := time.Now()
+	responses, err := client.SendBatch(context.Background(), reqs, ws4.WithCancelOnError())
+	var wserr ws4.WsError
+	if !errors.As(err, &wserr) || wserr.Msg != "failed" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if time.Since(start) > 4*time.Second {
+		t.Error("the other requests were not cancelled")
+	}
+	if len(responses) != 4 {
+		t.Fatal("len(responses) != 4")
+	}
+	for i, res := range responses {
+		if res != nil {
+			t.Errorf("response #%d is not nil", i)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&cancelled) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&cancelled) != 3 {
+		t.Errorf("cancelled requests on the server: %d, expected 3", atomic.LoadInt32(&cancelled))
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reqs []*ws4.Request
+	for _, id := range []int{1, 4} {
+		req, err := ws4.NewRequestBuilder().
+			AddQuery("SELECT VAL FROM TEMP WHERE ID = :id").
+			WithValues(map[string]interface{}{"id": id}).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqs = append(reqs, req)
+	}
+
+	responses, err := client.SendBatch(context.Background(), reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responses[0].Results[0].ResultSet[0]["VAL"] != "ONE" || responses[1].Results[0].ResultSet[0]["VAL"] != "FOUR" {
+		t.Error("responses are not in the order of the requests")
+	}
+}
+
+func TestSuccessStatuses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/accepted" {
+			w.WriteHeader(http.StatusAccepted)
+			io.WriteString(w, `{"results":[{"success":true,"rowsUpdated":1}]}`)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	request, err := ws4.NewRequestBuilder().
+		AddStatement("DELETE FROM TEMP").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL + "/accepted").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, code, err := client.Send(request)
+	var wserr ws4.WsError
+	if code != 202 || !errors.As(err, &wserr) {
+		t.Error("202 should be an error by default")
+	}
+
+	client, err = ws4.NewClientBuilder().
+		WithURL(srv.URL+"/accepted").
+		WithSuccessStatuses(200, 202, 204).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, code, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 202 || len(res.Results) != 1 || *res.Results[0].RowsUpdated != 1 {
+		t.Error("the 202 response was not parsed")
+	}
+
+	client = client.WithDatabase("nocontent")
+	res, code, err = client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 204 || res == nil || len(res.Results) != 0 {
+		t.Error("the 204 response is not an empty Response")
+	}
+
+	if _, err = ws4.NewClientBuilder().WithURL(srv.URL).WithSuccessStatuses(404).Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestAddBatchInsert(t *testing.T) {
+	rows := []map[string]interface{}{
+		{"id": 10, "val": "TEN"},
+		{"id": 11, "val": "ELEVEN"},
+		{"id": 12, "val": "TWELVE"},
+	}
+
+	request, err := ws4.NewRequestBuilder().
+		AddBatchInsert("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)", rows).
+		WithStrictBatch().
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(rows[0]).
+		WithValues(rows[1]).
+		WithValues(rows[2]).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sentBody(t, request)) != string(sentBody(t, expected)) {
+		t.Error("AddBatchInsert differs from the repeated WithValues")
+	}
+
+	if _, err = ws4.NewRequestBuilder().AddBatchInsert("DELETE FROM TEMP", nil).Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+	if _, err = ws4.NewRequestBuilder().AddBatchInsert("DELETE FROM TEMP", []map[string]interface{}{nil}).Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestNodeIndexAlignment(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT 'A' AS N").
+		AddStatement("UPDATE TEMP SET VAL = VAL WHERE ID = :id").
+		WithValues(map[string]interface{}{"id": 1}).
+		WithValues(map[string]interface{}{"id": 4}).
+		WithValues(map[string]interface{}{"id": 99}).
+		AddQuery("SELECT 'B' AS N").
+		AddStatement("UPDATE TEMP SET VAL = VAL WHERE ID = :id").
+		WithValues(map[string]interface{}{"id": 1}).
+		AddQuery("SELECT 'C' AS N").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.NodeCount() != 5 {
+		t.Fatalf("NodeCount() is %d, expected 5", request.NodeCount())
+	}
+
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Results) != request.NodeCount() {
+		t.Fatal("len(res.Results) != request.NodeCount()")
+	}
+	for i, n := range map[int]string{0: "A", 2: "B", 4: "C"} {
+		if res.Results[i].ResultSet[0]["N"] != n {
+			t.Errorf("result #%d is not query %s", i, n)
+		}
+	}
+	if !reflect.DeepEqual(res.Results[1].RowsUpdatedBatch, []int64{1, 1, 0}) {
+		t.Error("result #1 is not the batch")
+	}
+	if *res.Results[3].RowsUpdated != 1 {
+		t.Error("result #3 is not the single statement")
+	}
+}
+
+func TestWithValue(t *testing.T) {
+	request, err := ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValue("id", 1).
+		WithValue("val", "a").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 1, "val": "a"}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sentBody(t, request)) != string(sentBody(t, expected)) {
+		t.Error("single values differ from the map")
+	}
+
+	values := map[string]interface{}{"id": 2}
+	request, err = ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(values).
+		WithValue("val", "b").
+		WithValues(map[string]interface{}{"id": 3}).
+		WithValue("val", "c").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err = ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 2, "val": "b"}).
+		WithValues(map[string]interface{}{"id": 3, "val": "c"}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(sentBody(t, request)) != string(sentBody(t, expected)) {
+		t.Error("single values mixed with maps differ from the batch")
+	}
+	if len(values) != 1 {
+		t.Error("the map passed to WithValues was modified")
+	}
+
+	if _, err = ws4.NewRequestBuilder().AddQuery("SELECT 1").WithValue("", 1).Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestRejectMultiStatement(t *testing.T) {
+	benign := []string{
+		"SELECT * FROM TEMP WHERE VAL = 'a; DROP TABLE TEMP'",
+		"SELECT * FROM TEMP WHERE VAL = 'x -- y /* z */'",
+		`SELECT "a;b" FROM TEMP;`,
+		"SELECT [--] FROM TEMP ;  ",
+	}
+	for _, sql := range benign {
+		if _, err := ws4.NewRequestBuilder().AddQuery(sql).WithRejectMultiStatement().Build(); err != nil {
+			t.Errorf("'%s' failed: %v", sql, err)
+		}
+	}
+
+	suspicious := []string{
+		"SELECT * FROM TEMP; DROP TABLE TEMP",
+		"SELECT * FROM TEMP WHERE VAL = ''; DELETE FROM TEMP; --'",
+		"SELECT * FROM TEMP -- WHERE ID = 1",
+		"SELECT * FROM TEMP /* */",
+		"SELECT 1; SELECT 'a'",
+	}
+	for _, sql := range suspicious {
+		if _, err := ws4.NewRequestBuilder().AddQuery(sql).WithRejectMultiStatement().Build(); err == nil {
+			t.Errorf("'%s' did not fail, but should have", sql)
+		}
+	}
+}
+
+func TestQueryScalar(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := client.QueryScalar(context.Background(), "SELECT COUNT(*) FROM TEMP WHERE ID IN (1, 4)", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != float64(2) {
+		t.Errorf("count is %v, expected 2", count)
+	}
+
+	typed, err := ws4.QueryScalar[int64](client, context.Background(), "SELECT COUNT(*) FROM TEMP WHERE ID = :id", map[string]interface{}{"id": 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typed != 1 {
+		t.Errorf("typed count is %d, expected 1", typed)
+	}
+
+	val, err := ws4.QueryScalar[string](client, context.Background(), "SELECT VAL FROM TEMP WHERE ID = 1", nil)
+	if err != nil || val != "ONE" {
+		t.Errorf("val is '%s' (%v), expected 'ONE'", val, err)
+	}
+
+	if _, err = client.QueryScalar(context.Background(), "SELECT VAL FROM TEMP WHERE ID = -1", nil); !errors.Is(err, ws4.ErrNoRows) {
+		t.Errorf("zero rows did not return ErrNoRows: %v", err)
+	}
+	if _, err = ws4.QueryScalar[int64](client, context.Background(), "SELECT VAL FROM TEMP WHERE ID = 1", nil); err == nil {
+		t.Error("a string converted to int64 did not fail, but should have")
+	}
+}
+
+func TestNewClientFromEnv(t *testing.T) {
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT VAL FROM TEMP WHERE ID = 4").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	setEnv := func(env map[string]string) {
+		for _, name := range []string{ws4.ENV_URL, ws4.ENV_AUTH_MODE, ws4.ENV_USER, ws4.ENV_PASSWORD, ws4.ENV_BASIC_AUTH} {
+			t.Setenv(name, env[name])
+		}
+	}
+
+	basicAuth := base64.StdEncoding.EncodeToString([]byte("myUser1:myHotPassword"))
+	for _, env := range []map[string]string{
+		{ws4.ENV_URL: "http://localhost:12321/mydb", ws4.ENV_AUTH_MODE: "http", ws4.ENV_USER: "myUser1", ws4.ENV_PASSWORD: "myHotPassword"},
+		{ws4.ENV_URL: "http://localhost:12321/mydb", ws4.ENV_AUTH_MODE: "HTTP", ws4.ENV_BASIC_AUTH: basicAuth},
+		{ws4.ENV_URL: "http://localhost:12321/mydb2", ws4.ENV_AUTH_MODE: "INLINE", ws4.ENV_USER: "myUser1", ws4.ENV_PASSWORD: "myHotPassword"},
+	} {
+		setEnv(env)
+		client, err := ws4.NewClientFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, _, err := client.Send(request)
+		if err != nil {
+			t.Fatalf("%v: %v", env, err)
+		}
+		if res.Results[0].ResultSet[0]["VAL"] != "FOUR" {
+			t.Error("unexpected result")
+		}
+	}
+
+	for _, env := range []map[string]string{
+		{},
+		{ws4.ENV_URL: "http://localhost:12321/mydb", ws4.ENV_USER: "myUser1", ws4.ENV_PASSWORD: "myHotPassword"},
+		{ws4.ENV_URL: "http://localhost:12321/mydb", ws4.ENV_AUTH_MODE: "HTTP", ws4.ENV_USER: "myUser1", ws4.ENV_BASIC_AUTH: basicAuth},
+		{ws4.ENV_URL: "http://localhost:12321/mydb", ws4.ENV_AUTH_MODE: "INLINE", ws4.ENV_BASIC_AUTH: basicAuth},
+		{ws4.ENV_URL: "http://localhost:12321/mydb", ws4.ENV_AUTH_MODE: "INLINE", ws4.ENV_USER: "myUser1"},
+		{ws4.ENV_URL: "http://localhost:12321/mydb", ws4.ENV_AUTH_MODE: "BEARER"},
+		{ws4.ENV_URL: "http://localhost:12321/mydb", ws4.ENV_AUTH_MODE: "TOKEN", ws4.ENV_BASIC_AUTH: basicAuth},
+	} {
+		setEnv(env)
+		if _, err := ws4.NewClientFromEnv(); err == nil {
+			t.Errorf("%v did not fail, but should have", env)
+		}
+	}
+}
+
+func TestMaxRetryElapsedTime(t *testing.T) {
+	var calls int32
+	srv := flakyServer(t, math.MaxInt32, &calls)
+
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithBackoff(20*time.Millisecond, 50*time.Millisecond).
+		WithMaxRetryElapsedTime(500 * time.Millisecond).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	_, code, err := client.Send(request)
+	elapsed := time.Since(start)
+	if err == nil || code != 503 {
+		t.Error("did not fail with 503, but should have")
+	}
+	if elapsed > 600*time.Millisecond || elapsed < 400*time.Millisecond {
+		t.Errorf("the retries lasted %s, expected about 500ms", elapsed)
+	}
+	if atomic.LoadInt32(&calls) < 5 {
+		t.Errorf("only %d attempts were made", atomic.LoadInt32(&calls))
+	}
+
+	// with WithRetries too, the first limit that is reached applies
+	for _, tc := range []struct {
+		attempts      int
+		expectedCalls int32
+		maxElapsed    time.Duration
+	}{
+		{1, 1, 100 * time.Millisecond},
+		{3, 3, 300 * time.Millisecond},
+		{100, 0, 700 * time.Millisecond},
+	} {
+		atomic.StoreInt32(&calls, 0)
+		client, err = ws4.NewClientBuilder().
+			WithURL(srv.URL).
+			WithRetries(tc.attempts).
+			WithBackoff(20*time.Millisecond, 50*time.Millisecond).
+			WithMaxRetryElapsedTime(500 * time.Millisecond).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		start = time.Now()
+		if _, _, err = client.Send(request); err == nil {
+			t.Error("did not fail, but should have")
+		}
+		elapsed = time.Since(start)
+		n := atomic.LoadInt32(&calls)
+		if tc.expectedCalls > 0 && n != tc.expectedCalls {
+			t.Errorf("with %d attempts, %d were made", tc.attempts, n)
+		}
+		if tc.expectedCalls == 0 && (n < 5 || n >= int32(tc.attempts)) {
+			t.Errorf("with %d attempts, %d were made", tc.attempts, n)
+		}
+		if elapsed > tc.maxElapsed {
+			t.Errorf("with %d attempts, the retries lasted %s", tc.attempts, elapsed)
+		}
+	}
+}
+
+func TestRedirectPolicyNotRetried(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	t.Cleanup(other.Close)
+	var calls int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Redirect(w, r, "/loop", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/other", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Redirect(w, r, other.URL, http.StatusTemporaryRedirect)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		policy   ws4.RedirectPolicy
+		path     string
+		sentinel error
+		calls    int32
+	}{
+		{ws4.REDIRECT_POLICY_DEFAULT, "/loop", ws4.ErrTooManyRedirects, 10},
+		{ws4.REDIRECT_POLICY_SAME_HOST, "/loop", ws4.ErrTooManyRedirects, 10},
+		{ws4.REDIRECT_POLICY_SAME_HOST, "/other", ws4.ErrRedirectToOtherHost, 1},
+	} {
+		atomic.StoreInt32(&calls, 0)
+		client, err := ws4.NewClientBuilder().
+			WithURL(srv.URL+tc.path).
+			WithRedirectPolicy(tc.policy).
+			WithBackoff(time.Millisecond, time.Millisecond).
+			WithMaxRetryElapsedTime(time.Second).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = client.Send(request); !errors.Is(err, tc.sentinel) {
+			t.Errorf("%s %s: unexpected error: %v", tc.policy, tc.path, err)
+		}
+		if n := atomic.LoadInt32(&calls); n != tc.calls {
+			t.Errorf("%s %s: the request was retried (%d calls)", tc.policy, tc.path, n)
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	var mu sync.Mutex
+	var times []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	const backoff = 60 * time.Millisecond
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithRetries(6).
+		WithBackoff(backoff, backoff).
+		WithBackoffJitter(0.5).
+		WithBackoffJitterSeed(42).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err == nil {
+		t.Error("did not fail, but should have")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(times) != 6 {
+		t.Fatalf("%d attempts, expected 6", len(times))
+	}
+	for i := 1; i < len(times); i++ {
+		interval := times[i].Sub(times[i-1])
+		if interval < backoff/2 || interval > backoff*3/2+30*time.Millisecond {
+			t.Errorf("interval #%d is %s, outside of the jittered range", i, interval)
+		}
+	}
+
+	if _, err = ws4.NewClientBuilder().WithURL(srv.URL).WithBackoffJitter(1.5).Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestHostHeader(t *testing.T) {
+	var host string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	defer srv.Close()
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL + "/mydb").
+		WithHostHeader("db.example.com").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Fatal(err)
+	}
+	if host != "db.example.com" {
+		t.Errorf("Host is '%s', expected 'db.example.com'", host)
+	}
+
+	client, err = ws4.NewClientBuilder().WithURL(srv.URL + "/mydb").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Fatal(err)
+	}
+	if host != strings.TrimPrefix(srv.URL, "http://") {
+		t.Errorf("Host is '%s', expected the address of the server", host)
+	}
+
+	if _, err = ws4.NewClientBuilder().WithURL(srv.URL).WithHostHeader("a/b").Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestSendOptions(t *testing.T) {
+	var mu sync.Mutex
+	var headers []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers = append(headers, r.Header.Clone())
+		mu.Unlock()
+		if r.Header.Get("X-Slow") != "" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	defer srv.Close()
+
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithIdempotencyKeys().
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if _, _, err = client.SendWithContext(ctx, request, ws4.WithHeader("X-Tenant", "acme"), ws4.WithCallIdempotencyKey("key-1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.SendWithContext(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.SendWithContext(ctx, request, ws4.WithHeader("X-Slow", "1"), ws4.WithTimeout(50*time.Millisecond)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("the call did not time out: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if headers[0].Get("X-Tenant") != "acme" || headers[0].Get("Idempotency-Key") != "key-1" {
+		t.Error("the options were not applied to the first call")
+	}
+	if headers[1].Get("X-Tenant") != "" {
+		t.Error("the header leaked into the second call")
+	}
+	if key := headers[1].Get("Idempotency-Key"); key == "" || key == "key-1" {
+		t.Error("the idempotency key leaked into the second call")
+	}
+}
+
+func TestContentDecoder(t *testing.T) {
+	var acceptEncoding string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		io.WriteString(gz, `{"results":[{"success":true,"resultSet":[{"VAL":"ONE"}]}]}`)
+		gz.Close()
+	}))
+	defer srv.Close()
+
+	var decoded int32
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithContentDecoder("gzip", func(r io.Reader) (io.ReadCloser, error) {
+			atomic.AddInt32(&decoded, 1)
+			return gzip.NewReader(r)
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT VAL FROM TEMP").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Results[0].ResultSet[0]["VAL"] != "ONE" {
+		t.Error("the response was not decoded")
+	}
+	if acceptEncoding != "gzip" || atomic.LoadInt32(&decoded) != 1 {
+		t.Error("the decoder was not used")
+	}
+
+	if _, err = ws4.NewClientBuilder().WithURL(srv.URL).WithContentDecoder("zstd", nil).Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+type tenantKey struct{}
+
+func TestContextValues(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		WithContextValues(func(ctx context.Context) map[string]interface{} {
+			if tenant, ok := ctx.Value(tenantKey{}).(string); ok {
+				return map[string]interface{}{"tenant": tenant}
+			}
+			return nil
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT :tenant AS T").
+		AddQuery("SELECT :tenant AS T, :id AS ID").
+		WithValues(map[string]interface{}{"id": 1}).
+		AddQuery("SELECT :tenant AS T").
+		WithValues(map[string]interface{}{"tenant": "explicit"}).
+		AddStatement("UPDATE TEMP SET VAL = VAL WHERE ID = :id AND :tenant = 'acme'").
+		WithValues(map[string]interface{}{"id": 1}).
+		WithValues(map[string]interface{}{"id": 4}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), tenantKey{}, "acme")
+	res, _, err := client.SendWithContext(ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Results[0].ResultSet[0]["T"] != "acme" || res.Results[1].ResultSet[0]["T"] != "acme" {
+		t.Error("the tenant was not injected")
+	}
+	if res.Results[2].ResultSet[0]["T"] != "explicit" {
+		t.Error("the explicit value was overridden")
+	}
+	if !reflect.DeepEqual(res.Results[3].RowsUpdatedBatch, []int64{1, 1}) {
+		t.Error("the tenant was not injected in the batch")
+	}
+
+	var sent struct {
+		Transaction []map[string]interface{} `json:"transaction"`
+	}
+	if err = json.Unmarshal(sentBody(t, request), &sent); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sent.Transaction[0]["values"]; ok {
+		t.Error("the request was modified")
+	}
+}
+
+func TestResponseClone(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		WithOrderedRows().
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT * FROM TEMP WHERE ID IN (1, 4) ORDER BY ID").
+		AddStatement("UPDATE TEMP SET VAL = VAL WHERE ID = 1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone := res.Clone()
+	if !reflect.DeepEqual(res, clone) {
+		t.Fatal("the clone differs from the original")
+	}
+
+	clone.Results[0].ResultSet[0]["VAL"] = "CHANGED"
+	clone.Results[0].ResultSet = append(clone.Results[0].ResultSet, map[string]interface{}{})
+	*clone.Results[1].RowsUpdated = 42
+	clone.Results[0].Columns[0].Name = "CHANGED"
+
+	if res.Results[0].ResultSet[0]["VAL"] != "ONE" || len(res.Results[0].ResultSet) != 2 {
+		t.Error("the records of the original were modified")
+	}
+	if v, _ := res.Results[0].OrderedResultSet[0].Get("VAL"); v != "ONE" {
+		t.Error("the ordered records of the original were modified")
+	}
+	if v, _ := clone.Results[0].OrderedResultSet[0].Get("VAL"); v != "CHANGED" {
+		t.Error("the ordered records of the clone don't share the records")
+	}
+	if *res.Results[1].RowsUpdated != 1 || res.Results[0].Columns[0].Name != "ID" {
+		t.Error("the original was modified")
+	}
+}
+
+func TestQueryPaged(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := make([]map[string]interface{}, 23)
+	for i := range rows {
+		rows[i] = map[string]interface{}{"id": i}
+	}
+	request, err := ws4.NewRequestBuilder().
+		AddStatement("CREATE TABLE PAGED (ID INT PRIMARY KEY, GRP TEXT)").
+		AddBatchInsert("INSERT INTO PAGED (ID, GRP) VALUES (:id, 'A')", rows).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, sql := range []string{
+		"SELECT ID FROM PAGED WHERE GRP = :grp ORDER BY ID;",
+		"SELECT * FROM (SELECT ID FROM PAGED WHERE GRP = :grp ORDER BY ID {{PAGE}}) ORDER BY ID",
+	} {
+		it, err := client.QueryPaged(context.Background(), sql, map[string]interface{}{"grp": "A"}, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int
+		for it.Next() {
+			ids = append(ids, int(it.Row()["ID"].(float64)))
+		}
+		if it.Err() != nil {
+			t.Fatal(it.Err())
+		}
+		if len(ids) != 23 {
+			t.Fatalf("%d records, expected 23", len(ids))
+		}
+		for i, id := range ids {
+			if id != i {
+				t.Errorf("record #%d has ID %d", i, id)
+			}
+		}
+		if it.Next() {
+			t.Error("Next() after the end returned true")
+		}
+	}
+
+	it, err := client.QueryPaged(context.Background(), "SELECT * FROM NOT_THERE", nil, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.Next() || it.Err() == nil {
+		t.Error("the error was not reported")
+	}
+
+	if _, err = client.QueryPaged(context.Background(), "SELECT ID FROM PAGED", nil, 0); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestAuthTokenProvider(t *testing.T) {
+	var auths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths = append(auths, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, "Unauthorized")
+			return
+		}
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	defer srv.Close()
+
+	var refreshes int
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithAuthTokenProvider(func(ctx context.Context) (string, error) {
+			if ws4.IsTokenRefresh(ctx) {
+				refreshes++
+				return "fresh", nil
+			}
+			return "expired", nil
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT 1").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = client.Send(request); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(auths, []string{"Bearer expired", "Bearer fresh"}) || refreshes != 1 {
+		t.Errorf("unexpected authorizations: %v", auths)
+	}
+
+	failing, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithAuthTokenProvider(func(ctx context.Context) (string, error) {
+			return "", errors.New("no token")
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = failing.Send(request); err == nil || !strings.Contains(err.Error(), "no token") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err = ws4.NewClientBuilder().WithURL(srv.URL).WithAuthTokenProvider(nil).Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestEncoderOnBatch(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().
+		AddStatement("CREATE TABLE ENC_BATCH (ID INT PRIMARY KEY, VAL TEXT)").
+		AddBatchInsert("INSERT INTO ENC_BATCH (ID, VAL) VALUES (:id, :val)", []map[string]interface{}{
+			{"id": 1, "val": "uno"},
+			{"id": 2, "val": "due"},
+			{"id": 3, "val": "tre"},
+		}).
+		WithEncoder("secret", "val").
+		AddQuery("SELECT ID, VAL FROM ENC_BATCH ORDER BY ID").
+		AddQuery("SELECT ID, VAL FROM ENC_BATCH ORDER BY ID").
+		WithDecoder("secret", "VAL").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, val := range []string{"uno", "due", "tre"} {
+		if res.Results[2].ResultSet[i]["VAL"] == val {
+			t.Errorf("batch item #%d was not encoded", i)
+		}
+		if res.Results[3].ResultSet[i]["VAL"] != val {
+			t.Errorf("batch item #%d was not decoded to '%s'", i, val)
+		}
+	}
+
+	_, err = ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO ENC_BATCH (ID, VAL) VALUES (:id, :val)").
+		WithEncoder("secret", "val").
+		WithValues(map[string]interface{}{"id": 4, "val": "quattro"}).
+		WithValues(map[string]interface{}{"id": 5, "value": "cinque"}).
+		Build()
+	if err == nil || !strings.Contains(err.Error(), "batch item #1") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestTx(t *testing.T) {
+	var body []byte
+	srv := captureServer(t, `{"results":[{"success":true,"rowsUpdated":1},{"success":true,"resultSet":[{"N":1}]}]}`, &body)
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := client.Begin()
+	tx.Exec("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)", map[string]interface{}{"id": 50, "val": "a"})
+	idx := tx.Query("SELECT COUNT(*) AS N FROM TEMP WHERE ID = :id", map[string]interface{}{"id": 50})
+	res, err := tx.Commit(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx != 1 || res.Results[idx].ResultSet[0]["N"] != float64(1) {
+		t.Error("the index of the query is wrong")
+	}
+
+	expected, err := ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 50, "val": "a"}).
+		AddQuery("SELECT COUNT(*) AS N FROM TEMP WHERE ID = :id").
+		WithValues(map[string]interface{}{"id": 50}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != string(sentBody(t, expected)) {
+		t.Error("the transaction was not sent as a single request")
+	}
+	if _, err = tx.Commit(context.Background()); !errors.Is(err, ws4.ErrTxDone) {
+		t.Error("a second commit did not fail")
+	}
+
+	body = nil
+	tx = client.Begin()
+	tx.Exec("DELETE FROM TEMP", nil)
+	tx.Rollback()
+	if _, err = tx.Commit(context.Background()); !errors.Is(err, ws4.ErrTxDone) {
+		t.Error("a commit after the rollback did not fail")
+	}
+	if body != nil {
+		t.Error("the rolled back transaction was sent")
+	}
+
+	tx = client.Begin()
+	tx.Exec("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)", 42)
+	if _, err = tx.Commit(context.Background()); err == nil {
+		t.Error("invalid values did not fail")
+	}
+}
+
+func TestZeroForNilRowsUpdated(t *testing.T) {
+	var body []byte
+	srv := captureServer(t, `{"results":[{"success":true},{"success":true,"rowsUpdated":0},{"success":true,"resultSet":[]}]}`, &body)
+
+	request, err := ws4.NewRequestBuilder().
+		AddStatement("UPDATE TEMP SET VAL = 'X' WHERE ID = -1").
+		AddStatement("UPDATE TEMP SET VAL = 'X' WHERE ID = -2").
+		AddQuery("SELECT * FROM TEMP WHERE ID = -1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Results[0].RowsUpdated != nil || *res.Results[1].RowsUpdated != 0 {
+		t.Error("the counts are not reported as sent by the server")
+	}
+
+	client, err = ws4.NewClientBuilder().WithURL(srv.URL).WithZeroForNilRowsUpdated().Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err = client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Results[0].RowsUpdated == nil || *res.Results[0].RowsUpdated != 0 || *res.Results[1].RowsUpdated != 0 {
+		t.Error("the missing count is not 0")
+	}
+	if res.Results[2].RowsUpdated != nil {
+		t.Error("the query has a count")
+	}
+}
+
+func TestConcurrentSends(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb2").
+		WithInlineAuth("myUser1", "myHotPassword").
+		WithResponseCache(time.Minute, 10).
+		WithRetries(2).
+		WithBackoffJitter(0.1).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT VAL FROM TEMP WHERE ID = :id").
+		WithValues(map[string]interface{}{"id": 4}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			res, _, err := client.Send(shared)
+			if err == nil && res.Results[0].ResultSet[0]["VAL"] != "FOUR" {
+				err = errors.New("unexpected result for the shared request")
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			req, err := ws4.NewRequestBuilder().
+				AddStatement("UPDATE TEMP SET VAL = VAL WHERE ID = :id").
+				WithValues(map[string]interface{}{"id": i}).
+				Build()
+			if err == nil {
+				_, _, err = client.WithDatabase("mydb2").Send(req)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if bytes.Contains(sentBody(t, shared), []byte("myHotPassword")) {
+		t.Error("the credentials were stored in the request")
+	}
+}
+
+// Runs a query that returns 100k records, from a fake server.
+func benchmarkLargeResultSet(b *testing.B, cb *ws4.ClientBuilder) {
+	var sb strings.Builder
+	sb.WriteString(`{"results":[{"success":true,"resultSet":[`)
+	for i := 0; i < 100000; i++ {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, `{"ID":%d,"VAL":"value %d"}`, i, i)
+	}
+	sb.WriteString(`]}]}`)
+	body := sb.String()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	client, err := cb.WithURL(srv.URL).Build()
+	if err != nil {
+		b.Fatal(err)
+	}
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, _, err := client.Send(request)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(res.Results[0].ResultSet) != 100000 {
+			b.Fatal("unexpected number of records")
+		}
+	}
+}
+
+func BenchmarkLargeResultSet(b *testing.B) {
+	benchmarkLargeResultSet(b, ws4.NewClientBuilder())
+}
+
+func BenchmarkLargeResultSetWithExpectedRows(b *testing.B) {
+	benchmarkLargeResultSet(b, ws4.NewClientBuilder().WithExpectedRows(100000))
+}
+
+func TestScanOne(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT ID, VAL FROM TEMP WHERE ID = 4").
+		AddQuery("SELECT ID, VAL FROM TEMP WHERE ID = -1").
+		AddQuery("SELECT ID, VAL FROM TEMP WHERE ID IN (1, 4) ORDER BY ID").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rec temp
+	if err = res.Results[0].ScanOne(&rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.ID != 4 || *rec.Val != "FOUR" {
+		t.Error("the record was not decoded")
+	}
+	if err = res.Results[1].ScanOne(&rec); !errors.Is(err, ws4.ErrNoRows) {
+		t.Errorf("unexpected error for zero rows: %v", err)
+	}
+	if err = res.Results[2].ScanOne(&rec); !errors.Is(err, ws4.ErrTooManyRows) {
+		t.Errorf("unexpected error for two rows: %v", err)
+	}
+	if err = res.Results[2].ScanFirst(&rec); err != nil || rec.ID != 1 {
+		t.Errorf("the first record was not decoded: %v", err)
+	}
+	if err = res.Results[0].ScanOne(rec); err == nil {
+		t.Error("a non-pointer did not fail")
+	}
+}
+
+func TestPathPrefixAndQueryParams(t *testing.T) {
+	var uri string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uri = r.URL.RequestURI()
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	defer srv.Close()
+	host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	var port int
+	fmt.Sscan(portStr, &port)
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT 1").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := ws4.NewClientBuilder().
+		WithPathPrefix("/api/v1/").
+		WithQueryParam("tenant", "a b").
+		WithURLComponents(ws4.PROTOCOL_HTTP, host, port, "my db").
+		WithQueryParam("route", "x&y").
+		WithQueryParam("tenant", "c").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Fatal(err)
+	}
+	if uri != "/api/v1/my%20db?route=x%26y&tenant=a+b&tenant=c" {
+		t.Errorf("unexpected URI: %s", uri)
+	}
+
+	if _, _, err = client.WithDatabase("other").Send(request); err != nil {
+		t.Fatal(err)
+	}
+	if uri != "/api/v1/other?route=x%26y&tenant=a+b&tenant=c" {
+		t.Errorf("unexpected URI for the derived client: %s", uri)
+	}
+
+	client, err = ws4.NewClientBuilder().
+		WithURL(srv.URL+"/db?v=1").
+		WithQueryParam("w", "2").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Fatal(err)
+	}
+	if uri != "/db?v=1&w=2" {
+		t.Errorf("unexpected URI with an existing query: %s", uri)
+	}
+}
+
+func TestPerCallInlineCredentials(t *testing.T) {
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT VAL FROM TEMP WHERE ID = 4").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	inline, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb2").
+		WithInlineAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = inline.SendWithContext(ctx, request); err != nil {
+		t.Error(err)
+	}
+	if _, code, _ := inline.SendWithContext(ctx, request, ws4.WithoutInlineCredentials()); code != 401 {
+		t.Errorf("without credentials the code is %d, expected 401", code)
+	}
+	if _, _, err = inline.SendWithContext(ctx, request); err != nil {
+		t.Error("the option leaked to the next call")
+	}
+
+	noAuth, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb2").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, code, _ := noAuth.SendWithContext(ctx, request); code != 401 {
+		t.Errorf("without auth the code is %d, expected 401", code)
+	}
+	if _, _, err = noAuth.SendWithContext(ctx, request, ws4.WithInlineCredentials("myUser1", "myHotPassword")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProblemJSON(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT 1").
+		AddStatement("INSERT INTO NOT_THERE VALUES (1)").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = client.Send(request)
+	var wserr ws4.WsError
+	if !errors.As(err, &wserr) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var problem map[string]interface{}
+	if err = json.Unmarshal(wserr.ToProblemJSON(), &problem); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"type":       "about:blank",
+		"title":      "Internal Server Error",
+		"status":     float64(500),
+		"detail":     wserr.Msg,
+		"requestIdx": float64(1),
+		"category":   "SQL",
+	}
+	if !reflect.DeepEqual(problem, expected) {
+		t.Errorf("unexpected problem document: %v", problem)
+	}
+}
+
+func TestHTTPMethod(t *testing.T) {
+	var method string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method = r.Method
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	defer srv.Close()
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT 1").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ set, expected string }{{"", "POST"}, {"put", "PUT"}, {"PATCH", "PATCH"}} {
+		cb := ws4.NewClientBuilder().WithURL(srv.URL)
+		if tc.set != "" {
+			cb.WithHTTPMethod(tc.set)
+		}
+		client, err := cb.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = client.Send(request); err != nil {
+			t.Fatal(err)
+		}
+		if method != tc.expected {
+			t.Errorf("method is %s, expected %s", method, tc.expected)
+		}
+	}
+
+	if _, err = ws4.NewClientBuilder().WithURL(srv.URL).WithHTTPMethod("BREW").Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestRequestMutator(t *testing.T) {
+	var signature string
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		signature = r.Header.Get("X-Signature")
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	defer srv.Close()
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT 1").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithRequestMutator(func(r *http.Request) error {
+			body, err := r.GetBody()
+			if err != nil {
+				return err
+			}
+			b, err := io.ReadAll(body)
+			if err != nil {
+				return err
+			}
+			r.Header.Set("X-Signature", fmt.Sprintf("%d", len(b)))
+			return nil
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Fatal(err)
+	}
+	if signature != fmt.Sprintf("%d", len(sentBody(t, request))) {
+		t.Errorf("unexpected signature: %s", signature)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	failing, err := ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithRequestMutator(func(r *http.Request) error {
+			return errors.New("cannot sign")
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = failing.Send(request); err == nil || err.Error() != "cannot sign" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if atomic.LoadInt32(&calls) != 0 {
+		t.Error("the request was sent")
+	}
+}
+
+func TestExpandIn(t *testing.T) {
+	sql, values := ws4.ExpandIn("SELECT * FROM TEMP WHERE ID IN (:ids) AND VAL <> ':ids' AND :idsx = 1", ":ids", []interface{}{1, 4, 7})
+	if sql != "SELECT * FROM TEMP WHERE ID IN (:ids0, :ids1, :ids2) AND VAL <> ':ids' AND :idsx = 1" {
+		t.Errorf("unexpected SQL: %s", sql)
+	}
+	if !reflect.DeepEqual(values, map[string]interface{}{"ids0": 1, "ids1": 4, "ids2": 7}) {
+		t.Errorf("unexpected values: %v", values)
+	}
+
+	sql, values = ws4.ExpandIn("SELECT * FROM TEMP WHERE ID IN (:ids)", "ids", []interface{}{4})
+	if sql != "SELECT * FROM TEMP WHERE ID IN (:ids0)" || !reflect.DeepEqual(values, map[string]interface{}{"ids0": 4}) {
+		t.Errorf("unexpected expansion of a single value: %s, %v", sql, values)
+	}
+
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		ids   []interface{}
+		count float64
+	}{{nil, 0}, {[]interface{}{4}, 1}, {[]interface{}{1, 4, 999}, 2}} {
+		sql, values := ws4.ExpandIn("SELECT COUNT(*) AS N FROM TEMP WHERE ID IN (:ids)", ":ids", tc.ids)
+		count, err := client.QueryScalar(context.Background(), sql, values)
+		if err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+		if count != tc.count {
+			t.Errorf("%s: count is %v, expected %v", sql, count, tc.count)
+		}
+	}
+}
+
+func TestRedirectDroppingBody(t *testing.T) {
+	var targetCalls int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/moved", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/target", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/target", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&targetCalls, 1)
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL + "/moved").WithRetries(3).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = client.Send(request)
+	if !errors.Is(err, ws4.ErrRedirectDroppedBody) || !strings.Contains(err.Error(), "/target") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if atomic.LoadInt32(&targetCalls) != 0 {
+		t.Error("the request without body was sent")
+	}
+
+	// a custom http.Client is used as is, but the error is detected after the fact
+	custom := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error { return nil }}
+	client, err = ws4.NewClientBuilder().WithURL(srv.URL + "/moved").WithHTTPClient(custom).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); !errors.Is(err, ws4.ErrRedirectDroppedBody) {
+		t.Errorf("unexpected error with a custom CheckRedirect: %v", err)
+	}
+
+	client, err = ws4.NewClientBuilder().
+		WithURL(srv.URL + "/moved").
+		WithRedirectPolicy(ws4.REDIRECT_POLICY_NEVER).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, code, err := client.Send(request)
+	var wserr ws4.WsError
+	if code != http.StatusMovedPermanently || !errors.As(err, &wserr) {
+		t.Errorf("the redirect was not returned: %d, %v", code, err)
+	}
+}
+
+func TestTransportReuseAcrossDatabases(t *testing.T) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT 1").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		isolated bool
+		conns    int32
+	}{{false, 1}, {true, 3}} {
+		atomic.StoreInt32(&conns, 0)
+		cb := ws4.NewClientBuilder().WithURL(srv.URL + "/db1")
+		if tc.isolated {
+			cb.WithIsolatedTransport()
+		}
+		client, err := cb.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		derived2, derived3 := client.WithDatabase("db2"), client.WithDatabase("db3")
+		for i := 0; i < 3; i++ {
+			for _, c := range []*ws4.Client{client, derived2, derived3} {
+				if _, _, err = c.Send(request); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if (derived2.HTTPClient() == client.HTTPClient()) == tc.isolated {
+			t.Errorf("isolated: %t, but the http.Client sharing is wrong", tc.isolated)
+		}
+		if n := atomic.LoadInt32(&conns); n != tc.conns {
+			t.Errorf("isolated: %t, %d connections, expected %d", tc.isolated, n, tc.conns)
+		}
+	}
+}
+
+func TestAllRows(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT VAL FROM TEMP WHERE ID = 4").
+		AddStatement("UPDATE TEMP SET VAL = VAL WHERE ID = 1").
+		AddQuery("SELECT 'A' AS VAL UNION ALL SELECT 'B' ORDER BY 1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var vals []interface{}
+	for _, row := range res.AllRows() {
+		vals = append(vals, row["VAL"])
+	}
+	if !reflect.DeepEqual(vals, []interface{}{"FOUR", "A", "B"}) {
+		t.Errorf("unexpected rows: %v", vals)
+	}
+}
+
+func TestRequestMetadata(t *testing.T) {
+	meta := map[string]interface{}{"caller": "billing", "traceId": "abc"}
+	request, err := ws4.NewRequestBuilder().
+		WithRequestMetadata(meta).
+		AddQuery("SELECT * FROM TEMP").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta["caller"] = "changed"
+
+	var sent map[string]interface{}
+	if err = json.Unmarshal(sentBody(t, request), &sent); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sent["metadata"], map[string]interface{}{"caller": "billing", "traceId": "abc"}) {
+		t.Errorf("unexpected metadata: %v", sent["metadata"])
+	}
+
+	if _, err = ws4.NewRequestBuilder().WithRequestMetadata(nil).AddQuery("SELECT 1").Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+
+	// ignored by the server
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+}
+
+type user struct {
+	ID   int64  `ws4:"id"`
+	Name string `ws4:"val"`
+}
+
+func TestStructBatch(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := []user{{ID: 881, Name: "ANNA"}, {ID: 882, Name: "BOB"}, {ID: 883, Name: "CARL"}}
+	request, err := ws4.WithStructBatch(ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)"), users).
+		AddQuery("SELECT VAL FROM TEMP WHERE ID > 880 ORDER BY ID").
+		AddStatement("DELETE FROM TEMP WHERE ID > 880").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Results[0].RowsUpdatedBatch, []int64{1, 1, 1}) {
+		t.Errorf("unexpected batch: %v", res.Results[0].RowsUpdatedBatch)
+	}
+	var vals []interface{}
+	for _, row := range res.Results[1].ResultSet {
+		vals = append(vals, row["VAL"])
+	}
+	if !reflect.DeepEqual(vals, []interface{}{"ANNA", "BOB", "CARL"}) {
+		t.Errorf("unexpected rows: %v", vals)
+	}
+
+	// a single item is still a batch, and pointers are allowed
+	request, err = ws4.WithStructBatch(ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)"), []*user{{ID: 881, Name: "ANNA"}}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent struct {
+		Transaction []struct {
+			ValuesBatch []map[string]interface{}
+		}
+	}
+	if err = json.Unmarshal(sentBody(t, request), &sent); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent.Transaction[0].ValuesBatch) != 1 || sent.Transaction[0].ValuesBatch[0]["val"] != "ANNA" {
+		t.Errorf("unexpected batch: %v", sent.Transaction[0].ValuesBatch)
+	}
+
+	for _, rows := range []interface{}{nil, users[0], []int{1}, []user{}, []*user{nil}} {
+		if _, err = ws4.WithStructBatch(ws4.NewRequestBuilder().
+			AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)"), rows).
+			Build(); err == nil {
+			t.Errorf("did not fail for %v, but should have", rows)
+		}
+	}
+	if _, err = ws4.WithStructBatch(ws4.NewRequestBuilder().AddQuery("SELECT 1"), users).Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var calls int32
+	var retryAfter string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			io.WriteString(w, "Too Many Requests")
+			return
+		}
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[]}]}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newClient := func(maxRetryAfter time.Duration) *ws4.Client {
+		client, err := ws4.NewClientBuilder().
+			WithURL(srv.URL).
+			WithRetries(2).
+			WithBackoff(time.Millisecond, 10*time.Millisecond).
+			WithMaxRetryAfter(maxRetryAfter).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	for _, tc := range []struct {
+		name          string
+		retryAfter    string
+		maxRetryAfter time.Duration
+		min, max      time.Duration
+	}{
+		{"seconds", "1", ws4.DEFAULT_MAX_RETRY_AFTER, time.Second, 2 * time.Second},
+		{"capped date", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), 200 * time.Millisecond, 200 * time.Millisecond, time.Second},
+		{"ignored", "1", 0, 0, 500 * time.Millisecond},
+		{"invalid", "soon", ws4.DEFAULT_MAX_RETRY_AFTER, 0, 500 * time.Millisecond},
+	} {
+		atomic.StoreInt32(&calls, 0)
+		retryAfter = tc.retryAfter
+		start := time.Now()
+		_, code, err := newClient(tc.maxRetryAfter).Send(request)
+		elapsed := time.Since(start)
+		if err != nil || code != 200 {
+			t.Errorf("%s: unexpected result %d %v", tc.name, code, err)
+		}
+		if atomic.LoadInt32(&calls) != 2 {
+			t.Errorf("%s: 429 was not retried", tc.name)
+		}
+		if elapsed < tc.min || elapsed > tc.max {
+			t.Errorf("%s: waited %v", tc.name, elapsed)
+		}
+	}
+
+	// without retries, the wait is reported in the error
+	atomic.StoreInt32(&calls, 0)
+	retryAfter = "7"
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, code, err := client.Send(request)
+	var wserr ws4.WsError
+	if !errors.As(err, &wserr) || code != http.StatusTooManyRequests || wserr.RetryAfter != 7*time.Second {
+		t.Errorf("unexpected error: %d %+v", code, err)
+	}
+
+	if _, err = ws4.NewClientBuilder().WithURL(srv.URL).WithMaxRetryAfter(-1).Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestStatementTimeout(t *testing.T) {
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT * FROM TEMP").
+		AddStatement("DELETE FROM TEMP WHERE ID = 999").
+		WithStatementTimeout(1500 * time.Millisecond).
+		AddQuery("SELECT 1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// not supported by the default profile
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); !errors.Is(err, ws4.ErrStatementTimeoutUnsupported) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	var body []byte
+	srv := captureServer(t, `{"results":[]}`, &body)
+	client, err = ws4.NewClientBuilder().
+		WithURL(srv.URL).
+		WithServerProfile(ws4.PROFILE_V0_11.WithStatementTimeouts()).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Fatal(err)
+	}
+	var sent struct {
+		Transaction []map[string]interface{}
+	}
+	if err = json.Unmarshal(body, &sent); err != nil {
+		t.Fatal(err)
+	}
+	for i, item := range sent.Transaction {
+		timeout, ok := item["timeout"]
+		if i == 1 && timeout != float64(1500) {
+			t.Errorf("unexpected timeout: %v", timeout)
+		} else if i != 1 && ok {
+			t.Errorf("node %d has a timeout", i)
+		}
+	}
+
+	if _, err = ws4.NewRequestBuilder().AddQuery("SELECT 1").WithStatementTimeout(time.Microsecond).Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestStreamInsert(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := make(chan map[string]interface{})
+	go func() {
+		defer close(rows)
+		for i := 0; i < 5000; i++ {
+			rows <- map[string]interface{}{"id": 10000 + i, "val": fmt.Sprint(i)}
+		}
+	}()
+
+	results, err := client.StreamInsert(context.Background(), "INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)", rows, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, inserted := 0, int64(0)
+	for res := range results {
+		if res.Err != nil {
+			t.Fatal(res.Err)
+		}
+		if res.Offset != chunks*500 || res.Rows != 500 || len(res.RowsUpdated) != 500 {
+			t.Errorf("unexpected result: offset %d, rows %d", res.Offset, res.Rows)
+		}
+		for _, n := range res.RowsUpdated {
+			inserted += n
+		}
+		chunks++
+	}
+	if chunks != 10 || inserted != 5000 {
+		t.Errorf("unexpected totals: %d chunks, %d rows", chunks, inserted)
+	}
+
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT COUNT(*) AS CNT, MIN(ID) AS MN, MAX(ID) AS MX FROM TEMP WHERE ID >= 10000").
+		AddStatement("DELETE FROM TEMP WHERE ID >= 10000").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	row := res.Results[0].ResultSet[0]
+	if row["CNT"] != float64(5000) || row["MN"] != float64(10000) || row["MX"] != float64(14999) {
+		t.Errorf("unexpected rows in the db: %v", row)
+	}
+
+	// a partial last chunk, and a failing one that doesn't stop the stream
+	rows = make(chan map[string]interface{}, 5)
+	for _, id := range []int{20000, 20000, 20001, 20002, 20003} {
+		rows <- map[string]interface{}{"id": id, "val": "X"}
+	}
+	close(rows)
+	results, err = client.StreamInsert(context.Background(), "INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)", rows, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []ws4.BatchResult
+	for res := range results {
+		got = append(got, res)
+	}
+	if len(got) != 3 || got[0].Err == nil || got[1].Err != nil || got[2].Rows != 1 || got[2].Offset != 4 {
+		t.Errorf("unexpected results: %+v", got)
+	}
+	request, err = ws4.NewRequestBuilder().AddStatement("DELETE FROM TEMP WHERE ID >= 20000").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = client.StreamInsert(context.Background(), "INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)", rows, 0); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestResponseEqual(t *testing.T) {
+	one := int64(1)
+	alsoOne := int64(1)
+	two := int64(2)
+	base := func() *ws4.Response {
+		return &ws4.Response{Results: []ws4.ResponseItem{
+			{Success: true, ResultSet: []map[string]interface{}{{"ID": float64(1), "VAL": "ONE", "N": nil}}},
+			{Success: true, RowsUpdated: &one},
+			{Success: true, RowsUpdatedBatch: []int64{1, 0}},
+			{Success: false, Error: "boom"},
+		}}
+	}
+
+	other := base()
+	other.Results[0].ResultSet[0]["ID"] = 1
+	other.Results[1].RowsUpdated = &alsoOne
+	if d := base().Diff(other); d != "" {
+		t.Errorf("unexpected diff: %s", d)
+	}
+	if !base().Equal(other) {
+		t.Error("responses are not equal")
+	}
+
+	// numeric nuances
+	for _, tc := range []struct {
+		a, b  interface{}
+		equal bool
+	}{
+		{float64(1), int64(1), true},
+		{float64(1), json.Number("1"), true},
+		{json.Number("1.0"), uint8(1), true},
+		{float64(1.5), json.Number("1.5"), true},
+		{float64(1.5), 1, false},
+		{json.Number("9007199254740993"), float64(9007199254740992), false},
+		{int64(9007199254740993), json.Number("9007199254740993"), true},
+		{"1", 1, false},
+		{nil, 0, false},
+	} {
+		a, b := base(), base()
+		a.Results[0].ResultSet[0]["N"] = tc.a
+		b.Results[0].ResultSet[0]["N"] = tc.b
+		if a.Equal(b) != tc.equal {
+			t.Errorf("%#v == %#v should be %t", tc.a, tc.b, tc.equal)
+		}
+	}
+
+	for _, tc := range []struct {
+		change func(r *ws4.Response)
+		diff   string
+	}{
+		{func(r *ws4.Response) { r.Results = r.Results[:3] }, "len(Results): 4 != 3"},
+		{func(r *ws4.Response) { r.Results[0].ResultSet[0]["VAL"] = "UNO" }, `Results[0].ResultSet[0]["VAL"]: "ONE" != "UNO"`},
+		{func(r *ws4.Response) { delete(r.Results[0].ResultSet[0], "N") }, `Results[0].ResultSet[0]["N"]: present != missing`},
+		{func(r *ws4.Response) { r.Results[0].ResultSet = nil }, "Results[0].ResultSet: non-nil != nil"},
+		{func(r *ws4.Response) { r.Results[1].RowsUpdated = &two }, "Results[1].RowsUpdated: 1 != 2"},
+		{func(r *ws4.Response) { r.Results[1].RowsUpdated = nil }, "Results[1].RowsUpdated: non-nil != nil"},
+		{func(r *ws4.Response) { r.Results[2].RowsUpdatedBatch[1] = 1 }, "Results[2].RowsUpdatedBatch[1]: 0 != 1"},
+		{func(r *ws4.Response) { r.Results[3].Error = "bang" }, `Results[3].Error: "boom" != "bang"`},
+		{func(r *ws4.Response) { r.Results[3].Success = true }, "Results[3].Success: false != true"},
+	} {
+		other := base()
+		tc.change(other)
+		if d := base().Diff(other); d != tc.diff {
+			t.Errorf("unexpected diff: %s, expected %s", d, tc.diff)
+		}
+		if base().Equal(other) {
+			t.Errorf("responses should differ by %s", tc.diff)
+		}
+	}
+
+	var nilResponse *ws4.Response
+	if nilResponse.Equal(base()) || !nilResponse.Equal(nil) {
+		t.Error("unexpected comparison with nil")
+	}
+}
+
+func TestResponseSummary(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT * FROM TEMP WHERE ID IN (1, 4)").
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 891, "val": "A"}).
+		WithValues(map[string]interface{}{"id": 892, "val": "B"}).
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (1, 'DUP')").
+		WithNoFail().
+		AddQuery("SELECT * FROM NO_SUCH_TABLE").
+		WithNoFail().
+		AddStatement("DELETE FROM TEMP WHERE ID > 890").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := ws4.ResponseSummary{Succeeded: 3, Failed: 2, RowsAffected: 4, RowsReturned: 2}
+	if summary := res.Summary(); summary != expected {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+}
+
+func TestAddUpsert(t *testing.T) {
+	request, err := ws4.NewRequestBuilder().
+		AddUpsert("TEMP", []string{"ID"}, map[string]interface{}{"VAL": "UNO", "ID": 1}).
+		AddUpsert("MY \"TABLE\"", []string{"b", "a"}, map[string]interface{}{"a": 1, "b": 2, "order": "x"}).
+		AddUpsert("KEYS", []string{"ID"}, map[string]interface{}{"ID": 1}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent struct {
+		Transaction []struct {
+			Statement string
+			Values    map[string]interface{}
+		}
+	}
+	if err = json.Unmarshal(sentBody(t, request), &sent); err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{
+		`INSERT INTO "TEMP" ("ID", "VAL") VALUES (:ID, :VAL) ON CONFLICT ("ID") DO UPDATE SET "VAL" = excluded."VAL"`,
+		`INSERT INTO "MY ""TABLE""" ("a", "b", "order") VALUES (:a, :b, :order) ON CONFLICT ("b", "a") DO UPDATE SET "order" = excluded."order"`,
+		`INSERT INTO "KEYS" ("ID") VALUES (:ID) ON CONFLICT ("ID") DO NOTHING`,
+	} {
+		if sent.Transaction[i].Statement != expected {
+			t.Errorf("unexpected SQL: %s", sent.Transaction[i].Statement)
+		}
+	}
+	if !reflect.DeepEqual(sent.Transaction[1].Values, map[string]interface{}{"a": float64(1), "b": float64(2), "order": "x"}) {
+		t.Errorf("unexpected values: %v", sent.Transaction[1].Values)
+	}
+
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err = ws4.NewRequestBuilder().
+		AddStatement(`CREATE TABLE UPS (A INT, B INT, "order" TEXT, PRIMARY KEY (A, B))`).
+		AddUpsert("UPS", []string{"A", "B"}, map[string]interface{}{"A": 1, "B": 1, "order": "first"}).
+		AddUpsert("UPS", []string{"A", "B"}, map[string]interface{}{"A": 1, "B": 2, "order": "other"}).
+		AddUpsert("UPS", []string{"A", "B"}, map[string]interface{}{"A": 1, "B": 1, "order": "second"}).
+		AddUpsert("TEMP", []string{"ID"}, map[string]interface{}{"ID": 4, "VAL": "QUATTRO"}).
+		AddQuery(`SELECT B, "order" AS O FROM UPS ORDER BY B`).
+		AddQuery("SELECT VAL FROM TEMP WHERE ID = 4").
+		AddUpsert("TEMP", []string{"ID"}, map[string]interface{}{"ID": 4, "VAL": "FOUR"}).
+		AddStatement("DROP TABLE UPS").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := res.Results[5].ResultSet
+	if len(rs) != 2 || rs[0]["O"] != "second" || rs[1]["O"] != "other" {
+		t.Errorf("unexpected records: %v", rs)
+	}
+	if res.Results[6].ResultSet[0]["VAL"] != "QUATTRO" {
+		t.Errorf("unexpected records: %v", res.Results[6].ResultSet)
+	}
+
+	for _, rb := range []*ws4.RequestBuilder{
+		ws4.NewRequestBuilder().AddUpsert("", []string{"ID"}, map[string]interface{}{"ID": 1}),
+		ws4.NewRequestBuilder().AddUpsert("TEMP", nil, map[string]interface{}{"ID": 1}),
+		ws4.NewRequestBuilder().AddUpsert("TEMP", []string{"ID"}, nil),
+		ws4.NewRequestBuilder().AddUpsert("TEMP", []string{"ID"}, map[string]interface{}{"VAL": 1}),
+		ws4.NewRequestBuilder().AddUpsert("TEMP", []string{"ID", "ID"}, map[string]interface{}{"ID": 1}),
+		ws4.NewRequestBuilder().AddUpsert("TEMP", []string{"ID"}, map[string]interface{}{"ID": 1, "MY VAL": 1}),
+	} {
+		if _, err = rb.Build(); err == nil {
+			t.Error("did not fail, but should have")
+		}
+	}
+}
+
+func TestGlobalValues(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := ws4.NewRequestBuilder().
+		WithGlobalValues(map[string]interface{}{"tenant": "ACME"}).
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :tenant)").
+		WithValues(map[string]interface{}{"id": 901}).
+		WithValues(map[string]interface{}{"id": 902, "tenant": "OTHER"}).
+		AddQuery("SELECT ID FROM TEMP WHERE VAL = :tenant").
+		AddStatement("DELETE FROM TEMP WHERE VAL = :tenant OR ID > 900").
+		WithParamValidation().
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := res.Results[1].ResultSet
+	if len(rs) != 1 || rs[0]["ID"] != float64(901) {
+		t.Errorf("unexpected records: %v", rs)
+	}
+	if res.Results[2].TotalAffected() != 2 {
+		t.Errorf("unexpected deleted rows: %d", res.Results[2].TotalAffected())
+	}
+
+	if _, err = ws4.NewRequestBuilder().WithGlobalValues(nil).AddQuery("SELECT 1").Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestToSQLScript(t *testing.T) {
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT * FROM TEMP WHERE VAL = :val AND ':val' <> \"x:val\" -- :val\n").
+		WithValues(map[string]interface{}{"val": "it's"}).
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, @val);").
+		WithValues(map[string]interface{}{"id": 1, ":val": nil}).
+		WithValues(map[string]interface{}{"id": 2.5, "@val": true}).
+		WithValues(map[string]interface{}{"id": int64(9007199254740993), "val": ws4.Null}).
+		AddStatement("DELETE FROM TEMP").
+		WithNoFail().
+		AddStoredQuery("Q_BY_ID").
+		WithValues(map[string]interface{}{"id": 1}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	script, err := request.ToSQLScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `-- For inspection only: values are interpolated, not bound as parameters.
+BEGIN TRANSACTION;
+-- node #0
+SELECT * FROM TEMP WHERE VAL = 'it''s' AND ':val' <> "x:val" -- :val
+;
+-- node #1, batch item #0
+INSERT INTO TEMP (ID, VAL) VALUES (1, NULL);
+-- node #1, batch item #1
+INSERT INTO TEMP (ID, VAL) VALUES (2.5, 1);
+-- node #1, batch item #2
+INSERT INTO TEMP (ID, VAL) VALUES (9007199254740993, NULL);
+-- node #2, noFail
+DELETE FROM TEMP;
+-- node #3
+-- stored statement #Q_BY_ID, values: {"id":1}
+COMMIT;
+`
+	if script != expected {
+		t.Errorf("unexpected script:\n%s", script)
+	}
+
+	for _, values := range []map[string]interface{}{
+		{"other": 1},
+		{"val": []int{1, 2}},
+	} {
+		request, err = ws4.NewRequestBuilder().
+			AddQuery("SELECT * FROM TEMP WHERE VAL = :val").
+			WithValues(values).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = request.ToSQLScript(); err == nil {
+			t.Errorf("did not fail for %v, but should have", values)
+		}
+	}
+}
+
+func TestNewClientShortcuts(t *testing.T) {
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP WHERE ID = 1").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := ws4.NewClient("http://localhost:12321/mydb2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, code, err := client.Send(request); err == nil || code != http.StatusUnauthorized {
+		t.Errorf("unexpected result: %d %v", code, err)
+	}
+
+	client, err = ws4.NewClientWithBasicAuth("http://localhost:12321/mydb", "myUser1", "myHotPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Results[0].ResultSet[0]["VAL"] != "ONE" {
+		t.Errorf("unexpected records: %v", res.Results[0].ResultSet)
+	}
+
+	if _, err = ws4.NewClient(""); err == nil {
+		t.Error("did not fail, but should have")
+	}
+	if _, err = ws4.NewClientWithBasicAuth("", "myUser1", "myHotPassword"); err == nil {
+		t.Error("did not fail, but should have")
+	}
+	if _, err = ws4.NewClientWithBasicAuth("http://localhost:12321/mydb", "myUser1", ""); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestResponseItemValue(t *testing.T) {
+	ri := ws4.ResponseItem{
+		Success:   true,
+		ResultSet: []map[string]interface{}{{"ID": float64(1), "VAL": "ONE"}, {"ID": float64(4), "VAL": nil}},
+	}
+	if v, ok := ri.Value(0, "VAL"); !ok || v != "ONE" {
+		t.Errorf("unexpected value: %v %t", v, ok)
+	}
+	if v, ok := ri.Value(1, "VAL"); !ok || v != nil {
+		t.Errorf("unexpected value: %v %t", v, ok)
+	}
+	for _, idx := range []int{-1, 2} {
+		if _, ok := ri.Value(idx, "ID"); ok {
+			t.Errorf("row %d should be out of range", idx)
+		}
+	}
+	if _, ok := ri.Value(0, "MISSING"); ok {
+		t.Error("column should be missing")
+	}
+	if _, ok := (ws4.ResponseItem{}).Value(0, "ID"); ok {
+		t.Error("a statement has no values")
+	}
+}
+
+func TestResponseContentTypeCheck(t *testing.T) {
+	page := "<html><body>" + strings.Repeat("Please log in. ", 30) + "</body></html>"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, page)
+	}))
+	t.Cleanup(srv.Close)
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).WithResponseContentTypeCheck().Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, code, err := client.Send(request)
+	var cterr ws4.UnexpectedContentTypeError
+	if !errors.As(err, &cterr) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if code != 200 || cterr.Code != 200 || cterr.ContentType != "text/html; charset=utf-8" || cterr.BodySnippet != page[:ws4.MAX_BODY_SNIPPET] {
+		t.Errorf("unexpected error: %+v", cterr)
+	}
+	if !strings.Contains(err.Error(), "text/html") || !strings.Contains(err.Error(), "<html><body>Please log in.") {
+		t.Errorf("unexpected message: %s", err)
+	}
+
+	// the real server is fine
+	client, err = ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		WithResponseContentTypeCheck().
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddStatementPositional(t *testing.T) {
+	request, err := ws4.NewRequestBuilder().
+		AddStatementPositional("INSERT INTO TEMP (ID, VAL) VALUES (?, ? || '?' || \"?\") -- really?\n", 911, "A").
+		AddStatementPositional("DELETE FROM TEMP WHERE 0").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent struct {
+		Transaction []struct {
+			Statement string
+			Values    map[string]interface{}
+		}
+	}
+	if err = json.Unmarshal(sentBody(t, request), &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent.Transaction[0].Statement != "INSERT INTO TEMP (ID, VAL) VALUES (:p0, :p1 || '?' || \"?\") -- really?\n" {
+		t.Errorf("unexpected SQL: %s", sent.Transaction[0].Statement)
+	}
+	if !reflect.DeepEqual(sent.Transaction[0].Values, map[string]interface{}{"p0": float64(911), "p1": "A"}) {
+		t.Errorf("unexpected values: %v", sent.Transaction[0].Values)
+	}
+	if sent.Transaction[1].Values != nil {
+		t.Errorf("unexpected values: %v", sent.Transaction[1].Values)
+	}
+
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err = ws4.NewRequestBuilder().
+		AddStatementPositional("INSERT INTO TEMP (ID, VAL) VALUES (?, ? || '?')", 912, "B").
+		AddQuery("SELECT VAL FROM TEMP WHERE ID = 912").
+		AddStatementPositional("DELETE FROM TEMP WHERE ID = ? AND VAL = ?", 912, "B?").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := res.Results[1].Value(0, "VAL"); v != "B?" {
+		t.Errorf("unexpected value: %v", v)
+	}
+	if *res.Results[2].RowsUpdated != 1 {
+		t.Error("the record was not deleted")
+	}
+
+	for _, rb := range []*ws4.RequestBuilder{
+		ws4.NewRequestBuilder().AddStatementPositional("DELETE FROM TEMP WHERE ID = ?"),
+		ws4.NewRequestBuilder().AddStatementPositional("DELETE FROM TEMP WHERE ID = ?", 1, 2),
+		ws4.NewRequestBuilder().AddStatementPositional("DELETE FROM TEMP WHERE ID = ?1", 1),
+	} {
+		if _, err = rb.Build(); err == nil {
+			t.Error("did not fail, but should have")
+		}
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	var conns, requests int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[{"1":1}]}]}`)
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	client, err := ws4.NewClient(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Warmup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reused := false
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+	})
+	if _, _, err = client.SendWithContext(ctx, request); err != nil {
+		t.Fatal(err)
+	}
+	if !reused {
+		t.Error("the warmed up connection was not reused")
+	}
+	if atomic.LoadInt32(&conns) != 1 || atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("%d connections and %d requests", conns, requests)
+	}
+
+	// errors are reported, e.g. missing credentials
+	client, err = ws4.NewClient("http://localhost:12321/mydb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Warmup(context.Background()); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestErrorStatusPredicates(t *testing.T) {
+	for _, tc := range []struct {
+		code                                   int
+		server, client, unauthorized, notFound bool
+	}{
+		{400, false, true, false, false},
+		{401, false, true, true, false},
+		{403, false, true, true, false},
+		{404, false, true, false, true},
+		{429, false, true, false, false},
+		{500, true, false, false, false},
+		{503, true, false, false, false},
+		{302, false, false, false, false},
+	} {
+		wserr := ws4.WsError{RequestIdx: -1, Msg: "x", Code: tc.code}
+		// the category is set when the error is received
+		if tc.code == 404 {
+			wserr.Category = ws4.ERROR_CATEGORY_NOT_FOUND
+		}
+		if wserr.IsServerError() != tc.server || wserr.IsClientError() != tc.client ||
+			wserr.IsUnauthorized() != tc.unauthorized || wserr.IsNotFound() != tc.notFound {
+			t.Errorf("wrong predicates for %d", tc.code)
+		}
+	}
+
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "wrongPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT 1").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = client.Send(request)
+	var wserr ws4.WsError
+	if !errors.As(err, &wserr) || !wserr.IsUnauthorized() || !wserr.IsClientError() || wserr.IsServerError() {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestBatchResults(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := []map[string]interface{}{
+		{"id": 1, "val": "UNO"},
+		{"id": 999, "val": "NONE"},
+		{"id": 4, "val": "QUATTRO"},
+	}
+	request, err := ws4.NewRequestBuilder().
+		AddBatchInsert("UPDATE TEMP SET VAL = :val WHERE ID = :id", inputs).
+		AddBatchInsert("UPDATE TEMP SET VAL = :val WHERE ID = :id", []map[string]interface{}{
+			{"id": 1, "val": "ONE"},
+			{"id": 4, "val": "FOUR"},
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := res.Results[0].BatchResults(inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []int64{1, 0, 1} {
+		if results[i].RowsUpdated != expected || !reflect.DeepEqual(results[i].Input, inputs[i]) {
+			t.Errorf("unexpected result #%d: %+v", i, results[i])
+		}
+	}
+
+	if _, err = res.Results[0].BatchResults(inputs[:2]); err == nil {
+		t.Error("did not fail, but should have")
+	}
+	one := int64(1)
+	if _, err = (ws4.ResponseItem{Success: true, RowsUpdated: &one}).BatchResults(inputs[:1]); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+// Fails the test if, after a while, there are more goroutines than baseline; the idle
+// connections of the clients must be closed beforehand.
+func checkGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			buf = buf[:runtime.Stack(buf, true)]
+			t.Errorf("%d goroutines leaked:\n%s", runtime.NumGoroutine()-baseline, buf)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNoGoroutineLeaks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if bytes.Contains(body, []byte("SLOW")) {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+		io.WriteString(w, `{"results":[{"success":true,"rowsUpdatedBatch":[1,1]}]}`)
+	}))
+	defer srv.Close()
+
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).WithIsolatedTransport().Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline := runtime.NumGoroutine()
+
+	// SendBatch, cancelled by the parent while in flight
+	var reqs []*ws4.Request
+	for _, sql := range []string{"SELECT 1", "SELECT 'SLOW'", "SELECT 'SLOW'"} {
+		req, err := ws4.NewRequestBuilder().AddQuery(sql).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reqs = append(reqs, req)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	if _, err = client.SendBatch(ctx, reqs); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	cancel()
+	client.HTTPClient().CloseIdleConnections()
+	checkGoroutines(t, baseline)
+
+	// StreamInsert, abandoned by the consumer, with a producer that never closes the channel
+	rows := make(chan map[string]interface{})
+	ctx, cancel = context.WithCancel(context.Background())
+	results, err := client.StreamInsert(ctx, "INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)", rows, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows <- map[string]interface{}{"id": 1, "val": "A"}
+	rows <- map[string]interface{}{"id": 2, "val": "B"}
+	<-results
+	rows <- map[string]interface{}{"id": 3, "val": "C"}
+	rows <- map[string]interface{}{"id": 4, "val": "D"}
+	cancel()
+	for range results {
+	}
+	client.HTTPClient().CloseIdleConnections()
+	checkGoroutines(t, baseline)
+
+	// StreamInsert, cancelled while a chunk is in flight
+	rows = make(chan map[string]interface{})
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if results, err = client.StreamInsert(ctx, "INSERT INTO TEMP (ID, VAL) VALUES (:id, 'SLOW')", rows, 1); err != nil {
+		t.Fatal(err)
+	}
+	rows <- map[string]interface{}{"id": 1}
+	for res := range results {
+		if !errors.Is(res.Err, context.DeadlineExceeded) {
+			t.Errorf("unexpected error: %v", res.Err)
+		}
+	}
+	client.HTTPClient().CloseIdleConnections()
+	checkGoroutines(t, baseline)
+}
+
+func TestResponseValidator(t *testing.T) {
+	errEmpty := errors.New("empty result set")
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		WithResponseValidator(func(res *ws4.Response) error {
+			for i := range res.Results {
+				if res.Results[i].ResultSet != nil && len(res.Results[i].ResultSet) == 0 {
+					return fmt.Errorf("node #%d: %w", i, errEmpty)
+				}
+			}
+			return nil
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT * FROM TEMP WHERE ID = 1").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+
+	request, err = ws4.NewRequestBuilder().
+		AddQuery("SELECT * FROM TEMP WHERE ID = 1").
+		AddQuery("SELECT * FROM TEMP WHERE ID = 999").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, code, err := client.Send(request)
+	var verr ws4.ResponseValidationError
+	if !errors.As(err, &verr) || !errors.Is(err, errEmpty) || res != nil || code != 200 {
+		t.Errorf("unexpected result: %v %d %v", res, code, err)
+	}
+	if _, _, err = client.SendWithRetry(request, 2); !errors.Is(err, errEmpty) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// errors of the server are not validated
+	request, err = ws4.NewRequestBuilder().AddQuery("SELECT * FROM NO_SUCH_TABLE").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err == nil || errors.As(err, &verr) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err = ws4.NewClientBuilder().WithURL("http://localhost:12321/mydb").WithResponseValidator(nil).Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestStreamingRequestBody(t *testing.T) {
+	var bodies [][]byte
+	var chunked []bool
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		bodies = append(bodies, b)
+		chunked = append(chunked, len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked")
+		mu.Unlock()
+		io.WriteString(w, `{"results":[]}`)
+	}))
+	defer srv.Close()
+
+	request, err := ws4.NewRequestBuilder().
+		WithRequestMetadata(map[string]interface{}{"caller": "<etl>"}).
+		AddQuery("SELECT * FROM TEMP WHERE ID = :id").
+		WithValues(map[string]interface{}{"id": 1}).
+		AddBatchInsert("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)", []map[string]interface{}{
+			{"id": 2, "val": "B"},
+			{"id": 3, "val": nil},
+		}).
+		WithNoFail().
+		AddRaw(ws4.RequestItem{
+			Statement:   "INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)",
+			ValuesBatch: []map[string]interface{}{{"id": 4, "val": "D"}},
+			Extra:       map[string]interface{}{"valuesBatch": "ignored", "hint": 1},
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, streaming := range []bool{false, true} {
+		cb := ws4.NewClientBuilder().WithURL(srv.URL).WithInlineAuth("myUser1", "myHotPassword")
+		if streaming {
+			cb.WithStreamingRequestBody()
+		}
+		client, err := cb.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = client.Send(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buffered, streamed interface{}
+	if err = json.Unmarshal(bodies[0], &buffered); err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(bodies[1], &streamed); err != nil {
+		t.Fatalf("%s: %s", err, bodies[1])
+	}
+	if !reflect.DeepEqual(buffered, streamed) {
+		t.Errorf("streamed body differs:\n%s\n%s", bodies[0], bodies[1])
+	}
+	if chunked[0] || !chunked[1] {
+		t.Errorf("unexpected transfer encodings: %v", chunked)
+	}
+
+	// a large batch on the real server, with a redirect that resends the body
+	redirect := httptest.NewServer(http.RedirectHandler("http://localhost:12321/mydb2", http.StatusTemporaryRedirect))
+	defer redirect.Close()
+	client, err := ws4.NewClientBuilder().
+		WithURL(redirect.URL).
+		WithInlineAuth("myUser1", "myHotPassword").
+		WithStreamingRequestBody().
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := make([]map[string]interface{}, 2000)
+	for i := range rows {
+		rows[i] = map[string]interface{}{"id": 30000 + i, "val": strings.Repeat("x", 100)}
+	}
+	request, err = ws4.NewRequestBuilder().
+		AddBatchInsert("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)", rows).
+		AddQuery("SELECT COUNT(*) AS CNT FROM TEMP WHERE ID >= 30000").
+		AddStatement("DELETE FROM TEMP WHERE ID >= 30000").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := res.Results[1].Value(0, "CNT"); v != float64(2000) {
+		t.Errorf("unexpected count: %v", v)
+	}
+
+	for _, cb := range []*ws4.ClientBuilder{
+		ws4.NewClientBuilder().WithMaxRequestBytes(1000),
+		ws4.NewClientBuilder().WithMarshaller(&recordingMarshaller{}),
+		ws4.NewClientBuilder().WithServerProfile(ws4.NewServerProfile("custom", map[string]string{"valuesBatch": "batch"})),
+		ws4.NewClientBuilder().WithStableMarshalling(),
+	} {
+		if _, err = cb.WithURL(srv.URL).WithStreamingRequestBody().Build(); err == nil {
+			t.Error("did not fail, but should have")
+		}
+	}
+}
+
+func benchmarkRequestBody(b *testing.B, cb *ws4.ClientBuilder) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, `{"results":[{"success":true,"rowsUpdatedBatch":[]}]}`)
+	}))
+	defer srv.Close()
+
+	client, err := cb.WithURL(srv.URL).Build()
+	if err != nil {
+		b.Fatal(err)
+	}
+	rows := make([]map[string]interface{}, 100000)
+	for i := range rows {
+		rows[i] = map[string]interface{}{"id": i, "val": fmt.Sprintf("value %d", i)}
+	}
+	request, err := ws4.NewRequestBuilder().
+		AddBatchInsert("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)", rows).
+		Build()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := client.Send(request); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkBufferedRequestBody(b *testing.B) {
+	benchmarkRequestBody(b, ws4.NewClientBuilder())
+}
+
+func BenchmarkStreamingRequestBody(b *testing.B) {
+	benchmarkRequestBody(b, ws4.NewClientBuilder().WithStreamingRequestBody())
+}
+
+func TestConstraintViolations(t *testing.T) {
+	for _, tc := range []struct {
+		msg                       string
+		unique, notNull, foreignK bool
+	}{
+		{"UNIQUE constraint failed: TEMP.ID", true, false, false},
+		{"PRIMARY KEY must be unique", true, false, false},
+		{"column ID is not unique", true, false, false},
+		{"NOT NULL constraint failed: TEMP.VAL", false, true, false},
+		{"TEMP.VAL may not be NULL", false, true, false},
+		{"FOREIGN KEY constraint failed", false, false, true},
+		{"CHECK constraint failed: VAL", false, false, false},
+		{"no such table: NOPE", false, false, false},
+	} {
+		wserr := ws4.WsError{RequestIdx: 0, Msg: tc.msg, Code: 500}
+		if wserr.IsUniqueViolation() != tc.unique || wserr.IsNotNullViolation() != tc.notNull || wserr.IsForeignKeyViolation() != tc.foreignK {
+			t.Errorf("wrong classification of '%s'", tc.msg)
+		}
+	}
+
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		sql   string
+		check func(ws4.WsError) bool
+	}{
+		{"INSERT INTO TEMP (ID, VAL) VALUES (1, 'DUP')", ws4.WsError.IsUniqueViolation},
+		{"CREATE TABLE NN (ID INT NOT NULL); INSERT INTO NN (ID) VALUES (NULL)", ws4.WsError.IsNotNullViolation},
+	} {
+		rb := ws4.NewRequestBuilder()
+		for _, stmt := range strings.Split(tc.sql, "; ") {
+			rb.AddStatement(stmt)
+		}
+		request, err := rb.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = client.Send(request)
+		var wserr ws4.WsError
+		if !errors.As(err, &wserr) || !tc.check(wserr) {
+			t.Errorf("unexpected error for '%s': %v", tc.sql, err)
+		}
+	}
+}
+
+// Returns the URL of a server that was closed, so that connections are refused.
+func closedServerURL(t *testing.T) string {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	return srv.URL
+}
+
+func TestURLsFailover(t *testing.T) {
+	var calls [2]int32
+	newServer := func(i int) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls[i], 1)
+			body, _ := io.ReadAll(r.Body)
+			if bytes.Contains(body, []byte("FAIL")) {
+				w.WriteHeader(http.StatusInternalServerError)
+				io.WriteString(w, `{"reqIdx":0,"error":"near \"FAIL\": syntax error"}`)
+				return
+			}
+			io.WriteString(w, `{"results":[{"success":true,"resultSet":[{"PATH":"`+r.URL.Path+`"}]}]}`)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	srv1, srv2 := newServer(0), newServer(1)
+	down := closedServerURL(t)
+
+	client, err := ws4.NewClientBuilder().WithURLs(down+"/db", srv1.URL+"/db", srv2.URL+"/db").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT 1").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err = client.Send(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls[0] != 3 || calls[1] != 0 {
+		t.Errorf("unexpected calls: %v", calls)
+	}
+
+	// SQL errors don't cause a failover
+	failing, err := ws4.NewRequestBuilder().AddQuery("FAIL").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(failing); err == nil {
+		t.Error("did not fail, but should have")
+	}
+	if calls[0] != 4 || calls[1] != 0 {
+		t.Errorf("unexpected calls: %v", calls)
+	}
+
+	// when the preferred one goes down, the next one sticks; derived clients share it
+	srv1.Close()
+	if _, _, err = client.Send(request); err != nil {
+		t.Fatal(err)
+	}
+	derived := client.WithDatabase("other")
+	res, _, err := derived.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := res.Results[0].Value(0, "PATH"); v != "/other" {
+		t.Errorf("unexpected path: %v", v)
+	}
+	if calls[1] != 2 {
+		t.Errorf("unexpected calls: %v", calls)
+	}
+
+	// all down
+	client, err = ws4.NewClientBuilder().WithURLs(down, closedServerURL(t)).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, code, err := client.Send(request); err == nil || code != 0 {
+		t.Errorf("unexpected result: %d %v", code, err)
+	}
+
+	// the last of WithURL and WithURLs wins
+	client, err = ws4.NewClientBuilder().WithURLs(down, srv2.URL).WithURL(down).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err == nil {
+		t.Error("the URLs were not replaced by WithURL")
+	}
+	client, err = ws4.NewClientBuilder().WithURLs(down, srv2.URL).WithURLComponents(ws4.PROTOCOL_HTTP, "127.0.0.1", 1, "db").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err == nil {
+		t.Error("the URLs were not replaced by WithURLComponents")
+	}
+	client, err = ws4.NewClientBuilder().WithURL(down).WithURLs(down, srv2.URL).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = ws4.NewClientBuilder().WithURLs().Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+	if _, err = ws4.NewClientBuilder().WithURLs(srv2.URL, "").Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+// A Marshaller that writes the keys of the top-level objects in the (random) order of
+// iteration of Go maps.
+type unorderedMarshaller struct{}
+
+func (unorderedMarshaller) Marshal(v interface{}) ([]byte, error) {
+	return marshalUnordered(v)
+}
+
+func (unorderedMarshaller) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func marshalUnordered(v interface{}) ([]byte, error) {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(bs, &obj) != nil {
+		return bs, nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for k, raw := range obj {
+		if buf.Len() > 1 {
+			buf.WriteString(",")
+		}
+		key, _ := json.Marshal(k)
+		buf.Write(key)
+		buf.WriteString(":")
+		var arr []json.RawMessage
+		if json.Unmarshal(raw, &arr) == nil {
+			buf.WriteString("[")
+			for i, item := range arr {
+				if i > 0 {
+					buf.WriteString(",")
+				}
+				item, _ = marshalUnordered(decodeNumbers(item))
+				buf.Write(item)
+			}
+			buf.WriteString("]")
+			continue
+		}
+		raw, _ = marshalUnordered(decodeNumbers(raw))
+		buf.Write(raw)
+	}
+	buf.WriteString("}")
+	return buf.Bytes(), nil
+}
+
+func decodeNumbers(data []byte) interface{} {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	dec.Decode(&v)
+	return v
+}
+
+func TestStableMarshalling(t *testing.T) {
+	values := map[string]interface{}{}
+	for i := 0; i < 16; i++ {
+		values[fmt.Sprintf("k%02d", i)] = i
+	}
+	values["big"] = json.Number("12345678901234567890")
+	request, err := ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO T VALUES (:k00)").
+		WithValues(values).
+		WithValues(values).
+		WithRequestMetadata(values).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body []byte
+	srv := captureServer(t, `{"results":[]}`, &body)
+	for _, m := range []ws4.Marshaller{nil, unorderedMarshaller{}} {
+		cb := ws4.NewClientBuilder().WithURL(srv.URL).WithStableMarshalling()
+		if m != nil {
+			cb.WithMarshaller(m)
+		}
+		client, err := cb.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var first []byte
+		for i := 0; i < 10; i++ {
+			if _, _, err = client.Send(request); err != nil {
+				t.Fatal(err)
+			}
+			if i == 0 {
+				first = body
+			} else if !bytes.Equal(first, body) {
+				t.Fatalf("different bodies:\n%s\n%s", first, body)
+			}
+		}
+		if !bytes.Contains(first, []byte(`{"big":12345678901234567890,"k00":0,"k01":1,`)) {
+			t.Errorf("unexpected body: %s", first)
+		}
+	}
+}
+
+func TestReturnLastInsertID(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := ws4.NewRequestBuilder().
+		AddStatement("CREATE TABLE LID (ID INTEGER PRIMARY KEY, VAL TEXT UNIQUE)").
+		AddStatement("INSERT INTO LID (VAL) VALUES ('A')").
+		WithReturnLastInsertID().
+		AddStatement("INSERT INTO LID (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 10, "val": "B"}).
+		WithValues(map[string]interface{}{"id": 20, "val": "C"}).
+		WithReturnLastInsertID().
+		AddQuery("SELECT COUNT(*) AS N FROM LID").
+		AddStatement("INSERT INTO LID (VAL) VALUES ('A')").
+		WithNoFail().
+		WithReturnLastInsertID().
+		AddStatement("DROP TABLE LID").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.NodeCount() != 6 {
+		t.Errorf("unexpected node count: %d", request.NodeCount())
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Results) != 6 {
+		t.Fatalf("unexpected results: %d", len(res.Results))
+	}
+	if res.Results[0].LastInsertID != nil {
+		t.Errorf("unexpected id: %d", *res.Results[0].LastInsertID)
+	}
+	if id := res.Results[1].LastInsertID; id == nil || *id != 1 {
+		t.Errorf("unexpected id: %v", id)
+	}
+	if id := res.Results[2].LastInsertID; id == nil || *id != 20 {
+		t.Errorf("unexpected id: %v", id)
+	}
+	if res.Results[3].ResultSet[0]["N"] != float64(3) {
+		t.Errorf("unexpected records: %v", res.Results[3].ResultSet)
+	}
+	if res.Results[4].Success || res.Results[4].LastInsertID != nil {
+		t.Errorf("unexpected result: %+v", res.Results[4])
+	}
+
+	// the index of a failing node refers to the request as built
+	request, err = ws4.NewRequestBuilder().
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (100, 'X')").
+		WithReturnLastInsertID().
+		AddStatement("INSERT INTO NOPE VALUES (1)").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = client.Send(request)
+	var wserr ws4.WsError
+	if !errors.As(err, &wserr) || wserr.RequestIdx != 1 {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// returned by the server
+	var body []byte
+	srv := captureServer(t, `{"results":[{"success":true,"rowsUpdated":1,"lastInsertId":42}]}`, &body)
+	client, err = ws4.NewClientBuilder().WithURL(srv.URL).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err = ws4.NewRequestBuilder().AddStatement("INSERT INTO TEMP (VAL) VALUES ('X')").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err = client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := res.Results[0].LastInsertID; id == nil || *id != 42 {
+		t.Errorf("unexpected id: %v", id)
+	}
+
+	if _, err = ws4.NewRequestBuilder().AddQuery("SELECT 1").WithReturnLastInsertID().Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestValuesValidator(t *testing.T) {
+	errTooLong := errors.New("too long")
+	maxLen := func(key string, value interface{}) error {
+		if s, ok := value.(string); ok && len(s) > 5 {
+			return errTooLong
+		}
+		return nil
+	}
+
+	request, err := ws4.NewRequestBuilder().
+		WithValuesValidator(maxLen).
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 100, "val": "FIVE!"}).
+		AddQuery("SELECT * FROM TEMP WHERE ID = :id").
+		WithValues(map[string]interface{}{"id": 100}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if request.NodeCount() != 2 {
+		t.Errorf("unexpected node count: %d", request.NodeCount())
+	}
+
+	_, err = ws4.NewRequestBuilder().
+		WithValuesValidator(maxLen).
+		AddQuery("SELECT 1").
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 100, "val": "OK"}).
+		WithValues(map[string]interface{}{"id": 101, "val": "TOO LONG"}).
+		Build()
+	if !errors.Is(err, errTooLong) || err.Error() != `in request #1, batch item #1: invalid value for "val": too long` {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err = ws4.NewRequestBuilder().
+		WithValuesValidator(func(key string, value interface{}) error {
+			if _, ok := value.(int); !ok {
+				return fmt.Errorf("not an int: %T", value)
+			}
+			return nil
+		}).
+		AddQuery("SELECT * FROM TEMP WHERE ID = :id").
+		WithValues(map[string]interface{}{"id": "1"}).
+		Build()
+	if err == nil || err.Error() != `in request #0: invalid value for "id": not an int: string` {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err = ws4.NewRequestBuilder().WithValuesValidator(nil).AddQuery("SELECT 1").Build(); err == nil {
+		t.Error("did not fail, but should have")
+	}
+}
+
+func TestExtraField(t *testing.T) {
+	request, err := ws4.NewRequestBuilder().
+		WithExtraField("priority", "low").
+		WithExtraField("trace", map[string]interface{}{"id": 1}).
+		WithExtraField("priority", "high").
+		AddQuery("SELECT 1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := sentBody(t, request)
+	expected := `{"priority":"high","trace":{"id":1},"transaction":[{"query":"SELECT 1"}]}`
+	if string(body) != expected {
+		t.Errorf("unexpected body: %s", body)
+	}
+
+	// the same with a streamed body
+	var streamed []byte
+	srv := captureServer(t, `{"results":[{"success":true,"resultSet":[]}]}`, &streamed)
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).WithStreamingRequestBody().Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Fatal(err)
+	}
+	var sent map[string]interface{}
+	if err = json.Unmarshal(streamed, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent["priority"] != "high" || sent["transaction"] == nil {
+		t.Errorf("unexpected body: %s", streamed)
+	}
+
+	// the Marshaller of the Client encodes the whole request
+	var captured []byte
+	srv = captureServer(t, `{"results":[{"success":true,"resultSet":[]}]}`, &captured)
+	client, err = ws4.NewClientBuilder().WithURL(srv.URL).WithMarshaller(noEscapeMarshaller{}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err = ws4.NewRequestBuilder().
+		WithExtraField("note", "<x>").
+		WithExtraField("big", int64(9007199254740993)).
+		AddQuery("SELECT 1").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Fatal(err)
+	}
+	if string(captured) != `{"big":9007199254740993,"note":"<x>","transaction":[{"query":"SELECT 1"}]}` {
+		t.Errorf("unexpected body: %s", captured)
+	}
+
+	// ws4sqlite ignores it
+	client, err = ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb2").
+		WithInlineAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+
+	for _, key := range []string{"", "transaction", "credentials"} {
+		if _, err = ws4.NewRequestBuilder().WithExtraField(key, 1).AddQuery("SELECT 1").Build(); err == nil {
+			t.Errorf("did not fail for %q, but should have", key)
+		}
+	}
+}
+
+func TestResultSchema(t *testing.T) {
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := map[string]reflect.Kind{
+		"I":  reflect.Int64,
+		"F":  reflect.Float64,
+		"S":  reflect.String,
+		"B":  reflect.Bool,
+		"T":  reflect.Struct,
+		"U":  reflect.Struct,
+		"BL": reflect.Slice,
+		"N":  reflect.Int64,
+	}
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT 1 AS I, 2.5 AS F, 'x' AS S, 1 AS B, datetime(0, 'unixepoch') AS T, 86400 AS U, X'0102' AS BL, NULL AS N, 3 AS OTHER").
+		WithResultSchema(schema).
+		AddQuery("SELECT 1 AS I").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"I":     int64(1),
+		"F":     2.5,
+		"S":     "x",
+		"B":     true,
+		"T":     time.Unix(0, 0).UTC(),
+		"U":     time.Unix(86400, 0).UTC(),
+		"BL":    []byte{1, 2},
+		"N":     nil,
+		"OTHER": float64(3),
+	}
+	if !reflect.DeepEqual(res.Results[0].ResultSet[0], expected) {
+		t.Errorf("unexpected record: %#v", res.Results[0].ResultSet[0])
+	}
+	if res.Results[1].ResultSet[0]["I"] != float64(1) {
+		t.Errorf("unexpected record: %#v", res.Results[1].ResultSet[0])
+	}
+
+	for sql, schema := range map[string]map[string]reflect.Kind{
+		"SELECT 1.5 AS I":   {"I": reflect.Int64},
+		"SELECT 'x' AS I":   {"I": reflect.Int64},
+		"SELECT 2 AS B":     {"B": reflect.Bool},
+		"SELECT 'x' AS T":   {"T": reflect.Struct},
+		"SELECT 1 AS S":     {"S": reflect.String},
+		"SELECT 1 AS OTHER": {"I": reflect.Int64},
+	} {
+		request, err = ws4.NewRequestBuilder().AddQuery(sql).WithResultSchema(schema).Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = client.Send(request); !errors.Is(err, ws4.ErrSchemaMismatch) {
+			t.Errorf("unexpected error for %s: %v", sql, err)
+		}
+	}
+
+	for _, rb := range []*ws4.RequestBuilder{
+		ws4.NewRequestBuilder().AddQuery("SELECT 1").WithResultSchema(nil),
+		ws4.NewRequestBuilder().AddStatement("DELETE FROM TEMP").WithResultSchema(map[string]reflect.Kind{"I": reflect.Int64}),
+		ws4.NewRequestBuilder().AddQuery("SELECT 1").WithResultSchema(map[string]reflect.Kind{"I": reflect.Int32}),
+	} {
+		if _, err = rb.Build(); err == nil {
+			t.Error("did not fail, but should have")
+		}
+	}
+}
+
+func TestAuthChallengeErrors(t *testing.T) {
+	var challenge string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", challenge)
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, "Unauthorized")
+	}))
+	t.Cleanup(srv.Close)
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT 1").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge = `Basic realm="ws4sqlite", charset="UTF-8"`
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).WithAuthChallengeErrors().Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, code, err := client.Send(request)
+	var cherr ws4.AuthChallengeError
+	if code != 401 || !errors.As(err, &cherr) {
+		t.Fatalf("unexpected error: %d %v", code, err)
+	}
+	if cherr.Scheme != "Basic" || cherr.Realm != "ws4sqlite" || cherr.AuthMode != ws4.AUTH_MODE_NONE {
+		t.Errorf("unexpected error: %+v", cherr)
+	}
+	if err.Error() != `the server requires Basic authentication (realm "ws4sqlite"), but the client uses NONE authentication; see ClientBuilder.WithHTTPAuth` {
+		t.Errorf("unexpected message: %s", err)
+	}
+	var wserr ws4.WsError
+	if !errors.As(err, &wserr) || !wserr.IsUnauthorized() {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// with the same scheme, the credentials are wrong: a plain WsError
+	client, err = ws4.NewClientBuilder().WithURL(srv.URL).WithHTTPAuth("a", "b").WithAuthChallengeErrors().Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); errors.As(err, &cherr) || !errors.As(err, &wserr) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	challenge = "Bearer"
+	if _, _, err = client.Send(request); !errors.As(err, &cherr) || cherr.Scheme != "Bearer" || cherr.AuthMode != ws4.AUTH_MODE_HTTP {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// not enabled
+	client, err = ws4.NewClientBuilder().WithURL(srv.URL).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); errors.As(err, &cherr) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestMergedValues(t *testing.T) {
+	defaults := map[string]interface{}{"id": 1, "val": "DEFAULT"}
+	overrides := map[string]interface{}{"val": "ONE"}
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT * FROM TEMP WHERE ID = :id AND VAL = :val").
+		WithMergedValues(defaults, nil, overrides).
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 100, "val": "A"}).
+		WithMergedValues(map[string]interface{}{"val": "B"}).
+		AddStatement("INSERT INTO TEMP (ID, VAL) VALUES (:id, :val)").
+		WithValues(map[string]interface{}{"id": 101, "val": "C"}).
+		WithValues(map[string]interface{}{"id": 102, "val": "D"}).
+		WithMergedValues(map[string]interface{}{"val": "E"}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if defaults["val"] != "DEFAULT" || len(overrides) != 1 {
+		t.Errorf("the maps were modified: %v %v", defaults, overrides)
+	}
+	var sent struct {
+		Transaction []struct {
+			Values      map[string]interface{}
+			ValuesBatch []map[string]interface{}
+		}
+	}
+	if err = json.Unmarshal(sentBody(t, request), &sent); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(sent.Transaction[0].Values, map[string]interface{}{"id": float64(1), "val": "ONE"}) {
+		t.Errorf("unexpected values: %v", sent.Transaction[0].Values)
+	}
+	if sent.Transaction[1].ValuesBatch != nil || !reflect.DeepEqual(sent.Transaction[1].Values, map[string]interface{}{"id": float64(100), "val": "B"}) {
+		t.Errorf("unexpected values: %v %v", sent.Transaction[1].Values, sent.Transaction[1].ValuesBatch)
+	}
+	if !reflect.DeepEqual(sent.Transaction[2].ValuesBatch, []map[string]interface{}{
+		{"id": float64(101), "val": "C"},
+		{"id": float64(102), "val": "E"},
+	}) {
+		t.Errorf("unexpected batch: %v", sent.Transaction[2].ValuesBatch)
+	}
+
+	client, err := ws4.NewClientBuilder().
+		WithURLComponents(ws4.PROTOCOL_HTTP, "localhost", 12321, "mydb").
+		WithHTTPAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err = ws4.NewRequestBuilder().
+		AddQuery("SELECT * FROM TEMP WHERE ID = :id AND VAL = :val").
+		WithMergedValues(defaults, overrides).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, _, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Results[0].ResultSet) != 1 {
+		t.Errorf("unexpected records: %v", res.Results[0].ResultSet)
+	}
+
+	for _, rb := range []*ws4.RequestBuilder{
+		ws4.NewRequestBuilder().AddQuery("SELECT 1").WithMergedValues(),
+		ws4.NewRequestBuilder().AddQuery("SELECT :a").WithMergedValues(overrides).WithValues(map[string]interface{}{"a": 1}),
+	} {
+		if _, err = rb.Build(); err == nil {
+			t.Error("did not fail, but should have")
+		}
+	}
+}
+
+func TestResultSchemaCache(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		io.WriteString(w, `{"results":[{"success":true,"resultSet":[{"N":1}]}]}`)
+	}))
+	t.Cleanup(srv.Close)
+	client, err := ws4.NewClientBuilder().WithURL(srv.URL).WithResponseCache(time.Minute, 10).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	withSchema, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT N FROM T").
+		WithResultSchema(map[string]reflect.Kind{"N": reflect.Bool}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ws4.NewRequestBuilder().AddQuery("SELECT N FROM T").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range []struct {
+		req      *ws4.Request
+		expected interface{}
+		calls    int32
+	}{
+		{withSchema, true, 1},
+		{plain, float64(1), 2},
+		{withSchema, true, 2},
+		{plain, float64(1), 2},
+	} {
+		res, _, err := client.Send(c.req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := res.Results[0].ResultSet[0]["N"]; v != c.expected {
+			t.Errorf("#%d: unexpected value: %#v", i, v)
+		}
+		if n := atomic.LoadInt32(&calls); n != c.calls {
+			t.Errorf("#%d: calls = %d, expected %d", i, n, c.calls)
+		}
+	}
+}
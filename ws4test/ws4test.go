@@ -0,0 +1,281 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+// Package ws4test provides a mock ws4sqlite server, to test the code that uses the client
+// without running a real server.
+//
+// Expectations are registered with On, giving a Matcher for the incoming requests and the
+// response to return; the first registered expectation that matches is used. All the
+// received requests are recorded, and can be inspected with Calls.
+//
+// Example:
+//
+//	srv := ws4test.NewServer(t)
+//	srv.On(ws4test.HasSQL("SELECT * FROM TEMP")).
+//	    Respond(&ws4.Response{Results: []ws4.ResponseItem{{
+//	        Success:   true,
+//	        ResultSet: []map[string]interface{}{{"ID": 1, "VAL": "ONE"}},
+//	    }}})
+//	cli, err := ws4.NewClientBuilder().WithURL(srv.URL + "/mydb").Build()
+//	// ...
+//	srv.AssertExpectations(t)
+package ws4test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	ws4 "github.com/proofrock/ws4sqlite-client-go"
+)
+
+// Credentials sent inline in a request.
+type Credentials struct {
+	User     string
+	Password string
+}
+
+// A request received by the mock server. Numeric values are decoded as float64, as
+// encoding/json does.
+type Call struct {
+	// Path of the request, e.g. "/mydb"
+	Path string
+	// HTTP headers of the request
+	Header http.Header
+	// Inline credentials, if any
+	Credentials *Credentials
+	// Whether the request was marked read-only
+	ReadOnly bool
+	// Request-level metadata, if any
+	Metadata map[string]interface{}
+	// The nodes of the request, in order
+	Transaction []ws4.RequestItem
+	// The raw body of the request
+	Body []byte
+}
+
+// Tells if a request should be handled by an expectation.
+type Matcher func(c Call) bool
+
+// Matches every request.
+func Any() Matcher {
+	return func(c Call) bool { return true }
+}
+
+// Matches the requests that have a query or statement with exactly the given SQL.
+func HasSQL(sql string) Matcher {
+	return func(c Call) bool {
+		for _, item := range c.Transaction {
+			if item.Query == sql || item.Statement == sql {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Matches the requests sent to the given database, i.e. whose path ends with "/" + db.
+func ForDatabase(db string) Matcher {
+	return func(c Call) bool {
+		return strings.HasSuffix(c.Path, "/"+db)
+	}
+}
+
+// Matches the requests that satisfy all the given matchers.
+func All(matchers ...Matcher) Matcher {
+	return func(c Call) bool {
+		for _, m := range matchers {
+			if !m(c) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// An expectation registered on a Server with On. By default it responds with an empty
+// successful response. It must be configured before the requests are sent.
+type Expectation struct {
+	match  Matcher
+	status int
+	body   []byte
+	calls  int
+}
+
+// Sets the Response to return; it's serialized as ws4sqlite would. A successful item with
+// RowsUpdated or RowsUpdatedBatch is a statement, otherwise it's a query.
+func (e *Expectation) Respond(res *ws4.Response) *Expectation {
+	items := make([]map[string]interface{}, 0, len(res.Results))
+	for _, ri := range res.Results {
+		item := map[string]interface{}{"success": ri.Success}
+		switch {
+		case !ri.Success:
+			item["error"] = ri.Error
+		case ri.RowsUpdated != nil:
+			item["rowsUpdated"] = *ri.RowsUpdated
+		case ri.RowsUpdatedBatch != nil:
+			item["rowsUpdatedBatch"] = ri.RowsUpdatedBatch
+		case ri.ResultSet != nil:
+			item["resultSet"] = ri.ResultSet
+		default:
+			item["resultSet"] = []interface{}{}
+		}
+		items = append(items, item)
+	}
+	bs, err := json.Marshal(map[string]interface{}{"results": items})
+	if err != nil {
+		panic(err)
+	}
+	return e.RespondRaw(http.StatusOK, bs)
+}
+
+// Sets an error to return, as ws4sqlite would; reqIdx is the index of the failing node,
+// or -1 for a generic error.
+func (e *Expectation) RespondError(code, reqIdx int, msg string) *Expectation {
+	bs, err := json.Marshal(ws4.WsError{RequestIdx: reqIdx, Msg: msg})
+	if err != nil {
+		panic(err)
+	}
+	return e.RespondRaw(code, bs)
+}
+
+// Sets the status code and the body to return, verbatim.
+func (e *Expectation) RespondRaw(code int, body []byte) *Expectation {
+	e.status = code
+	e.body = body
+	return e
+}
+
+// A mock ws4sqlite server. It's closed when the test ends.
+type Server struct {
+	// Base URL of the server, e.g. "http://127.0.0.1:1234"; append the database name
+	URL string
+
+	t            testing.TB
+	srv          *httptest.Server
+	mu           sync.Mutex
+	expectations []*Expectation
+	calls        []Call
+}
+
+// Starts a new mock server; it's closed when the test ends. Requests that don't match
+// any expectation fail the test, and get a 500 response.
+func NewServer(t testing.TB) *Server {
+	s := &Server{t: t}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.handle))
+	s.URL = s.srv.URL
+	t.Cleanup(s.srv.Close)
+	return s
+}
+
+// Registers an expectation for the requests that match m.
+func (s *Server) On(m Matcher) *Expectation {
+	e := &Expectation{match: m, status: http.StatusOK, body: []byte(`{"results":[]}`)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expectations = append(s.expectations, e)
+	return e
+}
+
+// Returns the requests received so far, in order.
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call{}, s.calls...)
+}
+
+// Fails the test if any expectation wasn't matched by at least a request.
+func (s *Server) AssertExpectations(t testing.TB) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.expectations {
+		if e.calls == 0 {
+			t.Errorf("ws4test: expectation #%d was never matched", i)
+		}
+	}
+}
+
+// Fails the test if no request received so far matches m.
+func (s *Server) AssertCalled(t testing.TB, m Matcher) {
+	t.Helper()
+	for _, c := range s.Calls() {
+		if m(c) {
+			return
+		}
+	}
+	t.Error("ws4test: no request matched")
+}
+
+type wireRequest struct {
+	Credentials *Credentials           `json:"credentials"`
+	ReadOnly    bool                   `json:"readOnly"`
+	Metadata    map[string]interface{} `json:"metadata"`
+	Transaction []ws4.RequestItem      `json:"transaction"`
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.t.Errorf("ws4test: reading the request: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var wr wireRequest
+	if err = json.Unmarshal(body, &wr); err != nil {
+		s.t.Errorf("ws4test: malformed request: %v", err)
+		writeJSON(w, http.StatusBadRequest, []byte(`{"reqIdx":-1,"error":"malformed request"}`))
+		return
+	}
+	call := Call{
+		Path:        r.URL.Path,
+		Header:      r.Header.Clone(),
+		Credentials: wr.Credentials,
+		ReadOnly:    wr.ReadOnly,
+		Metadata:    wr.Metadata,
+		Transaction: wr.Transaction,
+		Body:        body,
+	}
+
+	s.mu.Lock()
+	s.calls = append(s.calls, call)
+	var matched *Expectation
+	for _, e := range s.expectations {
+		if e.match(call) {
+			matched = e
+			e.calls++
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	if matched == nil {
+		s.t.Errorf("ws4test: unexpected request: %s", body)
+		writeJSON(w, http.StatusInternalServerError, []byte(`{"reqIdx":-1,"error":"unexpected request"}`))
+		return
+	}
+	writeJSON(w, matched.status, matched.body)
+}
+
+func writeJSON(w http.ResponseWriter, code int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
@@ -0,0 +1,215 @@
+/*
+  Copyright (c) 2022-, Germano Rizzo <oss /AT/ germanorizzo /DOT/ it>
+
+  Permission to use, copy, modify, and/or distribute this software for any
+  purpose with or without fee is hereby granted, provided that the above
+  copyright notice and this permission notice appear in all copies.
+
+  THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+  WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+  MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+  ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+  WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+  ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+  OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+*/
+
+package ws4test_test
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+
+	ws4 "github.com/proofrock/ws4sqlite-client-go"
+	"github.com/proofrock/ws4sqlite-client-go/ws4test"
+)
+
+func newClient(t *testing.T, srv *ws4test.Server) *ws4.Client {
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL+"/mydb").
+		WithInlineAuth("myUser1", "myHotPassword").
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestRespond(t *testing.T) {
+	srv := ws4test.NewServer(t)
+	one := int64(1)
+	srv.On(ws4test.HasSQL("SELECT * FROM TEMP")).
+		Respond(&ws4.Response{Results: []ws4.ResponseItem{
+			{Success: true, ResultSet: []map[string]interface{}{{"ID": 1, "VAL": "ONE"}}},
+			{Success: true, RowsUpdated: &one},
+			{Success: true, RowsUpdatedBatch: []int64{1, 0}},
+			{Success: true},
+			{Success: false, Error: "boom"},
+		}})
+	client := newClient(t, srv)
+
+	request, err := ws4.NewRequestBuilder().
+		AddQuery("SELECT * FROM TEMP").
+		AddStatement("UPDATE TEMP SET VAL = 'X' WHERE ID = :id").
+		WithValues(map[string]interface{}{"id": 1}).
+		AddStatement("DELETE FROM TEMP WHERE ID = :id").
+		WithValues(map[string]interface{}{"id": 1}).
+		WithValues(map[string]interface{}{"id": 2}).
+		AddQuery("SELECT * FROM TEMP WHERE 0").
+		AddStatement("BAD").
+		WithNoFail().
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, code, err := client.Send(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 200 {
+		t.Errorf("unexpected code %d", code)
+	}
+	if len(res.Results) != 5 {
+		t.Fatalf("unexpected results: %d", len(res.Results))
+	}
+	if res.Results[0].ResultSet[0]["VAL"] != "ONE" {
+		t.Errorf("unexpected result set: %v", res.Results[0].ResultSet)
+	}
+	if *res.Results[1].RowsUpdated != 1 {
+		t.Errorf("unexpected rows updated: %d", *res.Results[1].RowsUpdated)
+	}
+	if fmt.Sprint(res.Results[2].RowsUpdatedBatch) != "[1 0]" {
+		t.Errorf("unexpected batch: %v", res.Results[2].RowsUpdatedBatch)
+	}
+	if res.Results[3].ResultSet == nil || len(res.Results[3].ResultSet) != 0 {
+		t.Errorf("unexpected empty result set: %v", res.Results[3].ResultSet)
+	}
+	if res.Results[4].Success || res.Results[4].Error != "boom" {
+		t.Errorf("unexpected error item: %+v", res.Results[4])
+	}
+
+	calls := srv.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("unexpected calls: %d", len(calls))
+	}
+	c := calls[0]
+	if c.Path != "/mydb" {
+		t.Errorf("unexpected path %s", c.Path)
+	}
+	if c.Credentials == nil || c.Credentials.User != "myUser1" {
+		t.Errorf("unexpected credentials: %v", c.Credentials)
+	}
+	if len(c.Transaction) != 5 || c.Transaction[1].Values["id"] != float64(1) || len(c.Transaction[2].ValuesBatch) != 2 || !c.Transaction[4].NoFail {
+		t.Errorf("unexpected transaction: %+v", c.Transaction)
+	}
+	srv.AssertExpectations(t)
+	srv.AssertCalled(t, ws4test.All(ws4test.ForDatabase("mydb"), ws4test.HasSQL("BAD")))
+}
+
+func TestRespondError(t *testing.T) {
+	srv := ws4test.NewServer(t)
+	srv.On(ws4test.HasSQL("SELECT 2")).RespondError(http.StatusBadRequest, 0, "no such table")
+	srv.On(ws4test.Any())
+	client := newClient(t, srv)
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT 2").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, code, err := client.Send(request)
+	wserr, ok := err.(ws4.WsError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if code != http.StatusBadRequest || wserr.RequestIdx != 0 || wserr.Msg != "no such table" {
+		t.Errorf("unexpected error: %d %+v", code, wserr)
+	}
+
+	// falls through to the second expectation
+	request, err = ws4.NewRequestBuilder().AddQuery("SELECT 1").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Error(err)
+	}
+	if len(srv.Calls()) != 2 {
+		t.Errorf("unexpected calls: %d", len(srv.Calls()))
+	}
+	srv.AssertExpectations(t)
+}
+
+type recorder struct {
+	testing.TB
+	errors int
+}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors++
+}
+
+func (r *recorder) Error(args ...interface{}) {
+	r.errors++
+}
+
+func TestUnexpected(t *testing.T) {
+	rec := &recorder{TB: t}
+	srv := ws4test.NewServer(rec)
+	srv.On(ws4test.HasSQL("SELECT 1"))
+	client := newClient(t, srv)
+
+	request, err := ws4.NewRequestBuilder().AddQuery("SELECT 2").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, code, err := client.Send(request); err == nil || code != http.StatusInternalServerError {
+		t.Errorf("unexpected result: %d %v", code, err)
+	}
+	if rec.errors != 1 {
+		t.Errorf("unexpected request was not reported")
+	}
+
+	srv.AssertExpectations(rec)
+	srv.AssertCalled(rec, ws4test.HasSQL("SELECT 1"))
+	if rec.errors != 3 {
+		t.Errorf("unmatched expectations were not reported")
+	}
+}
+
+func TestChunkedMetadata(t *testing.T) {
+	srv := ws4test.NewServer(t)
+	srv.On(ws4test.HasSQL("INSERT INTO TEMP (ID) VALUES (:id)")).
+		Respond(&ws4.Response{Results: []ws4.ResponseItem{{Success: true, RowsUpdatedBatch: []int64{1, 1}}}})
+	client, err := ws4.NewClientBuilder().
+		WithURL(srv.URL + "/mydb").
+		WithBatchChunkSize(2).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := ws4.NewRequestBuilder().
+		WithRequestMetadata(map[string]interface{}{"caller": "etl"}).
+		AddBatchInsert("INSERT INTO TEMP (ID) VALUES (:id)", []map[string]interface{}{
+			{"id": 1}, {"id": 2}, {"id": 3}, {"id": 4},
+		}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Send(request); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := srv.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("%d sub-requests were sent instead of 2", len(calls))
+	}
+	for i, call := range calls {
+		if !reflect.DeepEqual(call.Metadata, map[string]interface{}{"caller": "etl"}) {
+			t.Errorf("unexpected metadata in chunk #%d: %v", i, call.Metadata)
+		}
+	}
+}